@@ -1,55 +1,120 @@
 package client
 
 import (
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"hash/fnv"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
+	"sort"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/chuangyou/qsf/constant"
 	"github.com/chuangyou/qsf/plugin/breaker"
-	registry "github.com/chuangyou/qsf/plugin/loadbalance/registry/etcd"
+	"github.com/chuangyou/qsf/plugin/config"
+	"github.com/chuangyou/qsf/plugin/credential"
+	"github.com/chuangyou/qsf/plugin/graceful"
+	"github.com/chuangyou/qsf/plugin/loadbalance"
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry"
+	_ "github.com/chuangyou/qsf/plugin/loadbalance/registry/consul"
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry/dns"
+	etcd_registry "github.com/chuangyou/qsf/plugin/loadbalance/registry/etcd"
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry/static"
+	_ "github.com/chuangyou/qsf/plugin/loadbalance/registry/zookeeper"
 	"github.com/chuangyou/qsf/plugin/prometheus"
 	"github.com/chuangyou/qsf/plugin/tracing"
-	etcd "github.com/coreos/etcd/clientv3"
 	"github.com/grpc-ecosystem/go-grpc-middleware"
 	"github.com/opentracing/opentracing-go"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/naming"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/credentials"
 )
 
 type Config struct {
-	Name            string              //服务名
-	AccessToken     string              //服务密钥
-	AccessTokenFunc ServiceCredentialer //授权方法
-	RegistryAddrs   []string            //服务注册地址
-	Breaker         *breaker.Breaker    //熔断器
-	Tracer          opentracing.Tracer  //服务tracer
-	GrpcMetrics     *grpc_prometheus.ClientMetrics
+	Name               string              //服务名
+	AccessToken        string              //服务密钥
+	AccessTokenFunc    ServiceCredentialer //授权方法
+	RegistryAddrs      []string            //服务注册地址
+	RegistryKind       string              //注册中心类型：etcd（默认）、consul、zookeeper、dns、static（可选）
+	Discovery          registry.Discovery  //自定义服务发现，设置后忽略RegistryKind和RegistryAddrs（可选）
+	Endpoints          []string            //直连的节点地址，设置后不使用注册中心（可选）
+	Region             string              //客户端所在地域，默认读取环境变量QSF_REGION（可选）
+	Zone               string              //客户端所在可用区，默认读取环境变量QSF_ZONE，优先调用同可用区节点（可选）
+	ZoneSpillover      float64             //同可用区就绪节点比例低于该值时调用其他可用区，默认0.5（可选）
+	LoadBalance        string              //负载均衡策略：loadbalance.RoundRobin（默认）、Random、WeightedRoundRobin、ConsistentHash、LeastRequest、PeakEWMA或其他已注册的balancer
+	Breaker            *breaker.Breaker    //熔断器
+	Tracer             opentracing.Tracer  //服务tracer
+	GrpcMetrics        *grpc_prometheus.ClientMetrics
+	TLSCAFile          string                         //服务端CA证书，设置后启用TLS（可选）
+	TLSServerName      string                         //服务端证书域名（可选）
+	TLSCertFile        string                         //客户端证书（双向TLS，可选）
+	TLSKeyFile         string                         //客户端私钥（双向TLS，可选）
+	UnaryInterceptors  []grpc.UnaryClientInterceptor  //自定义unary拦截器（可选）
+	StreamInterceptors []grpc.StreamClientInterceptor //自定义stream拦截器（可选）
+	Interceptors       []Interceptor                  //具名的自定义拦截器，可按名称排序，默认依次位于custom之后（可选）
+	InterceptorOrder   []string                       //拦截器顺序，默认为DefaultInterceptorOrder()（可选）
+	DialOptions        []grpc.DialOption              //自定义grpc.DialOption，拦截器请使用UnaryInterceptors/StreamInterceptors（可选）
+	ConfigCenter       *config.Center                 //动态配置中心，熔断器、服务密钥（已设置AccessToken时）及日志级别随配置更新（可选）
 }
 type Client struct {
-	GrpcConn *grpc.ClientConn
-	GrpcOpts []grpc.DialOption
+	GrpcConn      *grpc.ClientConn
+	GrpcOpts      []grpc.DialOption
+	Target        string   //服务地址，如qsf://etcd-<注册中心哈希>/example，网关使用GrpcOpts拨号
+	release       func()   //释放Target的服务发现
+	configCancels []func() //取消配置中心的订阅
+	closeOnce     sync.Once
 }
 
+// sharedDiscovery is the discovery added to registry.DefaultResolver for the clients on one registry.
+type sharedDiscovery struct {
+	discovery registry.Discovery
+	owned     bool //created by NewClient, closed with the last client
+	refs      int
+}
+
+var (
+	resolverMu        sync.Mutex
+	discoveries       = make(map[string]*sharedDiscovery) //target authority对应的服务发现
+	customDiscoveries int                                 //自定义服务发现的数量，用于生成authority
+)
+
 func NewClient(config *Config, isGateway bool) (client *Client, err error) {
 	var (
-		r                        naming.Resolver
-		b                        grpc.Balancer
+		balancerName             = config.LoadBalance
+		tlsConfig                *tls.Config
 		grpcOpts                 []grpc.DialOption
+		chain                    = newInterceptorChain()
 		unaryClientInterceptors  []grpc.UnaryClientInterceptor
 		streamClientInterceptors []grpc.StreamClientInterceptor
 	)
-	if config.Name == "" || len(config.RegistryAddrs) == 0 {
+	if len(config.Endpoints) == 0 && (config.Name == "" || (len(config.RegistryAddrs) == 0 && config.Discovery == nil && config.RegistryKind != dns.Kind)) {
 		err = errors.New("service config data error")
 		return
 	}
 	client = new(Client)
-	grpcOpts = append(grpcOpts, grpc.WithInsecure())
+	//unwind what was set up before the error
+	defer func() {
+		if err != nil {
+			client.Close()
+		}
+	}()
+	//enable TLS, and mutual TLS when a client certificate is configured
+	if config.TLSCAFile != "" || config.TLSCertFile != "" || config.TLSKeyFile != "" {
+		tlsConfig, err = credential.NewClientTLSConfig(config.TLSCAFile, config.TLSServerName, config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			return
+		}
+		grpcOpts = append(grpcOpts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	} else {
+		grpcOpts = append(grpcOpts, grpc.WithInsecure())
+	}
 	grpcOpts = append(grpcOpts, grpc.WithInitialWindowSize(constant.InitialWindowSize))
 	grpcOpts = append(grpcOpts, grpc.WithInitialConnWindowSize(constant.InitialConnWindowSize))
 	grpcOpts = append(grpcOpts, grpc.WithDefaultCallOptions(
@@ -63,76 +128,247 @@ func NewClient(config *Config, isGateway bool) (client *Client, err error) {
 		}
 		//setToken
 		config.AccessTokenFunc.SetServiceToken(config.AccessToken)
+		if c, ok := config.AccessTokenFunc.(interface {
+			SetRequireTransportSecurity(bool)
+		}); ok {
+			c.SetRequireTransportSecurity(tlsConfig != nil)
+		}
 		grpcOpts = append(grpcOpts, grpc.WithPerRPCCredentials(config.AccessTokenFunc))
 	}
 
-	//service discovery
-	r = registry.NewResolver(
-		constant.DEFAULT_ETCD_PATH,
-		config.Name,
-		etcd.Config{
-			Endpoints: config.RegistryAddrs,
-		},
-	)
+	//service discovery, or direct connection to the endpoints
+	if len(config.Endpoints) > 0 {
+		client.Target = static.Target(config.Endpoints...)
+	} else {
+		var authority string
+		if authority, client.release, err = addDiscovery(config.RegistryKind, config.RegistryAddrs, config.Discovery); err != nil {
+			return
+		}
+		client.Target = registry.AuthorityTarget(authority, config.Name)
+	}
 	//loadbalance
-	b = grpc.RoundRobin(r)
-	grpcOpts = append(grpcOpts, grpc.WithBalancer(b))
+	if balancerName == "" {
+		balancerName = loadbalance.RoundRobin
+	}
+	if balancer.Get(balancerName) == nil {
+		err = loadbalance.ErrUnknownPolicy
+		return
+	}
+	if config.Region != "" || config.Zone != "" || config.ZoneSpillover > 0 {
+		l := loadbalance.DefaultLocality()
+		if config.Region != "" {
+			l.Region = config.Region
+		}
+		if config.Zone != "" {
+			l.Zone = config.Zone
+		}
+		if config.ZoneSpillover > 0 {
+			l.Spillover = config.ZoneSpillover
+		}
+		if balancerName, err = loadbalance.LocalBalancer(balancerName, l); err != nil {
+			return
+		}
+	}
+	grpcOpts = append(grpcOpts, grpc.WithBalancerName(balancerName))
 	if config.Breaker != nil {
-		unaryClientInterceptors = append(unaryClientInterceptors, breaker.UnaryClientInterceptor(config.Breaker))
+		chain.add(InterceptorBreaker, breaker.UnaryClientInterceptor(config.Breaker), nil)
+	}
+	//update the settings from the config center
+	if config.ConfigCenter != nil {
+		if err = client.watchConfig(config); err != nil {
+			return
+		}
 	}
 	if config.Tracer != nil {
-		unaryClientInterceptors = append(unaryClientInterceptors, otgrpc.OpenTracingClientInterceptor(config.Tracer))
-		streamClientInterceptors = append(streamClientInterceptors, otgrpc.OpenTracingStreamClientInterceptor(config.Tracer))
+		chain.add(InterceptorTracing, otgrpc.OpenTracingClientInterceptor(config.Tracer), otgrpc.OpenTracingStreamClientInterceptor(config.Tracer))
 	}
 	if config.GrpcMetrics != nil {
-		unaryClientInterceptors = append(unaryClientInterceptors, config.GrpcMetrics.UnaryClientInterceptor())
-		streamClientInterceptors = append(streamClientInterceptors, config.GrpcMetrics.StreamClientInterceptor())
+		chain.add(InterceptorPrometheus, config.GrpcMetrics.UnaryClientInterceptor(), config.GrpcMetrics.StreamClientInterceptor())
 	}
-	if len(unaryClientInterceptors) > 0 && len(streamClientInterceptors) > 0 {
-		grpcOpts = append(grpcOpts, grpc.WithUnaryInterceptor(grpc_middleware.ChainUnaryClient(unaryClientInterceptors...)))
-		grpcOpts = append(grpcOpts, grpc.WithStreamInterceptor(grpc_middleware.ChainStreamClient(streamClientInterceptors...)))
-	} else if len(unaryClientInterceptors) > 0 {
+	//latency of the calls for the peak EWMA balancers
+	chain.add(InterceptorLoadBalance, loadbalance.UnaryClientInterceptor(), nil)
+	//custom interceptors
+	for _, interceptor := range config.UnaryInterceptors {
+		chain.add(InterceptorCustom, interceptor, nil)
+	}
+	for _, interceptor := range config.StreamInterceptors {
+		chain.add(InterceptorCustom, nil, interceptor)
+	}
+	slot := InterceptorCustom
+	for _, interceptor := range config.Interceptors {
+		if err = chain.Slot(interceptor.Name, slot); err != nil {
+			return
+		}
+		chain.add(interceptor.Name, interceptor.Unary, interceptor.Stream)
+		slot = interceptor.Name
+	}
+	unaryClientInterceptors, streamClientInterceptors, err = chain.build(config.InterceptorOrder)
+	if err != nil {
+		return
+	}
+	if len(unaryClientInterceptors) > 0 {
 		grpcOpts = append(grpcOpts, grpc.WithUnaryInterceptor(grpc_middleware.ChainUnaryClient(unaryClientInterceptors...)))
-	} else if len(streamClientInterceptors) > 0 {
+	}
+	if len(streamClientInterceptors) > 0 {
 		grpcOpts = append(grpcOpts, grpc.WithStreamInterceptor(grpc_middleware.ChainStreamClient(streamClientInterceptors...)))
 	}
+	grpcOpts = append(grpcOpts, config.DialOptions...)
 	if isGateway {
 		client.GrpcOpts = grpcOpts
 	} else {
-		client.GrpcConn, err = grpc.Dial("", grpcOpts...)
+		client.GrpcConn, err = grpc.Dial(client.Target, grpcOpts...)
 	}
 
 	return
 }
 
-func HandleSignal(httpServer http.Server) {
+// watchConfig subscribes the breaker, the access token and the log level to the config center until the
+// client is closed.
+func (c *Client) watchConfig(conf *Config) (err error) {
+	var (
+		cancel func()
+	)
+	if cancel, err = config.WatchLogLevel(conf.ConfigCenter); err != nil {
+		return
+	}
+	c.configCancels = append(c.configCancels, cancel)
+	if conf.AccessToken != "" {
+		if cancel, err = config.WatchAccessToken(conf.ConfigCenter, conf.AccessTokenFunc.SetServiceToken); err != nil {
+			return
+		}
+		c.configCancels = append(c.configCancels, cancel)
+	}
+	if conf.Breaker != nil {
+		if cancel, err = config.WatchBreaker(conf.ConfigCenter, conf.Breaker); err != nil {
+			return
+		}
+		c.configCancels = append(c.configCancels, cancel)
+	}
+	return
+}
+
+// Close cancels the config center subscriptions, closes GrpcConn and releases the discovery of Target,
+// closing it with the last client on its registry. In gateway mode the connections dialed with GrpcOpts
+// must be closed before.
+func (c *Client) Close() (err error) {
+	c.closeOnce.Do(func() {
+		for _, cancel := range c.configCancels {
+			cancel()
+		}
+		if c.GrpcConn != nil {
+			err = c.GrpcConn.Close()
+		}
+		if c.release != nil {
+			c.release()
+		}
+	})
+	return
+}
+
+// addDiscovery adds the discovery of the client to registry.DefaultResolver and returns the authority of
+// its targets. The clients on the same registry kind and addresses share one discovery under an
+// "<kind>-<hash of the addresses>" authority, while every custom discovery gets a numbered authority.
+// release removes the discovery once every client sharing it released it.
+func addDiscovery(kind string, registryAddrs []string, discovery registry.Discovery) (authority string, release func(), err error) {
+	var (
+		shared *sharedDiscovery
+		ok     bool
+	)
+	resolverMu.Lock()
+	defer resolverMu.Unlock()
+	if discovery != nil {
+		customDiscoveries++
+		authority = fmt.Sprintf("discovery-%d", customDiscoveries)
+		shared = &sharedDiscovery{discovery: discovery}
+	} else {
+		if kind == "" {
+			kind = etcd_registry.Kind
+		}
+		addrs := append([]string(nil), registryAddrs...)
+		sort.Strings(addrs)
+		h := fnv.New64a()
+		h.Write([]byte(strings.Join(addrs, ",")))
+		authority = fmt.Sprintf("%s-%x", kind, h.Sum64())
+		if shared, ok = discoveries[authority]; !ok {
+			if discovery, err = registry.NewDiscovery(kind, registryAddrs); err != nil {
+				return
+			}
+			shared = &sharedDiscovery{discovery: discovery, owned: true}
+		}
+	}
+	if shared.refs == 0 {
+		discoveries[authority] = shared
+		registry.DefaultResolver.Add(authority, shared.discovery)
+	}
+	shared.refs++
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			resolverMu.Lock()
+			defer resolverMu.Unlock()
+			if shared.refs--; shared.refs > 0 {
+				return
+			}
+			delete(discoveries, authority)
+			registry.DefaultResolver.Remove(authority)
+			if shared.owned {
+				shared.discovery.Close()
+			}
+		})
+	}
+	return
+}
+
+// HandleSignal blocks until a system signal arrives and then shuts the gateway http server down,
+// draining it for at most constant.DEFAULT_SHUTDOWN_TIMEOUT.
+//
+// Deprecated: use HandleSignals, which takes the shutdown timeout and several servers.
+func HandleSignal(httpServer *http.Server) {
+	HandleSignals(constant.DEFAULT_SHUTDOWN_TIMEOUT, httpServer)
+}
+
+// HandleSignals blocks until a system signal arrives and then shuts the gateway http servers down.
+// On SIGHUP the listeners created by graceful.Listen are handed over to a new process first,
+// and the servers are only drained once the new process is ready. Draining is bounded by
+// shutdownTimeout, after which the servers are closed forcibly.
+func HandleSignals(shutdownTimeout time.Duration, httpServers ...*http.Server) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
 	for {
 		systemSignal := <-c
 		log.Println("server get a signal ", systemSignal.String())
-		switch systemSignal {
-		case syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT:
-			signal.Stop(c)
-			httpServer.Shutdown(nil)
-			return
-		case syscall.SIGHUP:
-			signal.Stop(c)
-			httpServer.Shutdown(nil)
-			cmd := exec.Command(os.Args[0], os.Args[1:]...)
-			err := cmd.Start()
+		if systemSignal == syscall.SIGHUP {
+			pid, err := graceful.Restart(constant.DEFAULT_RESTART_TIMEOUT)
 			if err != nil {
-				log.Println("cmd.Start fail: ", err)
-				return
+				log.Println("restart fail: ", err)
+				continue
 			}
-			log.Println("forked new pid : ", cmd.Process.Pid)
-			return
-		default:
-			signal.Stop(c)
-			httpServer.Shutdown(nil)
-			return
+			log.Println("forked new pid : ", pid)
 		}
+		signal.Stop(c)
+		shutdown(shutdownTimeout, httpServers)
+		return
+	}
+}
+
+// shutdown drains the http servers together, closing those still draining once timeout expires.
+func shutdown(timeout time.Duration, httpServers []*http.Server) {
+	var (
+		wg sync.WaitGroup
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, httpServer := range httpServers {
+		wg.Add(1)
+		go func(httpServer *http.Server) {
+			defer wg.Done()
+			if err := httpServer.Shutdown(ctx); err != nil {
+				log.Println("shutdown http server error: ", err)
+				httpServer.Close()
+			}
+		}(httpServer)
 	}
+	wg.Wait()
 }
 
 type ServiceCredentialer interface {
@@ -141,17 +377,28 @@ type ServiceCredentialer interface {
 	RequireTransportSecurity() bool
 }
 type ServiceCredential struct {
-	serviceToken string
+	mu                       sync.RWMutex
+	serviceToken             string
+	requireTransportSecurity bool
 }
 
 func (c *ServiceCredential) SetServiceToken(token string) {
+	c.mu.Lock()
 	c.serviceToken = token
+	c.mu.Unlock()
 }
 func (c *ServiceCredential) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return map[string]string{
 		"authorization": "basic " + c.serviceToken,
 	}, nil
 }
+
+// SetRequireTransportSecurity makes the token only be sent over TLS connections.
+func (c *ServiceCredential) SetRequireTransportSecurity(require bool) {
+	c.requireTransportSecurity = require
+}
 func (c *ServiceCredential) RequireTransportSecurity() bool {
-	return false
+	return c.requireTransportSecurity
 }
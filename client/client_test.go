@@ -0,0 +1,245 @@
+package client
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chuangyou/qsf/internal/etcdtest"
+	"github.com/chuangyou/qsf/plugin/config"
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry"
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry/static"
+	"github.com/chuangyou/qsf/server"
+	etcd3 "github.com/coreos/etcd/clientv3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+)
+
+// startService starts a service without a registry on a free local port.
+func startService(t *testing.T) (string, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := lis.Addr().String()
+	lis.Close()
+	s, err := server.NewSevice(&server.Config{Name: "example", Addr: addr, NodeId: "node-" + addr})
+	require.NoError(t, err)
+	require.NoError(t, s.Start(context.Background()))
+	return addr, func() { s.Stop(context.Background()) }
+}
+
+func TestDirectConnect(t *testing.T) {
+	a, stopA := startService(t)
+	defer stopA()
+	b, stopB := startService(t)
+	defer stopB()
+
+	c, err := NewClient(&Config{Endpoints: []string{a, b}}, false)
+	require.NoError(t, err)
+	defer c.GrpcConn.Close()
+	assert.Equal(t, static.Target(a, b), c.Target)
+
+	// the calls are balanced over both endpoints once they are connected
+	hc := healthpb.NewHealthClient(c.GrpcConn)
+	seen := make(map[string]bool)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(seen) < 2 && time.Now().Before(deadline) {
+		var p peer.Peer
+		resp, err := hc.Check(context.Background(), &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true), grpc.Peer(&p))
+		require.NoError(t, err)
+		assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+		seen[p.Addr.String()] = true
+	}
+	assert.Equal(t, map[string]bool{a: true, b: true}, seen)
+}
+
+// peers returns the addresses serving the calls of conn.
+func peers(t *testing.T, conn *grpc.ClientConn) map[string]bool {
+	hc := healthpb.NewHealthClient(conn)
+	seen := make(map[string]bool)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 10; i++ {
+		var p peer.Peer
+		_, err := hc.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true), grpc.Peer(&p))
+		require.NoError(t, err)
+		seen[p.Addr.String()] = true
+	}
+	return seen
+}
+
+func TestTwoRegistries(t *testing.T) {
+	a, stopA := startService(t)
+	defer stopA()
+	b, stopB := startService(t)
+	defer stopB()
+
+	// every registry resolves under its own authority of the qsf scheme
+	ca, err := NewClient(&Config{Name: "example", RegistryKind: static.Kind, RegistryAddrs: []string{a}}, false)
+	require.NoError(t, err)
+	defer ca.Close()
+	cb, err := NewClient(&Config{Name: "example", RegistryKind: static.Kind, RegistryAddrs: []string{b}}, false)
+	require.NoError(t, err)
+	defer cb.Close()
+	assert.Regexp(t, `^qsf://static-[0-9a-f]+/example$`, ca.Target)
+	assert.NotEqual(t, ca.Target, cb.Target)
+	assert.Equal(t, map[string]bool{a: true}, peers(t, ca.GrpcConn))
+	assert.Equal(t, map[string]bool{b: true}, peers(t, cb.GrpcConn))
+
+	// the same registry shares its resolver, a gateway dials the target itself
+	gateway, err := NewClient(&Config{Name: "example", RegistryKind: static.Kind, RegistryAddrs: []string{a}}, true)
+	require.NoError(t, err)
+	assert.Equal(t, ca.Target, gateway.Target)
+	assert.Nil(t, gateway.GrpcConn)
+	conn, err := grpc.Dial(gateway.Target, gateway.GrpcOpts...)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, map[string]bool{a: true}, peers(t, conn))
+
+	// so does a custom discovery, even one that is not comparable
+	discovery := listDiscovery{Discovery: static.NewDiscovery(registry.NodeData{Addr: b}), nodes: []string{b}}
+	cd, err := NewClient(&Config{Name: "example", Discovery: discovery}, false)
+	require.NoError(t, err)
+	defer cd.Close()
+	assert.Equal(t, map[string]bool{b: true}, peers(t, cd.GrpcConn))
+}
+
+// listDiscovery is not comparable because of its slice.
+type listDiscovery struct {
+	registry.Discovery
+	nodes []string
+}
+
+func TestCloseReleasesDiscovery(t *testing.T) {
+	a, stop := startService(t)
+	defer stop()
+	config := &Config{Name: "example", RegistryKind: static.Kind, RegistryAddrs: []string{a}}
+	c1, err := NewClient(config, false)
+	require.NoError(t, err)
+	c2, err := NewClient(config, false)
+	require.NoError(t, err)
+	authority := strings.TrimSuffix(strings.TrimPrefix(c1.Target, "qsf://"), "/example")
+	discovery := discoveries[authority]
+	require.NotNil(t, discovery)
+	assert.Equal(t, 2, discovery.refs)
+
+	// the discovery is kept until the last client on the registry is closed
+	require.NoError(t, c1.Close())
+	assert.NoError(t, c1.Close())
+	assert.Equal(t, 1, discovery.refs)
+	assert.Equal(t, map[string]bool{a: true}, peers(t, c2.GrpcConn))
+	require.NoError(t, c2.Close())
+	_, ok := discoveries[authority]
+	assert.False(t, ok)
+
+	// a failed client releases the discovery too
+	_, err = NewClient(&Config{Name: "example", RegistryKind: static.Kind, RegistryAddrs: []string{a}, LoadBalance: "unknown"}, false)
+	assert.Error(t, err)
+	_, ok = discoveries[authority]
+	assert.False(t, ok)
+}
+
+func TestCloseCancelsConfig(t *testing.T) {
+	etcd, err := etcdtest.NewServer()
+	require.NoError(t, err)
+	defer etcd.Close()
+	etcd.Put("/qsf.config/example/"+config.AuthItem, "accessToken: new")
+	audits := make(chan config.AuditEntry, 10)
+	center, err := config.New(config.Option{EtcdConfig: etcd3.Config{Endpoints: etcd.Endpoints()}, Service: "example",
+		Audit: func(entry config.AuditEntry) { audits <- entry }})
+	require.NoError(t, err)
+	defer center.Close()
+	token := func(cred ServiceCredentialer) string {
+		md, err := cred.GetRequestMetadata(context.Background())
+		require.NoError(t, err)
+		return md["authorization"]
+	}
+
+	cred := &ServiceCredential{}
+	c, err := NewClient(&Config{Name: "example", Endpoints: []string{"127.0.0.1:1"}, AccessToken: "old", AccessTokenFunc: cred, ConfigCenter: center}, false)
+	require.NoError(t, err)
+	assert.Equal(t, "basic new", token(cred))
+	require.NoError(t, c.Close())
+	// a failed client cancels its subscriptions too
+	failed := &ServiceCredential{}
+	_, err = NewClient(&Config{Name: "example", Endpoints: []string{"127.0.0.1:1"}, AccessToken: "old", AccessTokenFunc: failed, ConfigCenter: center, InterceptorOrder: []string{"unknown"}}, false)
+	assert.Error(t, err)
+
+	etcd.Put("/qsf.config/example/"+config.AuthItem, "accessToken: newer")
+	select {
+	case <-audits:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for the config change")
+	}
+	assert.Equal(t, "basic new", token(cred))
+	assert.Equal(t, "basic new", token(failed))
+}
+
+func TestMixedBackends(t *testing.T) {
+	etcd, err := etcdtest.NewServer()
+	require.NoError(t, err)
+	defer etcd.Close()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	a := lis.Addr().String()
+	lis.Close()
+	s, err := server.NewSevice(&server.Config{Name: "example", Addr: a, NodeId: "node-a", RegistryAddrs: etcd.Endpoints()})
+	require.NoError(t, err)
+	require.NoError(t, s.Start(context.Background()))
+	defer s.Stop(context.Background())
+	b, stopB := startService(t)
+	defer stopB()
+
+	// the etcd and the static backends resolve the same service name in one process
+	ca, err := NewClient(&Config{Name: "example", RegistryAddrs: etcd.Endpoints()}, false)
+	require.NoError(t, err)
+	defer ca.Close()
+	cb, err := NewClient(&Config{Name: "example", RegistryKind: static.Kind, RegistryAddrs: []string{b}}, false)
+	require.NoError(t, err)
+	defer cb.Close()
+	assert.Equal(t, map[string]bool{a: true}, peers(t, ca.GrpcConn))
+	assert.Equal(t, map[string]bool{b: true}, peers(t, cb.GrpcConn))
+}
+
+func TestConfigError(t *testing.T) {
+	_, err := NewClient(&Config{Name: "example"}, false)
+	assert.Error(t, err)
+	_, err = NewClient(&Config{Endpoints: []string{"127.0.0.1:1"}, LoadBalance: "unknown"}, false)
+	assert.Error(t, err)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	handling := make(chan struct{})
+	stuck := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(handling)
+		<-r.Context().Done()
+	})}
+	idle := &http.Server{}
+	for _, httpServer := range []*http.Server{stuck, idle} {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		httpServer.Addr = lis.Addr().String()
+		go httpServer.Serve(lis)
+	}
+	go http.Get("http://" + stuck.Addr)
+	select {
+	case <-handling:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not handled")
+	}
+
+	// the stuck request is closed once the timeout expires
+	begin := time.Now()
+	shutdown(200*time.Millisecond, []*http.Server{stuck, idle})
+	elapsed := time.Since(begin)
+	assert.True(t, elapsed >= 200*time.Millisecond && elapsed < 5*time.Second, elapsed.String())
+	for _, httpServer := range []*http.Server{stuck, idle} {
+		_, err := net.Dial("tcp", httpServer.Addr)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"github.com/chuangyou/qsf/internal/chain"
+	"google.golang.org/grpc"
+)
+
+// Names of the interceptors that can be ordered through Config.InterceptorOrder, along with the names of Config.Interceptors.
+// InterceptorCustom stands for Config.UnaryInterceptors and Config.StreamInterceptors.
+const (
+	InterceptorBreaker     = "breaker"
+	InterceptorTracing     = "tracing"
+	InterceptorPrometheus  = "prometheus"
+	InterceptorCustom      = "custom"
+	InterceptorLoadBalance = "loadbalance"
+)
+
+// DefaultInterceptorOrder returns the order used when Config.InterceptorOrder is empty, the first interceptor is
+// the outermost one. loadbalance comes last so that it measures the latency of the call itself.
+// Names missing from a configured order are appended in this order, Config.Interceptors right after custom.
+func DefaultInterceptorOrder() []string {
+	return []string{
+		InterceptorBreaker,
+		InterceptorTracing,
+		InterceptorPrometheus,
+		InterceptorCustom,
+		InterceptorLoadBalance,
+	}
+}
+
+// Interceptor is a custom interceptor in a slot of its own, its name orders it through Config.InterceptorOrder.
+type Interceptor struct {
+	Name   string                       //拦截器名称，不能与内置拦截器重名
+	Unary  grpc.UnaryClientInterceptor  //unary拦截器（可选）
+	Stream grpc.StreamClientInterceptor //stream拦截器（可选）
+}
+
+// interceptorChain collects the interceptors of a client by name, so they can be chained in the configured order.
+type interceptorChain struct {
+	*chain.Chain
+}
+
+func newInterceptorChain() *interceptorChain {
+	return &interceptorChain{chain.New("client", DefaultInterceptorOrder())}
+}
+
+// add appends the interceptors under name, nil interceptors are skipped.
+func (c *interceptorChain) add(name string, unary grpc.UnaryClientInterceptor, stream grpc.StreamClientInterceptor) {
+	var (
+		u, s interface{}
+	)
+	if unary != nil {
+		u = unary
+	}
+	if stream != nil {
+		s = stream
+	}
+	c.Add(name, u, s)
+}
+
+// build returns the interceptors sorted by order.
+func (c *interceptorChain) build(order []string) (unary []grpc.UnaryClientInterceptor, stream []grpc.StreamClientInterceptor, err error) {
+	u, s, err := c.Build(order)
+	if err != nil {
+		return
+	}
+	for _, interceptor := range u {
+		unary = append(unary, interceptor.(grpc.UnaryClientInterceptor))
+	}
+	for _, interceptor := range s {
+		stream = append(stream, interceptor.(grpc.StreamClientInterceptor))
+	}
+	return
+}
@@ -0,0 +1,234 @@
+// Command qsfctl inspects and manages the services registered in etcd, run it without arguments
+// for the usage.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/chuangyou/qsf/constant"
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry"
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry/etcd"
+	etcd3 "github.com/coreos/etcd/clientv3"
+	"golang.org/x/net/context"
+)
+
+const usage = `usage: qsfctl [flags] <command> [args]
+
+commands:
+  services                      list the services
+  nodes <service>               list the nodes of a service with their lease TTL
+  watch <service>               print the nodes of a service on every change
+  deregister <service> <node>   remove a stale node
+
+flags:
+`
+
+var errUsage = errors.New("invalid arguments")
+
+func main() {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+	if err := run(ctx, os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		if err != errUsage {
+			fmt.Fprintln(os.Stderr, "qsfctl:", err)
+		}
+		os.Exit(1)
+	}
+}
+
+type command struct {
+	endpoints string
+	dir       string
+	output    string
+	timeout   time.Duration
+	out       io.Writer
+	client    *etcd3.Client
+}
+
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	var (
+		c     = &command{out: stdout}
+		flags = flag.NewFlagSet("qsfctl", flag.ContinueOnError)
+		err   error
+	)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&c.endpoints, "endpoints", "127.0.0.1:2379", "comma separated etcd endpoints")
+	flags.StringVar(&c.dir, "dir", constant.DEFAULT_ETCD_PATH, "registry dir")
+	flags.StringVar(&c.output, "o", "table", "output format: table or json")
+	flags.DurationVar(&c.timeout, "timeout", 5*time.Second, "timeout of a request")
+	if err = flags.Parse(args); err != nil {
+		return errUsage
+	}
+	args = flags.Args()
+	if c.output != "table" && c.output != "json" {
+		fmt.Fprintf(stderr, "unknown output format '%s'\n", c.output)
+		return errUsage
+	}
+	var (
+		handler func(ctx context.Context, args []string) error
+		nargs   int
+	)
+	if len(args) > 0 {
+		switch args[0] {
+		case "services":
+			handler, nargs = c.services, 0
+		case "nodes":
+			handler, nargs = c.nodes, 1
+		case "watch":
+			handler, nargs = c.watch, 1
+		case "deregister":
+			handler, nargs = c.deregister, 2
+		}
+	}
+	if handler == nil || len(args)-1 != nargs {
+		flags.Usage()
+		return errUsage
+	}
+	c.client, err = etcd3.New(c.config())
+	if err != nil {
+		return err
+	}
+	defer c.client.Close()
+	return handler(ctx, args[1:])
+}
+
+func (c *command) config() etcd3.Config {
+	return etcd3.Config{Endpoints: strings.Split(c.endpoints, ","), DialTimeout: c.timeout}
+}
+
+func (c *command) services(ctx context.Context, args []string) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	services, err := etcd.ListServices(ctx, c.client, c.dir)
+	if err != nil {
+		return err
+	}
+	if c.output == "json" {
+		return c.printJSON(services)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tNODES")
+	for _, service := range services {
+		fmt.Fprintf(w, "%s\t%d\n", service.Name, service.Nodes)
+	}
+	return w.Flush()
+}
+
+func (c *command) nodes(ctx context.Context, args []string) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	nodes, err := etcd.ListNodes(ctx, c.client, c.dir, args[0])
+	if err != nil {
+		return err
+	}
+	if c.output == "json" {
+		return c.printJSON(nodes)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tADDR\tVERSION\tREGION\tZONE\tLEASE\tTTL")
+	for _, node := range nodes {
+		lease, ttl := "-", "-"
+		if node.Lease != 0 {
+			lease = fmt.Sprintf("%x", node.Lease)
+		}
+		if node.TTL >= 0 {
+			ttl = fmt.Sprintf("%ds", node.TTL)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", node.ID, node.Data.Addr, orDash(node.Data.Version),
+			orDash(node.Data.Region), orDash(node.Data.Zone), lease, ttl)
+	}
+	return w.Flush()
+}
+
+// watch prints the nodes of the service at once and on every change, until ctx is done.
+func (c *command) watch(ctx context.Context, args []string) error {
+	discovery, err := etcd.NewDiscovery(c.dir, c.config())
+	if err != nil {
+		return err
+	}
+	defer discovery.Close()
+	watcher, err := discovery.Watch(args[0])
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			watcher.Close()
+		case <-done:
+		}
+	}()
+	for {
+		nodes, err := watcher.Next()
+		if err == registry.ErrClosed {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if c.output == "json" {
+			if err = json.NewEncoder(c.out).Encode(struct {
+				Time  time.Time           `json:"time"`
+				Nodes []registry.NodeData `json:"nodes"`
+			}{time.Now(), nodes}); err != nil {
+				return err
+			}
+			continue
+		}
+		w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "--- %s, %d nodes\n", time.Now().Format("2006-01-02 15:04:05"), len(nodes))
+		for _, node := range nodes {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", node.Addr, orDash(node.Version), orDash(node.Zone))
+		}
+		if err = w.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *command) deregister(ctx context.Context, args []string) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	if err := etcd.DeleteNode(ctx, c.client, c.dir, args[0], args[1]); err != nil {
+		return err
+	}
+	if c.output == "json" {
+		return c.printJSON(map[string]string{"service": args[0], "id": args[1]})
+	}
+	fmt.Fprintf(c.out, "node '%s' of '%s' deregistered\n", args[1], args[0])
+	return nil
+}
+
+func (c *command) printJSON(v interface{}) error {
+	encoder := json.NewEncoder(c.out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
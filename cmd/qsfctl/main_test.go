@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chuangyou/qsf/internal/etcdtest"
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry/etcd"
+	etcd3 "github.com/coreos/etcd/clientv3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// syncBuffer is written by a running command while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// startRegistry starts etcd with two nodes of "example", also registered as "pkg.Example".
+func startRegistry(t *testing.T) (*etcdtest.Server, []*etcd.EtcdReigistry) {
+	s, err := etcdtest.NewServer()
+	require.NoError(t, err)
+	var registries []*etcd.EtcdReigistry
+	for i, addr := range []string{"127.0.0.1:9001", "127.0.0.1:9002"} {
+		r, err := etcd.NewRegistry(etcd.Option{
+			EtcdConfig:  etcd3.Config{Endpoints: s.Endpoints(), DialTimeout: 5 * time.Second},
+			RegistryDir: "/qsf.service",
+			Ttl:         10 * time.Second,
+		})
+		require.NoError(t, err)
+		node := etcd.NodeData{Addr: addr, Version: "v1", Zone: "zone-a", Services: []string{"pkg.Example"}}
+		require.NoError(t, r.Register(context.Background(), "example", []string{"node-1", "node-2"}[i], node))
+		registries = append(registries, r)
+	}
+	return s, registries
+}
+
+func qsfctl(t *testing.T, s *etcdtest.Server, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	args = append([]string{"-endpoints", strings.Join(s.Endpoints(), ",")}, args...)
+	err := run(context.Background(), args, &stdout, &stderr)
+	return stdout.String(), err
+}
+
+func TestServices(t *testing.T) {
+	s, registries := startRegistry(t)
+	defer s.Close()
+	for _, r := range registries {
+		defer r.Close()
+	}
+
+	out, err := qsfctl(t, s, "services")
+	require.NoError(t, err)
+	assert.Equal(t, "SERVICE      NODES\nexample      2\npkg.Example  2\n", out)
+
+	out, err = qsfctl(t, s, "-o", "json", "services")
+	require.NoError(t, err)
+	var services []etcd.Service
+	require.NoError(t, json.Unmarshal([]byte(out), &services))
+	assert.Equal(t, []etcd.Service{{Name: "example", Nodes: 2}, {Name: "pkg.Example", Nodes: 2}}, services)
+}
+
+func TestNodes(t *testing.T) {
+	s, registries := startRegistry(t)
+	defer s.Close()
+	for _, r := range registries {
+		defer r.Close()
+	}
+
+	out, err := qsfctl(t, s, "nodes", "example")
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, []string{"ID", "ADDR", "VERSION", "REGION", "ZONE", "LEASE", "TTL"}, strings.Fields(lines[0]))
+	assert.Equal(t, []string{"node-1", "127.0.0.1:9001", "v1", "-", "zone-a"}, strings.Fields(lines[1])[:5])
+	assert.Contains(t, []string{"9s", "10s"}, strings.Fields(lines[1])[6], "the remaining TTL of the lease")
+
+	out, err = qsfctl(t, s, "-o", "json", "nodes", "example")
+	require.NoError(t, err)
+	var nodes []etcd.Node
+	require.NoError(t, json.Unmarshal([]byte(out), &nodes))
+	require.Len(t, nodes, 2)
+	assert.Equal(t, "node-2", nodes[1].ID)
+	assert.Equal(t, "/qsf.service/example/node-2", nodes[1].Key)
+	assert.Equal(t, "127.0.0.1:9002", nodes[1].Data.Addr)
+	assert.NotZero(t, nodes[1].Lease)
+	assert.InDelta(t, 10, nodes[1].TTL, 1)
+}
+
+func TestDeregister(t *testing.T) {
+	s, registries := startRegistry(t)
+	defer s.Close()
+	for _, r := range registries {
+		defer r.Close()
+	}
+
+	out, err := qsfctl(t, s, "deregister", "example", "node-1")
+	require.NoError(t, err)
+	assert.Equal(t, "node 'node-1' of 'example' deregistered\n", out)
+	// the node is removed from every name it was registered under
+	assert.Equal(t, []string{"/qsf.service/example/node-2", "/qsf.service/pkg.Example/node-2"}, s.Keys("/qsf.service/"))
+
+	_, err = qsfctl(t, s, "deregister", "example", "node-1")
+	assert.Equal(t, etcd.ErrNodeNotFound, err)
+}
+
+func TestWatch(t *testing.T) {
+	s, registries := startRegistry(t)
+	defer s.Close()
+	for _, r := range registries {
+		defer r.Close()
+	}
+
+	var stdout syncBuffer
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, []string{"-endpoints", strings.Join(s.Endpoints(), ","), "-o", "json", "watch", "example"}, &stdout, &bytes.Buffer{})
+	}()
+	waitLines := func(n int) []string {
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			if lines := strings.Split(strings.TrimSpace(stdout.String()), "\n"); len(lines) >= n && lines[0] != "" {
+				return lines
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("timeout waiting for %d lines, got %q", n, stdout.String())
+		return nil
+	}
+	var update struct {
+		Nodes []etcd.NodeData `json:"nodes"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(waitLines(1)[0]), &update))
+	assert.Len(t, update.Nodes, 2)
+
+	require.NoError(t, registries[0].Deregister(context.Background()))
+	require.NoError(t, json.Unmarshal([]byte(waitLines(2)[1]), &update))
+	require.Len(t, update.Nodes, 1)
+	assert.Equal(t, "127.0.0.1:9002", update.Nodes[0].Addr)
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("watch did not stop")
+	}
+}
+
+func TestUsage(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, errUsage, run(context.Background(), []string{"nodes"}, &stdout, &stderr))
+	assert.Contains(t, stderr.String(), "usage: qsfctl")
+	assert.Equal(t, errUsage, run(context.Background(), []string{"-o", "yaml", "services"}, &stdout, &stderr))
+	assert.Equal(t, errUsage, run(context.Background(), []string{"unknown"}, &stdout, &stderr))
+}
@@ -1,9 +1,21 @@
 package constant
 
+import "time"
+
 const (
 	DEFAULT_ETCD_PATH     = "/qsf.service"
 	InitialWindowSize     = 1 << 30
 	InitialConnWindowSize = 1 << 30
 	MaxSendMsgSize        = 1<<31 - 1
 	MaxCallMsgSize        = 1<<31 - 1
+	//热重启等待新进程就绪的默认超时时间
+	DEFAULT_RESTART_TIMEOUT = 30 * time.Second
+	//优雅关闭的默认超时时间
+	DEFAULT_SHUTDOWN_TIMEOUT = 30 * time.Second
+	//关闭时从注册中心注销节点的默认超时时间
+	DEFAULT_DEREGISTER_TIMEOUT = 5 * time.Second
+	//动态配置的默认etcd路径
+	DEFAULT_CONFIG_PATH = "/qsf.config"
+	//分布式限流的默认etcd路径
+	DEFAULT_RATELIMIT_PATH = "/qsf.ratelimit"
 )
@@ -7,6 +7,7 @@ import (
 	"github.com/chuangyou/qsf/client"
 	spb "github.com/chuangyou/qsf/examples/pb"
 	"github.com/chuangyou/qsf/plugin/breaker"
+	"github.com/chuangyou/qsf/plugin/loadbalance"
 	zipkin "github.com/openzipkin/zipkin-go-opentracing"
 	"golang.org/x/net/context"
 )
@@ -28,6 +29,9 @@ func main() {
 	config.AccessTokenFunc = new(client.ServiceCredential)                //授权方法
 	config.RegistryAddrs = []string{"http://127.0.0.1:2379"}              //etcd 注册中心
 	config.Breaker = breaker.NewRateBreaker(BreakerRate, BreakMinSamples) //熔断器
+	config.LoadBalance = loadbalance.WeightedRoundRobin                   //按节点权重负载均衡（可选）
+	//直连节点，设置后不使用注册中心（可选）
+	//config.Endpoints = []string{"127.0.0.1:28544"}
 
 	//配置zipkin（可选）
 	collector, err := zipkin.NewHTTPCollector(ZIPKIN_HTTP_ENDPOINT)
@@ -6,9 +6,13 @@ import (
 	"time"
 
 	"github.com/chuangyou/qsf/client"
+	"github.com/chuangyou/qsf/constant"
 	spb "github.com/chuangyou/qsf/examples/pb"
 	"github.com/chuangyou/qsf/grpc_error"
 	"github.com/chuangyou/qsf/plugin/breaker"
+	"github.com/chuangyou/qsf/plugin/graceful"
+	"github.com/chuangyou/qsf/plugin/jwt"
+	"github.com/chuangyou/qsf/plugin/loadbalance"
 	"github.com/chuangyou/qsf/plugin/prometheus"
 	"github.com/golang/protobuf/proto"
 	"github.com/grpc-ecosystem/grpc-gateway/runtime"
@@ -29,14 +33,18 @@ var (
 const (
 	ZIPKIN_HTTP_ENDPOINT      = "http://127.0.0.1:9411/api/v1/spans"
 	ZIPKIN_RECORDER_HOST_PORT = "127.0.0.1:0"
+	JWT_SECRET                = "605f81a5fd7c623a22fb9b2ee33ad49f"
 )
 
+var jwtVerifier *jwt.Verifier
+
 func main() {
 	var (
 		mux         *runtime.ServeMux
 		ctx         context.Context
 		cancel      context.CancelFunc
-		http2Server http.Server
+		http2Server *http.Server
+		httpServer  *http.Server
 	)
 	ctx = context.Background()
 	ctx, cancel = context.WithCancel(ctx)
@@ -64,39 +72,58 @@ func main() {
 
 	//配置zipkin（可选）
 
+	//配置JWT（可选）
+	jwtVerifier, err = jwt.NewVerifier(jwt.Option{HMACSecret: []byte(JWT_SECRET)})
+	if err != nil {
+		log.Fatalf("jwt.NewVerifier err: %v", err)
+	}
+	//配置JWT（可选）
+
 	breakerBucket := breaker.NewRateBreaker(BreakerRate, BreakMinSamples) //配置熔断器（可选）
 
 	//配置prometheus(client-side)
 	prometheusRegistry := prometheus.NewRegistry()
 	grpcMetrics := grpc_prometheus.NewClientMetrics()
-	prometheusRegistry.MustRegister(grpcMetrics)
+	prometheusRegistry.MustRegister(grpcMetrics, loadbalance.ZoneCollector())
 	grpcMetrics.EnableClientHandlingTimeHistogram()
 	//配置prometheus(client-side)
 
 	initExampleService(ctx, mux, breakerBucket, tracer, grpcMetrics)
 
-	http2Server.Handler = AuthHandle(mux) //自定义请求过滤器
-	http2Server.Addr = "0.0.0.0:8082"
-	http2.ConfigureServer(&http2Server, &http2.Server{})
+	http2Server = &http.Server{
+		Handler: AuthHandle(mux), //自定义请求过滤器
+		Addr:    "0.0.0.0:8082",
+	}
+	http2.ConfigureServer(http2Server, &http2.Server{})
+	//热重启时由新进程继承监听端口
+	lis, err := graceful.Listen(http2Server.Addr)
+	if err != nil {
+		log.Fatalf("Listen err: %v", err)
+	}
 	go func() {
-		err = http2Server.ListenAndServeTLS("./server.pem", "./server.key")
-		if err != nil {
-			log.Fatalf("ListenAndServeTLS err: %v", err)
+		err := http2Server.ServeTLS(lis, "./server.pem", "./server.key")
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("ServeTLS err: %v", err)
 		}
 	}()
 	//启动prometheus(client-side)
+	httpServer = &http.Server{
+		Handler: promhttp.HandlerFor(prometheusRegistry, promhttp.HandlerOpts{}),
+		Addr:    "0.0.0.0:9094",
+	}
+	monitorLis, err := graceful.Listen(httpServer.Addr)
+	if err != nil {
+		log.Fatalf("Listen err: %v", err)
+	}
 	go func() {
-		httpServer := &http.Server{
-			Handler: promhttp.HandlerFor(prometheusRegistry, promhttp.HandlerOpts{}),
-			Addr:    "0.0.0.0:9094",
-		}
-		if err := httpServer.ListenAndServe(); err != nil {
+		if err := httpServer.Serve(monitorLis); err != nil && err != http.ErrServerClosed {
 			log.Fatal("Unable to start a http server.")
 		}
 	}()
 	//启动prometheus(client-side)
 
-	client.HandleSignal(http2Server)
+	graceful.Ready() //通知旧进程新进程已就绪
+	client.HandleSignals(constant.DEFAULT_SHUTDOWN_TIMEOUT, http2Server, httpServer)
 }
 
 func initExampleService(ctx context.Context,
@@ -115,14 +142,19 @@ func initExampleService(ctx context.Context,
 	config.GrpcMetrics = grpcMetrics                         //prometheus
 	c, err := client.NewClient(config, true)
 	if err == nil {
-		err = spb.RegisterExampleServiceHandlerFromEndpoint(ctx, mux, "", c.GrpcOpts)
+		err = spb.RegisterExampleServiceHandlerFromEndpoint(ctx, mux, c.Target, c.GrpcOpts)
 	} else {
 		log.Fatalf("initExampleService err: %v", err)
 	}
 
 }
 func MetaDataJoin(ctx context.Context, r *http.Request) metadata.MD {
-	return metadata.New(map[string]string{"QSF-UserId": "uid"})
+	md := metadata.New(nil)
+	//Authorization头由grpc-gateway原样转发，服务端可直接校验用户JWT
+	if claims, ok := jwt.FromContext(r.Context()); ok {
+		md.Set("QSF-UserId", claims.Subject)
+	}
+	return md
 }
 func ForwardResponseFilter(ctx context.Context, w http.ResponseWriter, resp proto.Message) error {
 	w.Header().Del("Grpc-Metadata-Content-Type")
@@ -132,6 +164,14 @@ func AuthHandle(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		//TODO your codes
 		log.Println("客户端信息", r.UserAgent(), r.Proto)
+		if token := jwt.TokenFromHTTPRequest(r); token != "" {
+			claims, err := jwtVerifier.Verify(token)
+			if err != nil {
+				grpc_error.CustomOtherHTTPError(w, r, "{\"code\":16,\"message\":\"Unauthenticated\"}", http.StatusUnauthorized)
+				return
+			}
+			r = r.WithContext(jwt.NewContext(r.Context(), claims))
+		}
 		h.ServeHTTP(w, r)
 	})
 }
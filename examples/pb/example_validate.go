@@ -0,0 +1,16 @@
+package chuangyou_touyuan_example_v1
+
+import (
+	"github.com/chuangyou/qsf/plugin/validator"
+)
+
+// Validate is called by the validator interceptor of the service before GetExample is handled.
+func (m *GetExampleRequest) Validate() error {
+	var (
+		errs validator.Errors
+	)
+	if m.Value == "" {
+		errs = append(errs, validator.FieldError{FieldName: "value", Description: "输入的值不能为空！"})
+	}
+	return errs.Err()
+}
@@ -4,12 +4,16 @@ import (
 	"flag"
 	"log"
 	"strconv"
+	"time"
 
 	"github.com/chuangyou/rsa"
 
 	spb "github.com/chuangyou/qsf/examples/pb"
 	"github.com/chuangyou/qsf/grpc_error"
+	"github.com/chuangyou/qsf/plugin/concurrency"
+	"github.com/chuangyou/qsf/plugin/jwt"
 	"github.com/chuangyou/qsf/plugin/ratelimit"
+	"github.com/chuangyou/qsf/plugin/rbac"
 	"github.com/chuangyou/qsf/server"
 	zipkin "github.com/openzipkin/zipkin-go-opentracing"
 	"github.com/zheng-ji/goSnowFlake"
@@ -19,6 +23,7 @@ import (
 const (
 	ZIPKIN_HTTP_ENDPOINT      = "http://127.0.0.1:9411/api/v1/spans"
 	ZIPKIN_RECORDER_HOST_PORT = "127.0.0.1:0"
+	JWT_SECRET                = "605f81a5fd7c623a22fb9b2ee33ad49f"
 )
 
 var nodeID = flag.String("node", "node1", "node ID")
@@ -31,12 +36,22 @@ func main() {
 	config.Name = "example" //服务名称
 	config.Addr = *addr     //服务地址
 	config.NodeId = *nodeID //服务节点
+	config.Version = "v1"   //服务版本（可选），节点同时以protobuf服务名注册，客户端可用"chuangyou.touyuan.example.v1.ExampleService"发现
 	config.AccessToken = "123456"
 	config.RegistryAddrs = []string{"http://127.0.0.1:2379"} //etcd 注册中心
+	config.DeregisterDelay = 2 * time.Second                 //关闭时注销后等待客户端感知的时间（可选）
+	config.Weight = 10                                       //节点权重，配合客户端weighted_round_robin使用（可选）
 	//配置限流器（可选）
-	rateLimit := int64(10000)
-	config.RateLimter = ratelimit.NewBucketWithRate(float64(rateLimit), rateLimit)
+	config.RateLimter = ratelimit.New(10000, time.Second)
+	config.RateLimitRules = []ratelimit.Rule{
+		//每个网关用户每秒最多调用10次GetExample，用户ID由网关MetaDataJoin转发
+		{Method: "/chuangyou.touyuan.example.v1.ExampleService/GetExample", Rate: 10, Key: ratelimit.MetadataKey("qsf-userid")},
+		//每个IP每秒最多调用其他方法100次
+		{Method: "*", Rate: 100, Key: ratelimit.PeerKey},
+	}
 	//配置限流器（可选）
+	//并发限制，根据请求延迟在10到500之间自动调整最大处理中请求数（可选）
+	config.ConcurrencyLimit = concurrency.NewGradientLimit(concurrency.GradientOption{Min: 10, Max: 500})
 
 	//config.MonitorListenAddr = *monitorListenAddr //配置prometheus采集地址（可选）
 
@@ -55,6 +70,22 @@ func main() {
 	config.Tracer = tracer
 	//配置zipkin（可选）
 
+	//配置JWT（可选），校验网关转发的用户令牌，handler中通过jwt.FromContext获取claims
+	config.JWTVerifier, err = jwt.NewVerifier(jwt.Option{HMACSecret: []byte(JWT_SECRET)})
+	if err != nil {
+		log.Fatalf("jwt.NewVerifier err: %v", err)
+	}
+	//配置JWT（可选）
+
+	//配置方法级授权（可选），也可以通过rbac.LoadPolicyFile或Authorizer.WatchEtcd加载
+	config.Authorizer = rbac.NewAuthorizer(&rbac.Policy{
+		Rules: []rbac.Rule{
+			{Method: "/chuangyou.touyuan.example.v1.ExampleService/GetExample"}, //认证通过即可调用
+			{Method: "/chuangyou.touyuan.example.v1.ExampleService/*", Roles: []string{"admin"}},
+		},
+	})
+	//配置方法级授权（可选）
+
 	service, err := server.NewSevice(config)
 	if err != nil {
 		log.Fatalf("server.NewSevice err: %v", err)
@@ -77,23 +108,19 @@ func (s *ExampleService) GetExample(ctx context.Context, request *spb.GetExample
 	var (
 		appSecret []byte
 	)
-	if request.Value == "" {
+	//request.Value is checked by GetExampleRequest.Validate before the handler is called
+	id, _ := s.IdWorker.NextId()
+	log.Println("request-id:" + strconv.FormatInt(id, 10) + ",service-node:" + *nodeID)
+	appSecret, err = rsa.RsaEncrypt([]byte("605f81a5fd7c623a22fb9b2ee33ad49f"), rsa.Base64Decode(request.Value))
+	if err != nil {
 		response = nil
-		err = grpc_error.InvalidArgument("value", "输入的值不能为空！")
+		err = grpc_error.InvalidArgument("value", "RSA公钥不正确！")
 	} else {
-		id, _ := s.IdWorker.NextId()
-		log.Println("request-id:" + strconv.FormatInt(id, 10) + ",service-node:" + *nodeID)
-		appSecret, err = rsa.RsaEncrypt([]byte("605f81a5fd7c623a22fb9b2ee33ad49f"), rsa.Base64Decode(request.Value))
-		if err != nil {
-			response = nil
-			err = grpc_error.InvalidArgument("value", "RSA公钥不正确！")
-		} else {
-			response = &spb.Example{
-				Value: rsa.Base64Encode(appSecret),
-			}
-			err = nil
-
+		response = &spb.Example{
+			Value: rsa.Base64Encode(appSecret),
 		}
+		err = nil
+
 	}
 	return
 }
@@ -2,6 +2,7 @@ package grpc_error
 
 import (
 	"strconv"
+	"time"
 
 	"net/http"
 
@@ -101,6 +102,24 @@ func InvalidArgument(field string, description string) error {
 	}
 }
 
+//400 INVALID_ARGUMENT 客户端使用了错误的参数，一次返回多个字段的错误
+func BadRequest(fieldViolations []*epb.BadRequest_FieldViolation) error {
+	var (
+		st       *status.Status
+		detSt    *status.Status
+		detStErr error
+	)
+	st = status.New(codes.InvalidArgument, codes.InvalidArgument.String())
+	detSt, detStErr = st.WithDetails(&epb.BadRequest{
+		FieldViolations: fieldViolations,
+	})
+	if detStErr == nil {
+		return detSt.Err()
+	} else {
+		return st.Err()
+	}
+}
+
 //404 NotFound 未找到资源
 func NotFound() error {
 	var (
@@ -112,6 +131,11 @@ func NotFound() error {
 
 //429 RESOURCE_EXHAUSTED  超过资源限额或频率限制
 func ResourceExhausted(subject, description string, secounds int64) error {
+	return ResourceExhaustedDelay(subject, description, time.Duration(secounds)*time.Second)
+}
+
+//429 RESOURCE_EXHAUSTED  超过资源限额或频率限制，重试间隔精确到纳秒
+func ResourceExhaustedDelay(subject, description string, delay time.Duration) error {
 	var (
 		st       *status.Status
 		detSt    *status.Status
@@ -127,7 +151,7 @@ func ResourceExhausted(subject, description string, secounds int64) error {
 		},
 	},
 		&epb.RetryInfo{
-			RetryDelay: &dpb.Duration{Seconds: secounds},
+			RetryDelay: &dpb.Duration{Seconds: int64(delay / time.Second), Nanos: int32(delay % time.Second)},
 		},
 	)
 	if detStErr == nil {
@@ -146,6 +170,25 @@ func Internal() error {
 	return st.Err()
 }
 
+//500 INTERNAL 服务端内部错误，附带调试信息（如堆栈），仅用于调试模式
+func InternalWithDebugInfo(detail string, stackEntries []string) error {
+	var (
+		st       *status.Status
+		detSt    *status.Status
+		detStErr error
+	)
+	st = status.New(codes.Internal, codes.Internal.String())
+	detSt, detStErr = st.WithDetails(&epb.DebugInfo{
+		StackEntries: stackEntries,
+		Detail:       detail,
+	})
+	if detStErr == nil {
+		return detSt.Err()
+	} else {
+		return st.Err()
+	}
+}
+
 //503 UNAVAILABLE  服务端不可用
 func Unavailable() error {
 	var (
@@ -0,0 +1,83 @@
+// Package chain orders the interceptors of servers and clients by name. The interceptors are kept as
+// interface{} values, the server and the client convert them to their grpc interceptor types.
+package chain
+
+import (
+	"errors"
+)
+
+// Chain collects interceptors under names, so they can be chained in a configured order.
+type Chain struct {
+	kind   string
+	order  []string //default order, the first interceptor is the outermost one
+	unary  map[string][]interface{}
+	stream map[string][]interface{}
+}
+
+// New returns a chain of the names of defaultOrder, kind prefixes the errors, e.g. "service" or "client".
+func New(kind string, defaultOrder []string) *Chain {
+	return &Chain{
+		kind:   kind,
+		order:  append([]string(nil), defaultOrder...),
+		unary:  make(map[string][]interface{}),
+		stream: make(map[string][]interface{}),
+	}
+}
+
+// Slot adds the name of a custom interceptor to the default order, right after the name after.
+func (c *Chain) Slot(name, after string) error {
+	if name == "" || c.has(name) {
+		return errors.New(c.kind + " interceptor name error: " + name)
+	}
+	for i, n := range c.order {
+		if n == after {
+			c.order = append(c.order[:i+1], append([]string{name}, c.order[i+1:]...)...)
+			return nil
+		}
+	}
+	return errors.New(c.kind + " interceptor name error: " + after)
+}
+
+// Add appends the interceptors under name, nil interceptors are skipped.
+func (c *Chain) Add(name string, unary, stream interface{}) {
+	if unary != nil {
+		c.unary[name] = append(c.unary[name], unary)
+	}
+	if stream != nil {
+		c.stream[name] = append(c.stream[name], stream)
+	}
+}
+
+// Build returns the interceptors sorted by order. Names missing from order are appended in the default order.
+func (c *Chain) Build(order []string) (unary, stream []interface{}, err error) {
+	var (
+		seen = make(map[string]bool)
+	)
+	for _, name := range order {
+		if !c.has(name) || seen[name] {
+			err = errors.New(c.kind + " interceptor order error: " + name)
+			return
+		}
+		seen[name] = true
+	}
+	order = append([]string(nil), order...)
+	for _, name := range c.order {
+		if !seen[name] {
+			order = append(order, name)
+		}
+	}
+	for _, name := range order {
+		unary = append(unary, c.unary[name]...)
+		stream = append(stream, c.stream[name]...)
+	}
+	return
+}
+
+func (c *Chain) has(name string) bool {
+	for _, n := range c.order {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
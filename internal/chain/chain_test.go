@@ -0,0 +1,52 @@
+package chain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuild(t *testing.T) {
+	c := New("service", []string{"auth", "prometheus", "tracing", "custom"})
+	c.Add("tracing", "tracing", nil)
+	c.Add("auth", "auth", "auth-stream")
+	c.Add("custom", "custom1", nil)
+	c.Add("custom", "custom2", nil)
+	c.Add("prometheus", "prometheus", nil)
+
+	unary, stream, err := c.Build(nil)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"auth", "prometheus", "tracing", "custom1", "custom2"}, unary)
+	assert.Equal(t, []interface{}{"auth-stream"}, stream)
+
+	unary, _, err = c.Build([]string{"tracing", "prometheus", "custom"})
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"tracing", "prometheus", "custom1", "custom2", "auth"}, unary)
+
+	_, _, err = c.Build([]string{"auth", "unknown"})
+	assert.EqualError(t, err, "service interceptor order error: unknown")
+	_, _, err = c.Build([]string{"auth", "auth"})
+	assert.Error(t, err)
+}
+
+func TestSlot(t *testing.T) {
+	c := New("client", []string{"breaker", "custom", "loadbalance"})
+	require.NoError(t, c.Slot("audit", "custom"))
+	require.NoError(t, c.Slot("retry", "audit"))
+	assert.Error(t, c.Slot("breaker", "custom"), "the name is taken")
+	assert.Error(t, c.Slot("cache", "unknown"))
+	assert.Error(t, c.Slot("", "custom"))
+	c.Add("loadbalance", "loadbalance", nil)
+	c.Add("retry", "retry", nil)
+	c.Add("audit", "audit", nil)
+	c.Add("breaker", "breaker", nil)
+
+	// named interceptors follow custom by default and can be ordered by name
+	unary, _, err := c.Build(nil)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"breaker", "audit", "retry", "loadbalance"}, unary)
+	unary, _, err = c.Build([]string{"retry", "breaker"})
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"retry", "breaker", "audit", "loadbalance"}, unary)
+}
@@ -0,0 +1,49 @@
+// Command etcd runs the etcd server of the etcdtest package in a process of its own, so that the tests do
+// not link the etcd server. It serves on a free local port, prints the client address on stdout once
+// ready and stops when its stdin is closed, which happens when the test process exits too.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/coreos/etcd/embed"
+	"github.com/coreos/pkg/capnslog"
+)
+
+func main() {
+	var (
+		dir = flag.String("dir", "", "data directory")
+	)
+	flag.Parse()
+	capnslog.SetGlobalLogLevel(capnslog.CRITICAL)
+	local := url.URL{Scheme: "http", Host: "127.0.0.1:0"}
+	cfg := embed.NewConfig()
+	cfg.Dir = *dir
+	//short ticks so that leases of one second can be granted
+	cfg.TickMs = 10
+	cfg.ElectionMs = 100
+	cfg.LPUrls, cfg.APUrls = []url.URL{local}, []url.URL{local}
+	cfg.LCUrls, cfg.ACUrls = []url.URL{local}, []url.URL{local}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		log.Fatalln("start etcd error:", err)
+	}
+	defer e.Close()
+	select {
+	case <-e.Server.ReadyNotify():
+	case err = <-e.Err():
+		log.Fatalln("etcd error:", err)
+	case <-time.After(30 * time.Second):
+		log.Fatalln("etcd not ready")
+	}
+	fmt.Println(e.Clients[0].Addr().String())
+	io.Copy(ioutil.Discard, os.Stdin)
+}
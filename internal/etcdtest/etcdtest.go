@@ -0,0 +1,311 @@
+// Package etcdtest runs an etcd server for tests. Clients reach it through a local proxy that tests can
+// cut, like a crashed etcd or a network partition, while the server keeps running: leases of the cut
+// clients expire, and tests still read and write the data with the methods of Server.
+//
+// The server runs the etcd command of this package in a process of its own, so the tests do not link the
+// etcd server and its dependencies, such as the metrics of the upstream go-grpc-prometheus.
+package etcdtest
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	etcd3 "github.com/coreos/etcd/clientv3"
+	"golang.org/x/net/context"
+)
+
+const (
+	//requestTimeout bounds the requests of the methods of Server
+	requestTimeout = 5 * time.Second
+	//startTimeout bounds building and starting the etcd command
+	startTimeout = 2 * time.Minute
+)
+
+// Server is an etcd server with a proxy in front of it.
+type Server struct {
+	dir    string
+	cmd    *exec.Cmd
+	stdin  io.Closer     //the etcd command stops once its stdin is closed
+	client *etcd3.Client //connects to etcd directly, it works while the proxy is stopped
+	proxy  *proxy
+}
+
+// NewServer starts etcd and its proxy on free local ports.
+func NewServer() (s *Server, err error) {
+	var (
+		addr string
+	)
+	s = &Server{}
+	defer func() {
+		if err != nil {
+			s.Close()
+		}
+	}()
+	if s.dir, err = ioutil.TempDir("", "etcdtest"); err != nil {
+		return
+	}
+	if addr, err = s.start(); err != nil {
+		return
+	}
+	if s.client, err = etcd3.New(etcd3.Config{Endpoints: []string{addr}, DialTimeout: requestTimeout}); err != nil {
+		return
+	}
+	s.proxy = &proxy{target: addr, addr: "127.0.0.1:0", conns: make(map[net.Conn]bool)}
+	err = s.proxy.start()
+	return
+}
+
+// start runs the etcd command and returns its client address.
+func (s *Server) start() (addr string, err error) {
+	_, file, _, _ := runtime.Caller(0)
+	s.cmd = exec.Command("go", "run", ".", "-dir", s.dir)
+	s.cmd.Dir = filepath.Join(filepath.Dir(file), "etcd")
+	s.cmd.Stderr = os.Stderr
+	stdin, err := s.cmd.StdinPipe()
+	if err != nil {
+		return
+	}
+	s.stdin = stdin
+	stdout, err := s.cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+	if err = s.cmd.Start(); err != nil {
+		s.cmd = nil
+		return
+	}
+	ready := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(stdout).ReadString('\n')
+		ready <- strings.TrimSpace(line)
+	}()
+	select {
+	case addr = <-ready:
+		if addr == "" {
+			err = errors.New("etcdtest: etcd exited")
+		}
+	case <-time.After(startTimeout):
+		err = errors.New("etcdtest: etcd not ready")
+	}
+	return
+}
+
+// Endpoints returns the client endpoints of the proxy.
+func (s *Server) Endpoints() []string {
+	return []string{s.proxy.address()}
+}
+
+// Start serves the clients again on the address of the proxy after Stop.
+func (s *Server) Start() error {
+	return s.proxy.start()
+}
+
+// Stop closes the proxy and every connection through it, the clients can no longer reach etcd.
+func (s *Server) Stop() {
+	s.proxy.stop()
+}
+
+// Close stops the proxy and etcd for good and removes the data.
+func (s *Server) Close() {
+	if s.proxy != nil {
+		s.proxy.stop()
+	}
+	if s.client != nil {
+		s.client.Close()
+	}
+	if s.cmd != nil {
+		s.stdin.Close()
+		s.cmd.Wait()
+	}
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+	}
+}
+
+// Revision returns the current revision.
+func (s *Server) Revision() int64 {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := s.client.Get(ctx, "/")
+	must(err)
+	return resp.Header.Revision
+}
+
+// Compact drops the history before rev, watches starting before rev fail with a compaction.
+func (s *Server) Compact(rev int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	_, err := s.client.Compact(ctx, rev, etcd3.WithCompactPhysical())
+	must(err)
+}
+
+// ExpireLease ends a lease at once, deleting its keys.
+func (s *Server) ExpireLease(id int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	_, err := s.client.Revoke(ctx, etcd3.LeaseID(id))
+	must(err)
+}
+
+// Leases returns the sorted ids of the live leases.
+func (s *Server) Leases() []int64 {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := s.client.Leases(ctx)
+	must(err)
+	ids := []int64{}
+	for _, lease := range resp.Leases {
+		ids = append(ids, int64(lease.ID))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Get returns the value of key.
+func (s *Server) Get(key string) (string, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := s.client.Get(ctx, key)
+	must(err)
+	if len(resp.Kvs) == 0 {
+		return "", false
+	}
+	return string(resp.Kvs[0].Value), true
+}
+
+// Put writes key, it works while the proxy is stopped.
+func (s *Server) Put(key, value string) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	_, err := s.client.Put(ctx, key, value)
+	must(err)
+}
+
+// Delete deletes key, it works while the proxy is stopped.
+func (s *Server) Delete(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	_, err := s.client.Delete(ctx, key)
+	must(err)
+}
+
+// Keys returns the sorted keys with prefix.
+func (s *Server) Keys(prefix string) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := s.client.Get(ctx, prefix, etcd3.WithPrefix(), etcd3.WithKeysOnly(), etcd3.WithSort(etcd3.SortByKey, etcd3.SortAscend))
+	must(err)
+	keys := []string{}
+	for _, kv := range resp.Kvs {
+		keys = append(keys, string(kv.Key))
+	}
+	return keys
+}
+
+// must fails the test by a panic, the methods of Server are only used by tests.
+func must(err error) {
+	if err != nil {
+		panic("etcdtest: " + err.Error())
+	}
+}
+
+// proxy forwards the connections of its listener to etcd.
+type proxy struct {
+	target string
+	mu     sync.Mutex
+	addr   string
+	lis    net.Listener
+	conns  map[net.Conn]bool
+}
+
+func (p *proxy) address() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.addr
+}
+
+// start listens on the address of the proxy, the first start picks a free port.
+func (p *proxy) start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.lis != nil {
+		return nil
+	}
+	lis, err := net.Listen("tcp", p.addr)
+	if err != nil {
+		return err
+	}
+	p.lis = lis
+	p.addr = lis.Addr().String()
+	go p.accept(lis)
+	return nil
+}
+
+func (p *proxy) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.lis != nil {
+		p.lis.Close()
+		p.lis = nil
+	}
+	for conn := range p.conns {
+		conn.Close()
+		delete(p.conns, conn)
+	}
+}
+
+func (p *proxy) accept(lis net.Listener) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		upstream, err := net.Dial("tcp", p.target)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		if !p.track(lis, conn, upstream) {
+			return
+		}
+		go p.pipe(conn, upstream)
+		go p.pipe(upstream, conn)
+	}
+}
+
+// track keeps the connections to close on stop, false if the proxy was stopped meanwhile.
+func (p *proxy) track(lis net.Listener, conns ...net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.lis != lis {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return false
+	}
+	for _, conn := range conns {
+		p.conns[conn] = true
+	}
+	return true
+}
+
+func (p *proxy) pipe(dst, src net.Conn) {
+	io.Copy(dst, src)
+	dst.Close()
+	src.Close()
+	p.mu.Lock()
+	delete(p.conns, dst)
+	delete(p.conns, src)
+	p.mu.Unlock()
+}
@@ -0,0 +1,111 @@
+package etcdtest
+
+import (
+	"testing"
+	"time"
+
+	etcd3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func newClient(t *testing.T, s *Server) *etcd3.Client {
+	client, err := etcd3.New(etcd3.Config{Endpoints: s.Endpoints(), DialTimeout: 5 * time.Second})
+	require.NoError(t, err)
+	return client
+}
+
+func TestKVAndWatch(t *testing.T) {
+	s, err := NewServer()
+	require.NoError(t, err)
+	defer s.Close()
+	client := newClient(t, s)
+	defer client.Close()
+	ctx := context.Background()
+
+	_, err = client.Put(ctx, "/a/1", "x")
+	require.NoError(t, err)
+	resp, err := client.Get(ctx, "/a/", etcd3.WithPrefix())
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 1)
+	assert.Equal(t, "x", string(resp.Kvs[0].Value))
+
+	wch := client.Watch(ctx, "/a/", etcd3.WithPrefix(), etcd3.WithRev(resp.Header.Revision+1))
+	_, err = client.Txn(ctx).Then(etcd3.OpPut("/a/2", "y"), etcd3.OpDelete("/a/1")).Commit()
+	require.NoError(t, err)
+	select {
+	case wresp := <-wch:
+		require.Len(t, wresp.Events, 2)
+		assert.Equal(t, mvccpb.PUT, wresp.Events[0].Type)
+		assert.Equal(t, mvccpb.DELETE, wresp.Events[1].Type)
+		assert.Empty(t, wresp.Events[1].Kv.Value)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for events")
+	}
+
+	s.Compact(s.Revision())
+	wresp := <-client.Watch(ctx, "/a/", etcd3.WithPrefix(), etcd3.WithRev(1))
+	assert.Equal(t, s.Revision(), wresp.CompactRevision)
+}
+
+func TestLease(t *testing.T) {
+	s, err := NewServer()
+	require.NoError(t, err)
+	defer s.Close()
+	client := newClient(t, s)
+	defer client.Close()
+	ctx := context.Background()
+
+	lease, err := client.Grant(ctx, 10)
+	require.NoError(t, err)
+	_, err = client.Put(ctx, "/a/1", "x", etcd3.WithLease(lease.ID))
+	require.NoError(t, err)
+	ttl, err := client.TimeToLive(ctx, lease.ID, etcd3.WithAttachedKeys())
+	require.NoError(t, err)
+	assert.EqualValues(t, 10, ttl.GrantedTTL)
+	assert.Len(t, ttl.Keys, 1)
+
+	ka, err := client.KeepAlive(ctx, lease.ID)
+	require.NoError(t, err)
+	<-ka
+	s.ExpireLease(int64(lease.ID))
+	_, ok := s.Get("/a/1")
+	assert.False(t, ok)
+	// the keepalive channel is closed once the lease is gone
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-ka:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			t.Fatal("keepalive channel not closed")
+		}
+	}
+}
+
+func TestStopStart(t *testing.T) {
+	s, err := NewServer()
+	require.NoError(t, err)
+	defer s.Close()
+	client := newClient(t, s)
+	defer client.Close()
+
+	s.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	_, err = client.Put(ctx, "/a/1", "x")
+	cancel()
+	assert.Error(t, err, "the client cannot reach etcd")
+	s.Put("/a/1", "y")
+
+	require.NoError(t, s.Start())
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := client.Get(ctx, "/a/1")
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 1)
+	assert.Equal(t, "y", string(resp.Kvs[0].Value))
+}
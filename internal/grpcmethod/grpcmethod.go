@@ -0,0 +1,16 @@
+// Package grpcmethod parses the full grpc method names, shared by the interceptors, balancers and metrics.
+package grpcmethod
+
+import (
+	"strings"
+)
+
+// Split splits a full method name like "/package.Service/Method" into the service and the method.
+// Both are "unknown" when the name is malformed, so that they can be used as metric labels.
+func Split(fullMethod string) (service, method string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if i := strings.Index(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+	return "unknown", "unknown"
+}
@@ -0,0 +1,19 @@
+package grpcmethod
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplit(t *testing.T) {
+	for fullMethod, want := range map[string][2]string{
+		"/example.v1.User/Get": {"example.v1.User", "Get"},
+		"example.v1.User/Get":  {"example.v1.User", "Get"},
+		"/example.v1.User":     {"unknown", "unknown"},
+		"":                     {"unknown", "unknown"},
+	} {
+		service, method := Split(fullMethod)
+		assert.Equal(t, want, [2]string{service, method}, fullMethod)
+	}
+}
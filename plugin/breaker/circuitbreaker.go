@@ -85,6 +85,7 @@ type Breaker struct {
 	eventReceivers []chan BreakerEvent
 	listeners      []chan ListenerEvent
 	backoffLock    sync.Mutex
+	tripLock       sync.RWMutex
 }
 
 // Options holds breaker configuration options.
@@ -258,11 +259,21 @@ func (cb *Breaker) Fail() {
 	now := cb.Clock.Now()
 	atomic.StoreInt64(&cb.lastFailure, now.UnixNano())
 	cb.sendEvent(BreakerFail)
-	if cb.ShouldTrip != nil && cb.ShouldTrip(cb) {
+	cb.tripLock.RLock()
+	shouldTrip := cb.ShouldTrip
+	cb.tripLock.RUnlock()
+	if shouldTrip != nil && shouldTrip(cb) {
 		cb.Trip()
 	}
 }
 
+// SetShouldTrip replaces the TripFunc of a breaker that is in use.
+func (cb *Breaker) SetShouldTrip(shouldTrip TripFunc) {
+	cb.tripLock.Lock()
+	cb.ShouldTrip = shouldTrip
+	cb.tripLock.Unlock()
+}
+
 // Success is used to indicate a success condition the Breaker should record. If
 // the success was triggered by a retry attempt, the breaker will be Reset().
 func (cb *Breaker) Success() {
@@ -0,0 +1,36 @@
+package breaker
+
+import (
+	"fmt"
+)
+
+// ConfigItem is the config center item of the client breaker, see config.WatchBreaker.
+const ConfigItem = "breaker"
+
+type Config struct {
+	Trip       string  `json:"trip"`       //threshold、consecutive或rate
+	Threshold  int64   `json:"threshold"`  //threshold、consecutive的失败次数
+	Rate       float64 `json:"rate"`       //rate的错误率
+	MinSamples int64   `json:"minSamples"` //rate的最小样本数
+}
+
+// TripFunc returns the TripFunc of the config.
+func (c *Config) TripFunc() (TripFunc, error) {
+	switch c.Trip {
+	case "threshold":
+		if c.Threshold > 0 {
+			return ThresholdTripFunc(c.Threshold), nil
+		}
+	case "consecutive":
+		if c.Threshold > 0 {
+			return ConsecutiveTripFunc(c.Threshold), nil
+		}
+	case "rate":
+		if c.Rate > 0 && c.Rate <= 1 {
+			return RateTripFunc(c.Rate, c.MinSamples), nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown breaker trip '%s'", c.Trip)
+	}
+	return nil, fmt.Errorf("invalid %s breaker config", c.Trip)
+}
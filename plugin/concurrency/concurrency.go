@@ -0,0 +1,202 @@
+// Package concurrency limits the number of requests a service handles at the same time. The limit is
+// fixed or adapted from the latency of the requests by a Limit.
+package concurrency
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/chuangyou/qsf/grpc_error"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Limiter admits requests while fewer than the limit are in flight. It implements prometheus.Collector,
+// so it can be registered on the registry of the service monitor.
+type Limiter struct {
+	limit           Limit
+	mu              sync.Mutex
+	inflight        int
+	rtt             time.Duration //smoothed latency of the completed requests
+	limitGauge      prom.Gauge
+	inflightGauge   prom.Gauge
+	rejectedCounter prom.Counter
+}
+
+// Token is a request admitted by a Limiter, it must be finished by exactly one of Success, Dropped or Ignore.
+type Token struct {
+	limiter  *Limiter
+	start    time.Time
+	inflight int
+}
+
+func New(limit Limit) *Limiter {
+	l := &Limiter{
+		limit: limit,
+		limitGauge: prom.NewGauge(prom.GaugeOpts{
+			Name: "qsf_concurrency_limit",
+			Help: "Current maximum number of requests in flight.",
+		}),
+		inflightGauge: prom.NewGauge(prom.GaugeOpts{
+			Name: "qsf_concurrency_inflight",
+			Help: "Number of requests in flight.",
+		}),
+		rejectedCounter: prom.NewCounter(prom.CounterOpts{
+			Name: "qsf_concurrency_rejected_total",
+			Help: "Total number of requests rejected by the concurrency limit.",
+		}),
+	}
+	l.limitGauge.Set(float64(limit.Limit()))
+	return l
+}
+
+// Acquire admits a request, false if the limit of requests in flight is reached.
+func (l *Limiter) Acquire() (*Token, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inflight >= l.limit.Limit() {
+		l.rejectedCounter.Inc()
+		return nil, false
+	}
+	l.inflight++
+	l.inflightGauge.Set(float64(l.inflight))
+	return &Token{limiter: l, start: time.Now(), inflight: l.inflight}, true
+}
+
+// Success finishes a request that completed, its latency updates the limit.
+func (t *Token) Success() {
+	t.limiter.release(t, true, false)
+}
+
+// Dropped finishes a request that failed because the service was overloaded, the limit shrinks.
+func (t *Token) Dropped() {
+	t.limiter.release(t, true, true)
+}
+
+// Ignore finishes a request without updating the limit, e.g. a stream whose duration is not a latency.
+func (t *Token) Ignore() {
+	t.limiter.release(t, false, false)
+}
+
+func (l *Limiter) release(t *Token, sample, dropped bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	l.inflightGauge.Set(float64(l.inflight))
+	if !sample {
+		return
+	}
+	rtt := time.Since(t.start)
+	if l.rtt == 0 {
+		l.rtt = rtt
+	} else {
+		l.rtt += (rtt - l.rtt) / 10
+	}
+	l.limit.Update(rtt, t.inflight, dropped)
+	l.limitGauge.Set(float64(l.limit.Limit()))
+}
+
+// Limit returns the current maximum number of requests in flight.
+func (l *Limiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit.Limit()
+}
+
+// Inflight returns the number of requests in flight.
+func (l *Limiter) Inflight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inflight
+}
+
+// RetryDelay estimates when a rejected request would be admitted: the requests in flight complete at a
+// rate of limit per latency, one second before any request completed.
+func (l *Limiter) RetryDelay() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rtt == 0 {
+		return time.Second
+	}
+	limit := l.limit.Limit()
+	waiting := l.inflight - limit + 1
+	if waiting < 1 {
+		waiting = 1
+	}
+	delay := l.rtt * time.Duration(waiting) / time.Duration(limit)
+	if delay < time.Millisecond {
+		delay = time.Millisecond
+	}
+	return delay
+}
+
+// Describe implements prometheus.Collector.
+func (l *Limiter) Describe(ch chan<- *prom.Desc) {
+	l.limitGauge.Describe(ch)
+	l.inflightGauge.Describe(ch)
+	l.rejectedCounter.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (l *Limiter) Collect(ch chan<- prom.Metric) {
+	l.limitGauge.Collect(ch)
+	l.inflightGauge.Collect(ch)
+	l.rejectedCounter.Collect(ch)
+}
+
+// UnaryServerInterceptor limits the unary requests in flight, the latency of each one updates the limit.
+// A panicking handler releases its slot without updating the limit.
+func (l *Limiter) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		token, ok := l.Acquire()
+		if !ok {
+			return nil, l.limitError()
+		}
+		panicked := true
+		defer func() {
+			switch {
+			case panicked:
+				token.Ignore()
+			case overloaded(ctx, err):
+				token.Dropped()
+			default:
+				token.Success()
+			}
+		}()
+		resp, err = handler(ctx, req)
+		panicked = false
+		return
+	}
+}
+
+// StreamServerInterceptor counts the streams in flight against the limit without updating it.
+func (l *Limiter) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		token, ok := l.Acquire()
+		if !ok {
+			return l.limitError()
+		}
+		defer token.Ignore()
+		return handler(srv, stream)
+	}
+}
+
+func (l *Limiter) limitError() error {
+	return grpc_error.ResourceExhaustedDelay("服务并发限制", fmt.Sprintf("当前服务最大并发数为%d，请稍后重试。", l.Limit()), l.RetryDelay())
+}
+
+// overloaded reports whether a request failed because the service could not keep up.
+func overloaded(ctx context.Context, err error) bool {
+	if ctx.Err() == context.DeadlineExceeded {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
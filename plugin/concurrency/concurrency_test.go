@@ -0,0 +1,123 @@
+package concurrency
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chuangyou/qsf/grpc_error"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLimiter(t *testing.T) {
+	l := New(NewFixedLimit(2))
+	t1, ok := l.Acquire()
+	require.True(t, ok)
+	t2, ok := l.Acquire()
+	require.True(t, ok)
+	_, ok = l.Acquire()
+	assert.False(t, ok)
+	assert.Equal(t, 2, l.Inflight())
+	assert.Equal(t, time.Second, l.RetryDelay(), "without a completed request the delay is unknown")
+
+	t1.Success()
+	assert.Equal(t, 1, l.Inflight())
+	t2.Ignore()
+	_, ok = l.Acquire()
+	assert.True(t, ok)
+	assert.Equal(t, float64(2), testutil.ToFloat64(l.limitGauge))
+	assert.Equal(t, float64(1), testutil.ToFloat64(l.inflightGauge))
+	assert.Equal(t, float64(1), testutil.ToFloat64(l.rejectedCounter))
+}
+
+func TestLimiterAdapts(t *testing.T) {
+	l := New(NewAIMDLimit(AIMDOption{Initial: 4}))
+	token, _ := l.Acquire()
+	token.Dropped()
+	assert.Equal(t, 3, l.Limit())
+	assert.Equal(t, float64(3), testutil.ToFloat64(l.limitGauge))
+}
+
+func TestRetryDelay(t *testing.T) {
+	l := New(NewFixedLimit(2))
+	l.rtt = 100 * time.Millisecond
+	l.inflight = 2
+	// one slot frees every rtt/limit
+	assert.Equal(t, 50*time.Millisecond, l.RetryDelay())
+	l.inflight = 5
+	assert.Equal(t, 200*time.Millisecond, l.RetryDelay())
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	l := New(NewFixedLimit(1))
+	interceptor := l.UnaryServerInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: "/pkg.Service/Get"}
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go interceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		close(started)
+		<-release
+		return nil, nil
+	})
+	<-started
+
+	_, err := interceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	var retry *epb.RetryInfo
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*epb.RetryInfo); ok {
+			retry = info
+		}
+	}
+	require.NotNil(t, retry)
+	delay, err := ptypes.Duration(retry.RetryDelay)
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, delay)
+
+	close(release)
+	for l.Inflight() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	resp, err := interceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "ok", resp)
+}
+
+func TestInterceptorPanic(t *testing.T) {
+	l := New(NewFixedLimit(1))
+	info := &grpc.UnaryServerInfo{FullMethod: "/pkg.Service/Get"}
+	assert.Panics(t, func() {
+		l.UnaryServerInterceptor()(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			panic("handler")
+		})
+	})
+	assert.Equal(t, 0, l.Inflight())
+	assert.Equal(t, 1, l.Limit())
+
+	assert.Panics(t, func() {
+		l.StreamServerInterceptor()(nil, nil, &grpc.StreamServerInfo{}, func(srv interface{}, stream grpc.ServerStream) error {
+			panic("handler")
+		})
+	})
+	assert.Equal(t, 0, l.Inflight())
+}
+
+func TestOverloaded(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	assert.True(t, overloaded(ctx, nil))
+	assert.True(t, overloaded(context.Background(), grpc_error.ResourceExhausted("", "", 1)))
+	assert.False(t, overloaded(context.Background(), status.Error(codes.NotFound, "")))
+	assert.False(t, overloaded(context.Background(), nil))
+}
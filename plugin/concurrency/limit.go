@@ -0,0 +1,163 @@
+package concurrency
+
+import (
+	"math"
+	"time"
+)
+
+// Limit computes the concurrency limit from the requests completed by a Limiter. A Limiter calls it under
+// its lock, so implementations need not be safe for concurrent use.
+type Limit interface {
+	// Limit returns the current maximum number of requests in flight.
+	Limit() int
+	// Update adds the sample of a completed request: its latency, the requests in flight when it started,
+	// and whether it was dropped because the service was overloaded (timed out, rejected downstream).
+	Update(rtt time.Duration, inflight int, dropped bool)
+}
+
+type fixedLimit int
+
+// NewFixedLimit returns a Limit that always allows limit requests in flight.
+func NewFixedLimit(limit int) Limit {
+	if limit < 1 {
+		limit = 1
+	}
+	return fixedLimit(limit)
+}
+
+func (l fixedLimit) Limit() int {
+	return int(l)
+}
+
+func (l fixedLimit) Update(rtt time.Duration, inflight int, dropped bool) {}
+
+type AIMDOption struct {
+	Initial      int           //初始并发数，默认20
+	Min          int           //最小并发数，默认1
+	Max          int           //最大并发数，默认1000
+	BackoffRatio float64       //请求被丢弃或超时时的缩减比例，默认0.9
+	Timeout      time.Duration //延迟超过该值视为过载，默认5秒
+}
+
+type aimdLimit struct {
+	option AIMDOption
+	limit  int
+}
+
+// NewAIMDLimit returns a Limit that grows by one while the requests use at least half of it, and shrinks
+// by BackoffRatio when a request is dropped or slower than Timeout.
+func NewAIMDLimit(option AIMDOption) Limit {
+	if option.Min < 1 {
+		option.Min = 1
+	}
+	if option.Max <= 0 {
+		option.Max = 1000
+	}
+	if option.Initial <= 0 {
+		option.Initial = 20
+	}
+	if option.BackoffRatio <= 0 || option.BackoffRatio >= 1 {
+		option.BackoffRatio = 0.9
+	}
+	if option.Timeout <= 0 {
+		option.Timeout = 5 * time.Second
+	}
+	return &aimdLimit{option: option, limit: clamp(option.Initial, option.Min, option.Max)}
+}
+
+func (l *aimdLimit) Limit() int {
+	return l.limit
+}
+
+func (l *aimdLimit) Update(rtt time.Duration, inflight int, dropped bool) {
+	if dropped || rtt > l.option.Timeout {
+		l.limit = clamp(int(float64(l.limit)*l.option.BackoffRatio), l.option.Min, l.option.Max)
+	} else if inflight*2 >= l.limit {
+		l.limit = clamp(l.limit+1, l.option.Min, l.option.Max)
+	}
+}
+
+type GradientOption struct {
+	Initial    int     //初始并发数，默认20
+	Min        int     //最小并发数，默认1
+	Max        int     //最大并发数，默认1000
+	Tolerance  float64 //延迟超过长期平均延迟的该倍数时开始缩减，默认1.5
+	Smoothing  float64 //每次调整的平滑系数，默认0.2
+	LongWindow int     //长期平均延迟的样本数，默认600
+}
+
+type gradientLimit struct {
+	option  GradientOption
+	limit   float64
+	longRtt float64
+}
+
+// NewGradientLimit returns a Limit that follows the gradient between the long term average latency and the
+// latency of each request, in the manner of TCP Vegas: while latency stays within Tolerance of the average
+// the limit grows by a queue of sqrt(limit), and it shrinks as latency increases because requests queue up.
+func NewGradientLimit(option GradientOption) Limit {
+	if option.Min < 1 {
+		option.Min = 1
+	}
+	if option.Max <= 0 {
+		option.Max = 1000
+	}
+	if option.Initial <= 0 {
+		option.Initial = 20
+	}
+	if option.Tolerance < 1 {
+		option.Tolerance = 1.5
+	}
+	if option.Smoothing <= 0 || option.Smoothing > 1 {
+		option.Smoothing = 0.2
+	}
+	if option.LongWindow <= 0 {
+		option.LongWindow = 600
+	}
+	return &gradientLimit{option: option, limit: float64(clamp(option.Initial, option.Min, option.Max))}
+}
+
+func (l *gradientLimit) Limit() int {
+	return int(l.limit)
+}
+
+func (l *gradientLimit) Update(rtt time.Duration, inflight int, dropped bool) {
+	var (
+		shortRtt = float64(rtt)
+		gradient float64
+	)
+	if shortRtt <= 0 {
+		return
+	}
+	if l.longRtt == 0 {
+		l.longRtt = shortRtt
+	} else {
+		l.longRtt += (shortRtt - l.longRtt) / float64(l.option.LongWindow)
+	}
+	// the average catches up faster once latency recovered from a long overload
+	if l.longRtt/shortRtt > 2 {
+		l.longRtt *= 0.95
+	}
+	// requests far below the limit say nothing about the capacity of the service
+	if !dropped && float64(inflight) < l.limit/2 {
+		return
+	}
+	if dropped {
+		gradient = 0.5
+	} else {
+		gradient = math.Max(0.5, math.Min(1, l.option.Tolerance*l.longRtt/shortRtt))
+	}
+	limit := l.limit*gradient + math.Sqrt(l.limit)
+	limit = l.limit*(1-l.option.Smoothing) + limit*l.option.Smoothing
+	l.limit = math.Max(float64(l.option.Min), math.Min(float64(l.option.Max), limit))
+}
+
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
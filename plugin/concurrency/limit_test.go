@@ -0,0 +1,60 @@
+package concurrency
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFixedLimit(t *testing.T) {
+	l := NewFixedLimit(10)
+	l.Update(time.Hour, 10, true)
+	assert.Equal(t, 10, l.Limit())
+	assert.Equal(t, 1, NewFixedLimit(0).Limit())
+}
+
+func TestAIMDLimit(t *testing.T) {
+	l := NewAIMDLimit(AIMDOption{Initial: 10, Max: 12, Timeout: time.Second})
+	assert.Equal(t, 10, l.Limit())
+
+	// requests using less than half of the limit do not grow it
+	l.Update(time.Millisecond, 4, false)
+	assert.Equal(t, 10, l.Limit())
+	for i := 0; i < 5; i++ {
+		l.Update(time.Millisecond, 10, false)
+	}
+	assert.Equal(t, 12, l.Limit())
+
+	l.Update(time.Millisecond, 12, true)
+	assert.Equal(t, 10, l.Limit())
+	l.Update(2*time.Second, 10, false)
+	assert.Equal(t, 9, l.Limit())
+
+	l = NewAIMDLimit(AIMDOption{Initial: 1})
+	l.Update(time.Millisecond, 1, true)
+	assert.Equal(t, 1, l.Limit(), "the limit does not go below Min")
+}
+
+func TestGradientLimit(t *testing.T) {
+	l := NewGradientLimit(GradientOption{Initial: 20, Max: 100})
+
+	// steady latency grows the limit by its queue
+	for i := 0; i < 50; i++ {
+		l.Update(10*time.Millisecond, l.Limit(), false)
+	}
+	grown := l.Limit()
+	assert.True(t, grown > 20, "limit %d", grown)
+
+	// latency well above the average shrinks it
+	for i := 0; i < 20; i++ {
+		l.Update(100*time.Millisecond, l.Limit(), false)
+	}
+	assert.True(t, l.Limit() < grown, "limit %d", l.Limit())
+
+	l = NewGradientLimit(GradientOption{Initial: 20})
+	l.Update(10*time.Millisecond, 1, false)
+	assert.Equal(t, 20, l.Limit(), "requests far below the limit do not change it")
+	l.Update(10*time.Millisecond, 1, true)
+	assert.True(t, l.Limit() < 20)
+}
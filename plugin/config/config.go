@@ -0,0 +1,314 @@
+// Package config is the dynamic configuration center. The config items of a service are etcd keys
+// "<ConfigDir>/<service>/<item>" holding JSON or YAML, subscribers are called with the decoded value
+// of an item every time it changes and every change is recorded in the audit log.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chuangyou/qsf/constant"
+	etcd3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+)
+
+// resyncInterval is the wait between two failed attempts to read the items.
+const resyncInterval = time.Second
+
+var (
+	ErrNotFound   = errors.New("config item not found")
+	ErrNotPointer = errors.New("config value must be a non-nil pointer")
+)
+
+type Option struct {
+	EtcdConfig etcd3.Config
+	ConfigDir  string           //配置路径，默认constant.DEFAULT_CONFIG_PATH
+	Service    string           //服务名称
+	Audit      func(AuditEntry) //变更审计，默认以JSON写入Logger（可选）
+	Logger     *log.Logger      //配置中心日志，默认写入标准错误（可选）
+}
+
+// Subscriber is implemented by Center, the built-in plugins subscribe to their items through it.
+type Subscriber interface {
+	Subscribe(item string, v interface{}, fn func(v interface{}) error) (cancel func(), err error)
+}
+
+// AuditEntry records a change of an item.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Service  string    `json:"service"`
+	Item     string    `json:"item"`
+	Action   string    `json:"action"` //put或delete
+	Revision int64     `json:"revision"`
+	Previous string    `json:"previous,omitempty"`
+	Value    string    `json:"value,omitempty"`
+	Errors   []string  `json:"errors,omitempty"` //订阅者解码或应用失败的原因
+}
+
+// Center watches the items of a service. Subscribers are called one at a time, in the order of the
+// changes, and must not subscribe from the callback.
+type Center struct {
+	client  *etcd3.Client
+	service string
+	prefix  string
+	audit   func(AuditEntry)
+	logger  *log.Logger
+	mu      sync.Mutex
+	items   map[string][]byte
+	rev     int64
+	loaded  bool
+	subs    map[string][]*subscription
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+type subscription struct {
+	typ reflect.Type
+	fn  func(v interface{}) error
+}
+
+// New reads the items of the service and watches them until Close.
+func New(option Option) (*Center, error) {
+	if option.Service == "" {
+		return nil, errors.New("config center service is empty")
+	}
+	client, err := etcd3.New(option.EtcdConfig)
+	if err != nil {
+		return nil, err
+	}
+	c := newCenter(client, option)
+	if err = c.sync(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	c.loaded = true
+	go c.watch()
+	return c, nil
+}
+
+func newCenter(client *etcd3.Client, option Option) *Center {
+	dir := option.ConfigDir
+	if dir == "" {
+		dir = constant.DEFAULT_CONFIG_PATH
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Center{
+		client:  client,
+		service: option.Service,
+		prefix:  dir + "/" + option.Service + "/",
+		audit:   option.Audit,
+		logger:  option.Logger,
+		items:   make(map[string][]byte),
+		subs:    make(map[string][]*subscription),
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	if c.logger == nil {
+		c.logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	if c.audit == nil {
+		c.audit = c.logAudit
+	}
+	return c
+}
+
+func (c *Center) logAudit(entry AuditEntry) {
+	line, _ := json.Marshal(entry)
+	c.logger.Println("config change:", string(line))
+}
+
+// Subscribe calls fn with a new value of the type v points to, decoded from the item, at once if the
+// item is set and then on every change. An error of fn on a change is recorded in the audit log, at
+// once it is returned and fn is not subscribed. A deleted item leaves the subscribers with the last value.
+func (c *Center) Subscribe(item string, v interface{}, fn func(v interface{}) error) (cancel func(), err error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return nil, ErrNotPointer
+	}
+	sub := &subscription{typ: rv.Elem().Type(), fn: fn}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if value, ok := c.items[item]; ok {
+		if err = sub.call(value); err != nil {
+			return nil, err
+		}
+	}
+	c.subs[item] = append(c.subs[item], sub)
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		subs := c.subs[item]
+		for i := range subs {
+			if subs[i] == sub {
+				c.subs[item] = append(subs[:i:i], subs[i+1:]...)
+				break
+			}
+		}
+	}, nil
+}
+
+// Get decodes the current value of the item into v.
+func (c *Center) Get(item string, v interface{}) error {
+	c.mu.Lock()
+	value, ok := c.items[item]
+	c.mu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	return Decode(value, v)
+}
+
+func (s *subscription) call(value []byte) error {
+	v := reflect.New(s.typ).Interface()
+	if err := Decode(value, v); err != nil {
+		return err
+	}
+	return s.fn(v)
+}
+
+// watch applies the changes from the revision read by New, and reads all items again when the watch
+// fails, e.g. after a compaction.
+func (c *Center) watch() {
+	defer close(c.done)
+	for {
+		ctx, cancel := context.WithCancel(c.ctx)
+		for wresp := range c.client.Watch(ctx, c.prefix, etcd3.WithPrefix(), etcd3.WithRev(c.rev+1)) {
+			if wresp.Err() != nil {
+				c.logger.Printf("config watch of '%s' resyncs at revision %d: %v", c.prefix, c.rev, wresp.Err())
+				break
+			}
+			for _, ev := range wresp.Events {
+				item := strings.TrimPrefix(string(ev.Kv.Key), c.prefix)
+				c.apply(item, ev.Kv.Value, ev.Type == mvccpb.DELETE, ev.Kv.ModRevision)
+			}
+			c.mu.Lock()
+			c.rev = wresp.Header.Revision
+			c.mu.Unlock()
+		}
+		cancel()
+		for {
+			if c.ctx.Err() != nil || c.client.Ctx().Err() != nil {
+				return
+			}
+			if err := c.sync(); err == nil {
+				break
+			} else {
+				c.logger.Println("config get error:", err)
+			}
+			select {
+			case <-time.After(resyncInterval):
+			case <-c.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// sync reads all items and applies the ones that changed.
+func (c *Center) sync() error {
+	resp, err := c.client.Get(c.ctx, c.prefix, etcd3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	current := make(map[string]bool, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		item := strings.TrimPrefix(string(kv.Key), c.prefix)
+		current[item] = true
+		c.apply(item, kv.Value, false, kv.ModRevision)
+	}
+	c.mu.Lock()
+	var deleted []string
+	for item := range c.items {
+		if !current[item] {
+			deleted = append(deleted, item)
+		}
+	}
+	c.rev = resp.Header.Revision
+	c.mu.Unlock()
+	for _, item := range deleted {
+		c.apply(item, nil, true, resp.Header.Revision)
+	}
+	return nil
+}
+
+// apply stores the value of the item, calls its subscribers and records the change. The items read by
+// New are not changes and are not recorded.
+func (c *Center) apply(item string, value []byte, deleted bool, rev int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	previous, ok := c.items[item]
+	if deleted && !ok || !deleted && ok && bytes.Equal(previous, value) {
+		return
+	}
+	entry := AuditEntry{Time: time.Now(), Service: c.service, Item: item, Revision: rev, Previous: string(previous)}
+	if deleted {
+		entry.Action = "delete"
+		delete(c.items, item)
+	} else {
+		entry.Action = "put"
+		entry.Value = string(value)
+		c.items[item] = value
+		for _, sub := range c.subs[item] {
+			if err := sub.call(value); err != nil {
+				entry.Errors = append(entry.Errors, err.Error())
+			}
+		}
+	}
+	if c.loaded {
+		c.audit(entry)
+	}
+}
+
+// Close stops watching and closes the etcd client.
+func (c *Center) Close() error {
+	c.cancel()
+	<-c.done
+	return c.client.Close()
+}
+
+// Decode decodes a JSON or YAML value into v. YAML is converted to JSON first, so that the json tags of
+// v apply to both.
+func Decode(data []byte, v interface{}) error {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed) {
+		return json.Unmarshal(trimmed, v)
+	}
+	var value interface{}
+	if err := yaml.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	data, err := json.Marshal(jsonValue(value))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// jsonValue converts the maps decoded by yaml to maps with string keys.
+func jsonValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			m[fmt.Sprint(k)] = jsonValue(v)
+		}
+		return m
+	case []interface{}:
+		for i, v := range value {
+			value[i] = jsonValue(v)
+		}
+	}
+	return value
+}
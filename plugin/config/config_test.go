@@ -0,0 +1,200 @@
+package config
+
+import (
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chuangyou/qsf/internal/etcdtest"
+	etcd3 "github.com/coreos/etcd/clientv3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type limits struct {
+	Rate   int      `json:"rate"`
+	Paths  []string `json:"paths"`
+	Nested struct {
+		Enabled bool `json:"enabled"`
+	} `json:"nested"`
+}
+
+// startCenter starts etcd and a center of "example" recording its audit entries.
+func startCenter(t *testing.T, items map[string]string) (*etcdtest.Server, *Center, *etcd3.Client, <-chan AuditEntry) {
+	s, err := etcdtest.NewServer()
+	require.NoError(t, err)
+	for item, value := range items {
+		s.Put("/qsf.config/example/"+item, value)
+	}
+	cfg := etcd3.Config{Endpoints: s.Endpoints(), DialTimeout: 5 * time.Second}
+	audits := make(chan AuditEntry, 100)
+	c, err := New(Option{EtcdConfig: cfg, Service: "example", Audit: func(entry AuditEntry) { audits <- entry }})
+	require.NoError(t, err)
+	client, err := etcd3.New(cfg)
+	require.NoError(t, err)
+	return s, c, client, audits
+}
+
+func waitAudit(t *testing.T, audits <-chan AuditEntry) AuditEntry {
+	select {
+	case entry := <-audits:
+		return entry
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for audit entry")
+	}
+	return AuditEntry{}
+}
+
+func TestSubscribe(t *testing.T) {
+	s, c, client, audits := startCenter(t, map[string]string{"limits": `{"rate": 10, "paths": ["/a"]}`})
+	defer s.Close()
+	defer c.Close()
+	defer client.Close()
+
+	values := make(chan *limits, 10)
+	cancel, err := c.Subscribe("limits", &limits{}, func(v interface{}) error {
+		values <- v.(*limits)
+		return nil
+	})
+	require.NoError(t, err)
+	// the current value comes at once, loading it is not a change
+	assert.Equal(t, 10, (<-values).Rate)
+	assert.Empty(t, audits)
+
+	_, err = client.Put(context.Background(), "/qsf.config/example/limits", "rate: 20\npaths:\n- /b\nnested:\n  enabled: true\n")
+	require.NoError(t, err)
+	entry := waitAudit(t, audits)
+	assert.Equal(t, "limits", entry.Item)
+	assert.Equal(t, "put", entry.Action)
+	assert.Equal(t, `{"rate": 10, "paths": ["/a"]}`, entry.Previous)
+	assert.Empty(t, entry.Errors)
+	v := <-values
+	assert.Equal(t, 20, v.Rate)
+	assert.Equal(t, []string{"/b"}, v.Paths)
+	assert.True(t, v.Nested.Enabled)
+
+	// a value that does not decode is recorded and not applied
+	_, err = client.Put(context.Background(), "/qsf.config/example/limits", `rate: [1`)
+	require.NoError(t, err)
+	entry = waitAudit(t, audits)
+	assert.Len(t, entry.Errors, 1)
+	assert.Empty(t, values)
+
+	_, err = client.Delete(context.Background(), "/qsf.config/example/limits")
+	require.NoError(t, err)
+	entry = waitAudit(t, audits)
+	assert.Equal(t, "delete", entry.Action)
+	assert.Equal(t, ErrNotFound, c.Get("limits", &limits{}))
+
+	cancel()
+	_, err = client.Put(context.Background(), "/qsf.config/example/limits", `{"rate": 30}`)
+	require.NoError(t, err)
+	waitAudit(t, audits)
+	assert.Empty(t, values)
+	var current limits
+	require.NoError(t, c.Get("limits", &current))
+	assert.Equal(t, 30, current.Rate)
+}
+
+// lineWriter sends each write, a log line, on a channel.
+type lineWriter chan string
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestLogger(t *testing.T) {
+	s, err := etcdtest.NewServer()
+	require.NoError(t, err)
+	defer s.Close()
+	grpcLogger := etcd3.GetLogger()
+	lines := make(lineWriter, 100)
+	c, err := New(Option{EtcdConfig: etcd3.Config{Endpoints: s.Endpoints(), DialTimeout: 5 * time.Second},
+		Service: "example", Logger: log.New(lines, "", 0)})
+	require.NoError(t, err)
+	defer c.Close()
+	// the process-wide grpc logger is left alone
+	assert.True(t, grpcLogger == etcd3.GetLogger())
+
+	cancel, err := c.Subscribe("limits", &limits{}, func(interface{}) error { return nil })
+	require.NoError(t, err)
+	defer cancel()
+	s.Put("/qsf.config/example/limits", `{"rate": 10}`)
+	select {
+	case line := <-lines:
+		assert.True(t, strings.HasPrefix(line, "config change: "), line)
+		assert.Contains(t, line, `"item":"limits"`)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for the audit log")
+	}
+}
+
+func TestSubscribeError(t *testing.T) {
+	s, c, client, _ := startCenter(t, map[string]string{"limits": `{"rate": "10"}`})
+	defer s.Close()
+	defer c.Close()
+	defer client.Close()
+
+	_, err := c.Subscribe("limits", &limits{}, func(v interface{}) error { return nil })
+	assert.Error(t, err)
+	_, err = c.Subscribe("limits", limits{}, func(v interface{}) error { return nil })
+	assert.Equal(t, ErrNotPointer, err)
+}
+
+func TestResync(t *testing.T) {
+	s, c, client, audits := startCenter(t, map[string]string{"a": `{"rate": 1}`, "b": `{"rate": 2}`})
+	defer s.Close()
+	defer c.Close()
+	defer client.Close()
+	values := make(chan int, 10)
+	_, err := c.Subscribe("a", &limits{}, func(v interface{}) error {
+		values <- v.(*limits).Rate
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, <-values)
+
+	// the changes missed while disconnected are compacted, so the center reads the items again
+	s.Stop()
+	s.Put("/qsf.config/example/a", `{"rate": 3}`)
+	s.Delete("/qsf.config/example/b")
+	s.Compact(s.Revision())
+	require.NoError(t, s.Start())
+
+	changes := map[string]string{}
+	for i := 0; i < 2; i++ {
+		entry := waitAudit(t, audits)
+		changes[entry.Item] = entry.Action
+	}
+	assert.Equal(t, map[string]string{"a": "put", "b": "delete"}, changes)
+	assert.Equal(t, 3, <-values)
+}
+
+func TestDecode(t *testing.T) {
+	var v limits
+	require.NoError(t, Decode([]byte(`{"rate": 1, "nested": {"enabled": true}}`), &v))
+	assert.Equal(t, 1, v.Rate)
+	assert.True(t, v.Nested.Enabled)
+
+	v = limits{}
+	require.NoError(t, Decode([]byte("rate: 2\npaths: [/a, /b]\nnested: {enabled: true}"), &v))
+	assert.Equal(t, 2, v.Rate)
+	assert.Equal(t, []string{"/a", "/b"}, v.Paths)
+	assert.True(t, v.Nested.Enabled)
+
+	assert.Error(t, Decode([]byte("rate: x"), &v))
+}
+
+func TestSetLogLevel(t *testing.T) {
+	assert.NoError(t, SetLogLevel("WARNING"))
+	l := &levelLogger{}
+	assert.False(t, l.V(0))
+	assert.NoError(t, SetLogLevel("info"))
+	assert.True(t, l.V(0))
+	assert.Error(t, SetLogLevel("debug"))
+	assert.NoError(t, SetLogLevel("off"))
+	assert.False(t, l.V(0))
+}
@@ -0,0 +1,140 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/chuangyou/qsf/plugin/breaker"
+	etcd3 "github.com/coreos/etcd/clientv3"
+)
+
+// The items of the server and the client, the plugins define their own.
+const (
+	// LogItem sets the level of the grpc logger installed by SetGrpcLogger, which the registry and load
+	// balancer log to. The standard log package, which the server and the client write to, and the logger
+	// of the config center are not filtered by it.
+	LogItem = "log"
+	// AuthItem sets the access token of the service and of the client.
+	AuthItem = "auth"
+)
+
+// Log levels, lower ones include the higher ones.
+const (
+	LevelInfo = iota
+	LevelWarning
+	LevelError
+	LevelFatal
+	LevelOff
+)
+
+var (
+	levelNames = []string{"info", "warning", "error", "fatal", "off"}
+	logLevel   = int32(LevelWarning)
+)
+
+// SetGrpcLogger replaces the grpc logger of the process, which the etcd client discards by default, with
+// one writing the logs of the LogItem level and above to stderr, warning by default. The grpc logger is
+// global and can only be replaced before grpc is used, so it is opt-in: call it first thing in main.
+// Without it the LogItem and SetLogLevel have no effect.
+func SetGrpcLogger() {
+	etcd3.SetLogger(&levelLogger{logger: log.New(os.Stderr, "", log.LstdFlags)})
+}
+
+type LogConfig struct {
+	Level string `json:"level"` //info、warning、error、fatal或off
+}
+
+type AuthConfig struct {
+	AccessToken string `json:"accessToken"` //服务密钥
+}
+
+// WatchLogLevel sets the level of the grpc logger installed by SetGrpcLogger from the LogItem.
+func WatchLogLevel(s Subscriber) (cancel func(), err error) {
+	return s.Subscribe(LogItem, &LogConfig{}, func(v interface{}) error {
+		return SetLogLevel(v.(*LogConfig).Level)
+	})
+}
+
+// WatchBreaker replaces the TripFunc of cb from the breaker.ConfigItem.
+func WatchBreaker(s Subscriber, cb *breaker.Breaker) (cancel func(), err error) {
+	return s.Subscribe(breaker.ConfigItem, &breaker.Config{}, func(v interface{}) error {
+		shouldTrip, err := v.(*breaker.Config).TripFunc()
+		if err != nil {
+			return err
+		}
+		cb.SetShouldTrip(shouldTrip)
+		return nil
+	})
+}
+
+// WatchAccessToken calls set with the access token of the AuthItem.
+func WatchAccessToken(s Subscriber, set func(token string)) (cancel func(), err error) {
+	return s.Subscribe(AuthItem, &AuthConfig{}, func(v interface{}) error {
+		token := v.(*AuthConfig).AccessToken
+		if token == "" {
+			return errors.New("access token is empty")
+		}
+		set(token)
+		return nil
+	})
+}
+
+// SetLogLevel makes the grpc logger installed by SetGrpcLogger write the logs of level and above, it is
+// warning by default.
+func SetLogLevel(level string) error {
+	for i, name := range levelNames {
+		if strings.EqualFold(level, name) {
+			atomic.StoreInt32(&logLevel, int32(i))
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level '%s'", level)
+}
+
+// levelLogger is a grpclog.LoggerV2 filtering the logs by logLevel.
+type levelLogger struct {
+	logger *log.Logger
+}
+
+func (l *levelLogger) output(level int, s string) {
+	if int32(level) >= atomic.LoadInt32(&logLevel) {
+		l.logger.Output(3, strings.ToUpper(levelNames[level])+": "+s)
+	}
+}
+
+func (l *levelLogger) Info(args ...interface{})   { l.output(LevelInfo, fmt.Sprint(args...)) }
+func (l *levelLogger) Infoln(args ...interface{}) { l.output(LevelInfo, fmt.Sprintln(args...)) }
+func (l *levelLogger) Infof(format string, args ...interface{}) {
+	l.output(LevelInfo, fmt.Sprintf(format, args...))
+}
+func (l *levelLogger) Warning(args ...interface{})   { l.output(LevelWarning, fmt.Sprint(args...)) }
+func (l *levelLogger) Warningln(args ...interface{}) { l.output(LevelWarning, fmt.Sprintln(args...)) }
+func (l *levelLogger) Warningf(format string, args ...interface{}) {
+	l.output(LevelWarning, fmt.Sprintf(format, args...))
+}
+func (l *levelLogger) Error(args ...interface{})   { l.output(LevelError, fmt.Sprint(args...)) }
+func (l *levelLogger) Errorln(args ...interface{}) { l.output(LevelError, fmt.Sprintln(args...)) }
+func (l *levelLogger) Errorf(format string, args ...interface{}) {
+	l.output(LevelError, fmt.Sprintf(format, args...))
+}
+func (l *levelLogger) Fatal(args ...interface{}) {
+	l.output(LevelFatal, fmt.Sprint(args...))
+	os.Exit(1)
+}
+func (l *levelLogger) Fatalln(args ...interface{}) {
+	l.output(LevelFatal, fmt.Sprintln(args...))
+	os.Exit(1)
+}
+func (l *levelLogger) Fatalf(format string, args ...interface{}) {
+	l.output(LevelFatal, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// V reports whether the verbose logs of level l are written, only the info level ones are.
+func (l *levelLogger) V(level int) bool {
+	return level <= 0 && atomic.LoadInt32(&logLevel) == LevelInfo
+}
@@ -0,0 +1,59 @@
+package config_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chuangyou/qsf/internal/etcdtest"
+	"github.com/chuangyou/qsf/plugin/breaker"
+	"github.com/chuangyou/qsf/plugin/config"
+	"github.com/chuangyou/qsf/plugin/ratelimit"
+	etcd3 "github.com/coreos/etcd/clientv3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestPlugins(t *testing.T) {
+	s, err := etcdtest.NewServer()
+	require.NoError(t, err)
+	defer s.Close()
+	s.Put("/qsf.config/example/"+ratelimit.ConfigItem, `{"rate": 50}`)
+	cfg := etcd3.Config{Endpoints: s.Endpoints(), DialTimeout: 5 * time.Second}
+	audits := make(chan config.AuditEntry, 10)
+	c, err := config.New(config.Option{EtcdConfig: cfg, Service: "example", Audit: func(entry config.AuditEntry) { audits <- entry }})
+	require.NoError(t, err)
+	defer c.Close()
+	client, err := etcd3.New(cfg)
+	require.NoError(t, err)
+	defer client.Close()
+
+	rl := ratelimit.New(10, time.Second)
+	_, err = ratelimit.Watch(c, rl)
+	require.NoError(t, err)
+	assert.Equal(t, 50, rl.Rate())
+
+	cb := breaker.NewConsecutiveBreaker(100)
+	_, err = config.WatchBreaker(c, cb)
+	require.NoError(t, err)
+
+	_, err = client.Txn(context.Background()).Then(
+		etcd3.OpPut("/qsf.config/example/"+ratelimit.ConfigItem, "rate: 0"),
+		etcd3.OpPut("/qsf.config/example/"+breaker.ConfigItem, "trip: consecutive\nthreshold: 2\n"),
+	).Commit()
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		entry := <-audits
+		if entry.Item == ratelimit.ConfigItem {
+			assert.Len(t, entry.Errors, 1)
+		} else {
+			assert.Empty(t, entry.Errors)
+		}
+	}
+	// the invalid rate is not applied
+	assert.Equal(t, 50, rl.Rate())
+	cb.Fail()
+	assert.False(t, cb.Tripped())
+	cb.Fail()
+	assert.True(t, cb.Tripped())
+}
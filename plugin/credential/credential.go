@@ -0,0 +1,109 @@
+// Package credential builds the TLS configuration shared by qsf services, clients and
+// gateways, and exposes the certificate identity of the caller to handlers.
+package credential
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+var (
+	ErrNoCertificate = errors.New("credential: no certificate found")
+)
+
+// NewServerTLSConfig loads the server certificate pair. If clientCAFile is set, clients
+// must present a certificate signed by one of its CAs (mutual TLS).
+func NewServerTLSConfig(certFile, keyFile, clientCAFile string) (config *tls.Config, err error) {
+	var (
+		cert tls.Certificate
+	)
+	cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return
+	}
+	config = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		config.ClientCAs, err = loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return
+}
+
+// NewClientTLSConfig verifies the server against caFile (or the system roots when empty).
+// If certFile and keyFile are set, the client presents that certificate for mutual TLS.
+func NewClientTLSConfig(caFile, serverName, certFile, keyFile string) (config *tls.Config, err error) {
+	var (
+		cert tls.Certificate
+	)
+	config = &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if caFile != "" {
+		config.RootCAs, err = loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return
+}
+
+// PeerCertificate returns the verified certificate the caller presented over TLS.
+func PeerCertificate(ctx context.Context) (*x509.Certificate, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.AuthInfo == nil {
+		return nil, ErrNoCertificate
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil, ErrNoCertificate
+	}
+	if len(tlsInfo.State.VerifiedChains) > 0 && len(tlsInfo.State.VerifiedChains[0]) > 0 {
+		return tlsInfo.State.VerifiedChains[0][0], nil
+	}
+	return nil, ErrNoCertificate
+}
+
+// PeerCommonName returns the subject common name of the caller's verified certificate.
+func PeerCommonName(ctx context.Context) string {
+	cert, err := PeerCertificate(ctx)
+	if err != nil {
+		return ""
+	}
+	return cert.Subject.CommonName
+}
+
+func loadCertPool(caFile string) (pool *x509.CertPool, err error) {
+	var (
+		pem []byte
+	)
+	pem, err = ioutil.ReadFile(caFile)
+	if err != nil {
+		return
+	}
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("credential: no certificate found in %s", caFile)
+	}
+	return
+}
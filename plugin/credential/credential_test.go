@@ -0,0 +1,164 @@
+package credential
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+type pki struct {
+	dir    string
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	serial int64
+}
+
+func newPKI(t *testing.T) *pki {
+	dir, err := ioutil.TempDir("", "qsf-credential")
+	require.NoError(t, err)
+	p := &pki{dir: dir}
+	p.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := p.template("qsf test ca")
+	tmpl.IsCA = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign
+	tmpl.BasicConstraintsValid = true
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &p.caKey.PublicKey, p.caKey)
+	require.NoError(t, err)
+	p.caCert, err = x509.ParseCertificate(der)
+	require.NoError(t, err)
+	p.writePEM(t, "ca.pem", "CERTIFICATE", der)
+	return p
+}
+
+func (p *pki) template(cn string) *x509.Certificate {
+	p.serial++
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(p.serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+}
+
+// issue writes <name>.pem and <name>.key signed by the test CA.
+func (p *pki) issue(t *testing.T, name, cn string, usage x509.ExtKeyUsage) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := p.template(cn)
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.DNSNames = []string{"localhost"}
+	tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, p.caCert, &key.PublicKey, p.caKey)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	p.writePEM(t, name+".pem", "CERTIFICATE", der)
+	p.writePEM(t, name+".key", "EC PRIVATE KEY", keyDer)
+}
+
+func (p *pki) writePEM(t *testing.T, name, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	require.NoError(t, ioutil.WriteFile(p.path(name), data, 0600))
+}
+
+func (p *pki) path(name string) string {
+	return filepath.Join(p.dir, name)
+}
+
+type identityHealthServer struct {
+	commonName chan string
+}
+
+func (s *identityHealthServer) Check(ctx context.Context, _ *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	s.commonName <- PeerCommonName(ctx)
+	return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+}
+
+func startServer(t *testing.T, p *pki, clientCAFile string) (string, *identityHealthServer, func()) {
+	serverConfig, err := NewServerTLSConfig(p.path("server.pem"), p.path("server.key"), clientCAFile)
+	require.NoError(t, err)
+	srv := grpc.NewServer(grpc.Creds(credentials.NewTLS(serverConfig)))
+	health := &identityHealthServer{commonName: make(chan string, 1)}
+	healthpb.RegisterHealthServer(srv, health)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(lis)
+	return lis.Addr().String(), health, srv.Stop
+}
+
+func check(addr string, tlsCAFile, certFile, keyFile string) error {
+	clientConfig, err := NewClientTLSConfig(tlsCAFile, "localhost", certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(credentials.NewTLS(clientConfig)), grpc.WithBlock())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	return err
+}
+
+func TestMutualTLSExposesPeerIdentity(t *testing.T) {
+	p := newPKI(t)
+	defer os.RemoveAll(p.dir)
+	p.issue(t, "server", "example.service", x509.ExtKeyUsageServerAuth)
+	p.issue(t, "client", "example.gateway", x509.ExtKeyUsageClientAuth)
+	addr, health, stop := startServer(t, p, p.path("ca.pem"))
+	defer stop()
+
+	require.NoError(t, check(addr, p.path("ca.pem"), p.path("client.pem"), p.path("client.key")))
+	assert.Equal(t, "example.gateway", <-health.commonName)
+}
+
+func TestMutualTLSRejectsClientWithoutCertificate(t *testing.T) {
+	p := newPKI(t)
+	defer os.RemoveAll(p.dir)
+	p.issue(t, "server", "example.service", x509.ExtKeyUsageServerAuth)
+	addr, _, stop := startServer(t, p, p.path("ca.pem"))
+	defer stop()
+
+	assert.Error(t, check(addr, p.path("ca.pem"), "", ""))
+}
+
+func TestServerOnlyTLS(t *testing.T) {
+	p := newPKI(t)
+	defer os.RemoveAll(p.dir)
+	p.issue(t, "server", "example.service", x509.ExtKeyUsageServerAuth)
+	addr, health, stop := startServer(t, p, "")
+	defer stop()
+
+	require.NoError(t, check(addr, p.path("ca.pem"), "", ""))
+	assert.Equal(t, "", <-health.commonName)
+}
+
+func TestLoadCertPoolRejectsEmptyFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "qsf-ca")
+	require.NoError(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+	_, err = NewClientTLSConfig(f.Name(), "", "", "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,209 @@
+// Package graceful implements zero-downtime restarts by handing the listening
+// sockets of the current process over to a freshly started copy of itself.
+//
+// Listeners are created with Listen. On restart, every listener that is still
+// open is passed to the child process as an inherited file descriptor, keyed by
+// the address it was requested with, so the child's Listen call for the same
+// address reuses the socket instead of binding a new one. The child calls Ready
+// once it is serving, and only then does the parent start draining.
+package graceful
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// envListenFds lists the inherited listeners as "addr=fd" pairs separated by ";".
+	envListenFds = "QSF_LISTEN_FDS"
+	// envReadyFd is the pipe the child writes to once it is ready.
+	envReadyFd = "QSF_READY_FD"
+)
+
+var (
+	ErrRestartTimeout = errors.New("graceful: timed out waiting for the new process")
+	ErrRestartFailed  = errors.New("graceful: new process exited before it was ready")
+)
+
+var (
+	mu        sync.Mutex
+	inherited map[string]*os.File
+	listeners = make(map[string]*listener)
+	readyOnce sync.Once
+)
+
+type listener struct {
+	net.Listener
+	addr      string
+	closeOnce sync.Once
+}
+
+func (l *listener) Close() (err error) {
+	l.closeOnce.Do(func() {
+		mu.Lock()
+		if listeners[l.addr] == l {
+			delete(listeners, l.addr)
+		}
+		mu.Unlock()
+		err = l.Listener.Close()
+	})
+	return
+}
+
+// Listen announces on the tcp address addr. If the process was started by
+// Restart and inherited a listener for addr, that listener is returned instead.
+func Listen(addr string) (net.Listener, error) {
+	var (
+		lis net.Listener
+		err error
+	)
+	mu.Lock()
+	defer mu.Unlock()
+	if inherited == nil {
+		inherited = parseInherited(os.Getenv(envListenFds))
+	}
+	if f, ok := inherited[addr]; ok {
+		delete(inherited, addr)
+		lis, err = net.FileListener(f)
+		f.Close()
+	} else {
+		lis, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	l := &listener{Listener: lis, addr: addr}
+	listeners[addr] = l
+	return l, nil
+}
+
+// Ready tells the parent process, if any, that this process is serving and the
+// parent may start draining. It is safe to call more than once.
+func Ready() {
+	readyOnce.Do(func() {
+		fd, err := strconv.Atoi(os.Getenv(envReadyFd))
+		if err != nil {
+			return
+		}
+		f := os.NewFile(uintptr(fd), "qsf-ready")
+		f.Write([]byte{1})
+		f.Close()
+	})
+}
+
+// Restart starts a new copy of the current process with every open listener
+// and waits up to timeout for it to call Ready. The caller keeps serving on its
+// own listeners; on success it should drain and exit.
+func Restart(timeout time.Duration) (pid int, err error) {
+	return restart(os.Args, timeout)
+}
+
+func restart(args []string, timeout time.Duration) (pid int, err error) {
+	var (
+		files   []*os.File
+		pairs   []string
+		readyR  *os.File
+		readyW  *os.File
+		cmd     *exec.Cmd
+		readyCh = make(chan bool, 1)
+	)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	mu.Lock()
+	for addr, l := range listeners {
+		f, fileErr := listenerFile(l.Listener)
+		if fileErr != nil {
+			mu.Unlock()
+			return 0, fileErr
+		}
+		// ExtraFiles[i] becomes file descriptor 3+i in the child
+		pairs = append(pairs, addr+"="+strconv.Itoa(3+len(files)))
+		files = append(files, f)
+	}
+	mu.Unlock()
+	readyR, readyW, err = os.Pipe()
+	if err != nil {
+		return
+	}
+	defer readyR.Close()
+	cmd = exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(environ(),
+		envListenFds+"="+strings.Join(pairs, ";"),
+		envReadyFd+"="+strconv.Itoa(3+len(files)),
+	)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return
+	}
+	go func() {
+		b, _ := ioutil.ReadAll(readyR)
+		readyCh <- len(b) > 0
+	}()
+	select {
+	case ready := <-readyCh:
+		if !ready {
+			cmd.Wait()
+			return 0, ErrRestartFailed
+		}
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, ErrRestartTimeout
+	}
+	go cmd.Wait()
+	return cmd.Process.Pid, nil
+}
+
+func listenerFile(l net.Listener) (*os.File, error) {
+	switch lis := l.(type) {
+	case *net.TCPListener:
+		return lis.File()
+	case *net.UnixListener:
+		return lis.File()
+	default:
+		return nil, fmt.Errorf("graceful: unsupported listener type %T", l)
+	}
+}
+
+func parseInherited(value string) map[string]*os.File {
+	files := make(map[string]*os.File)
+	for _, pair := range strings.Split(value, ";") {
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 {
+			continue
+		}
+		fd, err := strconv.Atoi(pair[i+1:])
+		if err != nil {
+			continue
+		}
+		files[pair[:i]] = os.NewFile(uintptr(fd), pair[:i])
+	}
+	return files
+}
+
+// environ returns the environment of the current process without the variables set by a previous restart.
+func environ() (env []string) {
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, envListenFds+"=") || strings.HasPrefix(kv, envReadyFd+"=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return
+}
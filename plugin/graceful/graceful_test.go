@@ -0,0 +1,72 @@
+package graceful
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const helperAddr = "127.0.0.1:0"
+
+func TestRestartHandsOverListener(t *testing.T) {
+	lis, err := Listen(helperAddr)
+	require.NoError(t, err)
+	addr := lis.Addr().String()
+
+	os.Setenv("QSF_GRACEFUL_HELPER", "1")
+	defer os.Unsetenv("QSF_GRACEFUL_HELPER")
+	pid, err := restart([]string{os.Args[0], "-test.run=TestHelperProcess"}, 10*time.Second)
+	require.NoError(t, err)
+	assert.NotZero(t, pid)
+
+	// the parent stops accepting, the child keeps the same socket
+	lis.Close()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	b, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "child", string(b))
+}
+
+func TestRestartFailsWhenChildExits(t *testing.T) {
+	os.Setenv("QSF_GRACEFUL_HELPER", "exit")
+	defer os.Unsetenv("QSF_GRACEFUL_HELPER")
+	_, err := restart([]string{os.Args[0], "-test.run=TestHelperProcess"}, 10*time.Second)
+	assert.Equal(t, ErrRestartFailed, err)
+}
+
+func TestParseInherited(t *testing.T) {
+	files := parseInherited("0.0.0.0:8080=3;[::1]:9090=4;broken")
+	require.Len(t, files, 2)
+	assert.Equal(t, uintptr(3), files["0.0.0.0:8080"].Fd())
+	assert.Equal(t, uintptr(4), files["[::1]:9090"].Fd())
+}
+
+// TestHelperProcess is the child started by the restart tests.
+func TestHelperProcess(t *testing.T) {
+	switch os.Getenv("QSF_GRACEFUL_HELPER") {
+	case "1":
+	case "exit":
+		os.Exit(1)
+	default:
+		return
+	}
+	lis, err := Listen(helperAddr)
+	if err != nil {
+		os.Exit(2)
+	}
+	Ready()
+	conn, err := lis.Accept()
+	if err != nil {
+		os.Exit(3)
+	}
+	conn.Write([]byte("child"))
+	conn.Close()
+	os.Exit(0)
+}
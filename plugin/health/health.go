@@ -0,0 +1,45 @@
+// Package health implements the grpc.health.v1.Health service on top of the upstream grpc health server.
+package health
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Server is the upstream health server, which also keeps the overall status of the node, set under the
+// empty service name, for its registration.
+type Server struct {
+	*health.Server
+	mu      sync.Mutex
+	serving bool
+}
+
+// NewServer returns a health server whose overall status is SERVING.
+func NewServer() *Server {
+	return &Server{Server: health.NewServer(), serving: true}
+}
+
+// AuthFuncOverride lets probes check the health without an access token.
+func (s *Server) AuthFuncOverride(ctx context.Context, fullMethodName string) (context.Context, error) {
+	return ctx, nil
+}
+
+// SetServingStatus records the serving status of service, the empty service name is the overall status.
+func (s *Server) SetServingStatus(service string, servingStatus healthpb.HealthCheckResponse_ServingStatus) {
+	s.Server.SetServingStatus(service, servingStatus)
+	if service == "" {
+		s.mu.Lock()
+		s.serving = servingStatus == healthpb.HealthCheckResponse_SERVING
+		s.mu.Unlock()
+	}
+}
+
+// Serving reports whether the overall status is SERVING, only then the node may be registered.
+func (s *Server) Serving() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.serving
+}
@@ -0,0 +1,46 @@
+package health
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func check(t *testing.T, s *Server, service string) (healthpb.HealthCheckResponse_ServingStatus, codes.Code) {
+	resp, err := s.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		return healthpb.HealthCheckResponse_UNKNOWN, status.Code(err)
+	}
+	return resp.Status, codes.OK
+}
+
+func TestCheck(t *testing.T) {
+	s := NewServer()
+	servingStatus, code := check(t, s, "")
+	require.Equal(t, codes.OK, code)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, servingStatus)
+
+	_, code = check(t, s, "example.ExampleService")
+	assert.Equal(t, codes.NotFound, code)
+
+	s.SetServingStatus("example.ExampleService", healthpb.HealthCheckResponse_NOT_SERVING)
+	servingStatus, code = check(t, s, "example.ExampleService")
+	require.Equal(t, codes.OK, code)
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, servingStatus)
+}
+
+func TestServing(t *testing.T) {
+	s := NewServer()
+	assert.True(t, s.Serving())
+	s.SetServingStatus("example.ExampleService", healthpb.HealthCheckResponse_NOT_SERVING)
+	assert.True(t, s.Serving())
+	s.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	assert.False(t, s.Serving())
+	s.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	assert.True(t, s.Serving())
+}
@@ -0,0 +1,394 @@
+// Package jwt verifies HS256 and RS256 signed JSON Web Tokens and carries their claims in the context.
+package jwt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	//JWKS中oct密钥的最小字节数，即HS256的哈希长度
+	MinHMACKeySize = sha256.Size
+)
+
+var (
+	ErrMalformed        = errors.New("jwt: malformed token")
+	ErrUnsupportedAlg   = errors.New("jwt: unsupported algorithm")
+	ErrInvalidSignature = errors.New("jwt: invalid signature")
+	ErrExpired          = errors.New("jwt: token is expired")
+	ErrNoExpiration     = errors.New("jwt: token has no expiration")
+	ErrNotValidYet      = errors.New("jwt: token is not valid yet")
+	ErrInvalidAudience  = errors.New("jwt: invalid audience")
+	ErrInvalidIssuer    = errors.New("jwt: invalid issuer")
+	ErrNoKey            = errors.New("jwt: no verification key configured")
+)
+
+type Option struct {
+	HMACSecret       []byte        //HS256密钥
+	RSAPublicKeyFile string        //RS256公钥文件（PEM）
+	JWKSFile         string        //JWKS文件，支持RSA与oct密钥，密钥须有kid
+	Audience         string        //要求的aud，为空则不校验
+	Issuer           string        //要求的iss，为空则不校验
+	Leeway           time.Duration //exp/nbf允许的时间误差
+	AllowNoExpiry    bool          //允许不含exp的令牌（永不过期），默认拒绝
+}
+
+// Verifier checks the signature and the registered claims of tokens. It is safe for concurrent use.
+type Verifier struct {
+	hmacKeys map[string][]byte
+	rsaKeys  map[string]*rsa.PublicKey
+	audience string
+	issuer   string
+	leeway   time.Duration
+	noExpiry bool
+	now      func() time.Time
+}
+
+// Claims are the claims of a verified token. Extra holds every claim of the payload, including the registered ones.
+type Claims struct {
+	Issuer    string
+	Subject   string
+	Audience  []string
+	ExpiresAt int64
+	NotBefore int64
+	IssuedAt  int64
+	ID        string
+	Extra     map[string]interface{}
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	K   string `json:"k"`
+}
+
+func NewVerifier(option Option) (verifier *Verifier, err error) {
+	verifier = &Verifier{
+		hmacKeys: make(map[string][]byte),
+		rsaKeys:  make(map[string]*rsa.PublicKey),
+		audience: option.Audience,
+		issuer:   option.Issuer,
+		leeway:   option.Leeway,
+		noExpiry: option.AllowNoExpiry,
+		now:      time.Now,
+	}
+	if len(option.HMACSecret) > 0 {
+		verifier.hmacKeys[""] = option.HMACSecret
+	}
+	if option.RSAPublicKeyFile != "" {
+		verifier.rsaKeys[""], err = loadRSAPublicKey(option.RSAPublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if option.JWKSFile != "" {
+		err = verifier.loadJWKS(option.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(verifier.hmacKeys) == 0 && len(verifier.rsaKeys) == 0 {
+		return nil, ErrNoKey
+	}
+	return
+}
+
+// Verify checks the token and returns its claims.
+func (v *Verifier) Verify(token string) (claims *Claims, err error) {
+	var (
+		parts     = strings.Split(token, ".")
+		h         header
+		signature []byte
+		payload   []byte
+	)
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	if err = decodeSegment(parts[0], &h); err != nil {
+		return nil, ErrMalformed
+	}
+	if signature, err = base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+		return nil, ErrMalformed
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	switch h.Alg {
+	case AlgHS256:
+		err = v.verifyHMAC(h.Kid, signed, signature)
+	case AlgRS256:
+		err = v.verifyRSA(h.Kid, signed, signature)
+	default:
+		err = ErrUnsupportedAlg
+	}
+	if err != nil {
+		return nil, err
+	}
+	if payload, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return nil, ErrMalformed
+	}
+	if claims, err = parseClaims(payload); err != nil {
+		return nil, ErrMalformed
+	}
+	if err = v.validate(claims); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (v *Verifier) verifyHMAC(kid string, signed, signature []byte) error {
+	for id, key := range v.hmacKeys {
+		if !matchKid(kid, id) {
+			continue
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write(signed)
+		if hmac.Equal(mac.Sum(nil), signature) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+func (v *Verifier) verifyRSA(kid string, signed, signature []byte) error {
+	hash := sha256.Sum256(signed)
+	for id, key := range v.rsaKeys {
+		if !matchKid(kid, id) {
+			continue
+		}
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) == nil {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+func (v *Verifier) validate(claims *Claims) error {
+	now := v.now().Unix()
+	leeway := int64(v.leeway / time.Second)
+	if claims.ExpiresAt == 0 && !v.noExpiry {
+		return ErrNoExpiration
+	}
+	if claims.ExpiresAt != 0 && now > claims.ExpiresAt+leeway {
+		return ErrExpired
+	}
+	if claims.NotBefore != 0 && now+leeway < claims.NotBefore {
+		return ErrNotValidYet
+	}
+	if v.audience != "" && !claims.HasAudience(v.audience) {
+		return ErrInvalidAudience
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return ErrInvalidIssuer
+	}
+	return nil
+}
+
+// HasAudience reports whether aud is one of the audiences of the token.
+func (c *Claims) HasAudience(aud string) bool {
+	for _, a := range c.Audience {
+		if a == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// StringClaim returns the claim name if it is a string.
+func (c *Claims) StringClaim(name string) string {
+	s, _ := c.Extra[name].(string)
+	return s
+}
+
+// StringsClaim returns the claim name as a list, a string claim is split on spaces like the OAuth2 "scope" claim.
+func (c *Claims) StringsClaim(name string) (values []string) {
+	switch v := c.Extra[name].(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	return
+}
+
+type claimsKey struct{}
+
+// NewContext returns a context carrying the claims of the caller.
+func NewContext(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// FromContext returns the claims put into ctx by the service authentication.
+func FromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*Claims)
+	return claims, ok
+}
+
+// TokenFromHTTPRequest returns the bearer token of the Authorization header, for gateways.
+func TokenFromHTTPRequest(r *http.Request) string {
+	scheme, token := SplitAuthorization(r.Header.Get("Authorization"))
+	if !strings.EqualFold(scheme, "bearer") {
+		return ""
+	}
+	return token
+}
+
+// SplitAuthorization splits an authorization value such as "Bearer <token>" into its scheme and credentials.
+func SplitAuthorization(value string) (scheme, token string) {
+	i := strings.IndexByte(value, ' ')
+	if i < 0 {
+		return "", ""
+	}
+	return value[:i], strings.TrimSpace(value[i+1:])
+}
+
+// matchKid reports whether a key with id keyID may verify a token with kid. Keys without an id match any token.
+func matchKid(kid, keyID string) bool {
+	return kid == "" || keyID == "" || kid == keyID
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func parseClaims(payload []byte) (claims *Claims, err error) {
+	var (
+		decoder = json.NewDecoder(bytes.NewReader(payload))
+	)
+	claims = new(Claims)
+	decoder.UseNumber()
+	if err = decoder.Decode(&claims.Extra); err != nil {
+		return nil, err
+	}
+	claims.Issuer, _ = claims.Extra["iss"].(string)
+	claims.Subject, _ = claims.Extra["sub"].(string)
+	claims.ID, _ = claims.Extra["jti"].(string)
+	switch aud := claims.Extra["aud"].(type) {
+	case string:
+		claims.Audience = []string{aud}
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				claims.Audience = append(claims.Audience, s)
+			}
+		}
+	}
+	if claims.ExpiresAt, err = numericDate(claims.Extra["exp"]); err != nil {
+		return nil, err
+	}
+	if claims.NotBefore, err = numericDate(claims.Extra["nbf"]); err != nil {
+		return nil, err
+	}
+	if claims.IssuedAt, err = numericDate(claims.Extra["iat"]); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func numericDate(v interface{}) (int64, error) {
+	if v == nil {
+		return 0, nil
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, ErrMalformed
+	}
+	f, err := n.Float64()
+	return int64(f), err
+}
+
+func loadRSAPublicKey(file string) (*rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("jwt: no PEM data found in " + file)
+	}
+	if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+		if key, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+	}
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		if rsaKey, ok := key.(*rsa.PublicKey); ok {
+			return rsaKey, nil
+		}
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("jwt: no RSA public key found in " + file)
+}
+
+func (v *Verifier) loadJWKS(file string) (err error) {
+	var (
+		data []byte
+		jwks struct {
+			Keys []jsonWebKey `json:"keys"`
+		}
+	)
+	if data, err = ioutil.ReadFile(file); err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &jwks); err != nil {
+		return
+	}
+	for _, key := range jwks.Keys {
+		//keys without kid would replace HMACSecret or the key of RSAPublicKeyFile
+		if key.Kid == "" && (key.Kty == "RSA" || key.Kty == "oct") {
+			return errors.New("jwt: " + key.Kty + " key without kid in " + file)
+		}
+		switch key.Kty {
+		case "RSA":
+			n, nErr := base64.RawURLEncoding.DecodeString(key.N)
+			e, eErr := base64.RawURLEncoding.DecodeString(key.E)
+			if nErr != nil || eErr != nil || len(e) == 0 {
+				return errors.New("jwt: invalid RSA key " + key.Kid + " in " + file)
+			}
+			v.rsaKeys[key.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "oct":
+			//an empty or short secret would let anyone forge the tokens of the kid
+			k, kErr := base64.RawURLEncoding.DecodeString(key.K)
+			if kErr != nil || len(k) < MinHMACKeySize {
+				return errors.New("jwt: invalid oct key " + key.Kid + " in " + file)
+			}
+			v.hmacKeys[key.Kid] = k
+		}
+	}
+	return
+}
@@ -0,0 +1,219 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+var (
+	secret = []byte("605f81a5fd7c623a22fb9b2ee33ad49f")
+	exp    = time.Now().Add(time.Hour).Unix()
+)
+
+func segment(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signHS256(t *testing.T, kid string, key []byte, claims map[string]interface{}) string {
+	signed := segment(t, map[string]string{"alg": AlgHS256, "typ": "JWT", "kid": kid}) + "." + segment(t, claims)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signRS256(t *testing.T, kid string, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	signed := segment(t, map[string]string{"alg": AlgRS256, "typ": "JWT", "kid": kid}) + "." + segment(t, claims)
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	require.NoError(t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func tempFile(t *testing.T, data []byte) string {
+	f, err := ioutil.TempFile("", "qsf-jwt")
+	require.NoError(t, err)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	f.Close()
+	return f.Name()
+}
+
+func TestHS256(t *testing.T) {
+	v, err := NewVerifier(Option{HMACSecret: secret, Audience: "example", Issuer: "qsf"})
+	require.NoError(t, err)
+	now := time.Now().Unix()
+
+	claims, err := v.Verify(signHS256(t, "", secret, map[string]interface{}{
+		"sub": "uid", "aud": []string{"gateway", "example"}, "iss": "qsf", "exp": now + 60, "nbf": now - 60, "role": "admin",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "uid", claims.Subject)
+	assert.Equal(t, now+60, claims.ExpiresAt)
+	assert.Equal(t, "admin", claims.StringClaim("role"))
+	assert.Equal(t, []string{"admin"}, claims.StringsClaim("role"))
+	assert.Equal(t, []string{"gateway", "example"}, claims.StringsClaim("aud"))
+	assert.Empty(t, claims.StringsClaim("exp"))
+
+	_, err = v.Verify(signHS256(t, "", []byte("wrong"), map[string]interface{}{"aud": "example", "iss": "qsf", "exp": exp}))
+	assert.Equal(t, ErrInvalidSignature, err)
+	_, err = v.Verify(signHS256(t, "", secret, map[string]interface{}{"aud": "example", "iss": "qsf", "exp": now - 60}))
+	assert.Equal(t, ErrExpired, err)
+	_, err = v.Verify(signHS256(t, "", secret, map[string]interface{}{"aud": "example", "iss": "qsf", "nbf": now + 60, "exp": exp}))
+	assert.Equal(t, ErrNotValidYet, err)
+	_, err = v.Verify(signHS256(t, "", secret, map[string]interface{}{"aud": "other", "iss": "qsf", "exp": exp}))
+	assert.Equal(t, ErrInvalidAudience, err)
+	_, err = v.Verify(signHS256(t, "", secret, map[string]interface{}{"aud": "example", "iss": "other", "exp": exp}))
+	assert.Equal(t, ErrInvalidIssuer, err)
+	_, err = v.Verify("not.a-token")
+	assert.Equal(t, ErrMalformed, err)
+}
+
+func TestLeeway(t *testing.T) {
+	v, err := NewVerifier(Option{HMACSecret: secret, Leeway: time.Minute})
+	require.NoError(t, err)
+	_, err = v.Verify(signHS256(t, "", secret, map[string]interface{}{"exp": time.Now().Unix() - 30}))
+	assert.NoError(t, err)
+}
+
+func TestExpiration(t *testing.T) {
+	v, err := NewVerifier(Option{HMACSecret: secret})
+	require.NoError(t, err)
+	_, err = v.Verify(signHS256(t, "", secret, map[string]interface{}{"sub": "uid"}))
+	assert.Equal(t, ErrNoExpiration, err)
+
+	v, err = NewVerifier(Option{HMACSecret: secret, AllowNoExpiry: true})
+	require.NoError(t, err)
+	_, err = v.Verify(signHS256(t, "", secret, map[string]interface{}{"sub": "uid"}))
+	assert.NoError(t, err)
+}
+
+func TestRS256PublicKeyFile(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	file := tempFile(t, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	defer os.Remove(file)
+
+	v, err := NewVerifier(Option{RSAPublicKeyFile: file})
+	require.NoError(t, err)
+	claims, err := v.Verify(signRS256(t, "", key, map[string]interface{}{"sub": "uid", "exp": exp}))
+	require.NoError(t, err)
+	assert.Equal(t, "uid", claims.Subject)
+
+	// an HS256 token must not be verified with the RSA public key as HMAC secret
+	_, err = v.Verify(signHS256(t, "", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), map[string]interface{}{"sub": "uid", "exp": exp}))
+	assert.Equal(t, ErrInvalidSignature, err)
+}
+
+func TestJWKSFile(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	jwks, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{
+			"kty": "RSA", "kid": "rsa1",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		},
+		{"kty": "oct", "kid": "hmac1", "k": base64.RawURLEncoding.EncodeToString(secret)},
+	}})
+	require.NoError(t, err)
+	file := tempFile(t, jwks)
+	defer os.Remove(file)
+
+	v, err := NewVerifier(Option{JWKSFile: file})
+	require.NoError(t, err)
+	_, err = v.Verify(signRS256(t, "rsa1", key, map[string]interface{}{"sub": "uid", "exp": exp}))
+	assert.NoError(t, err)
+	_, err = v.Verify(signHS256(t, "hmac1", secret, map[string]interface{}{"sub": "uid", "exp": exp}))
+	assert.NoError(t, err)
+	_, err = v.Verify(signRS256(t, "rsa1", other, map[string]interface{}{"sub": "uid", "exp": exp}))
+	assert.Equal(t, ErrInvalidSignature, err)
+	_, err = v.Verify(signRS256(t, "unknown", key, map[string]interface{}{"sub": "uid", "exp": exp}))
+	assert.Equal(t, ErrInvalidSignature, err)
+}
+
+func TestJWKSKeyWithoutKid(t *testing.T) {
+	jwks, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "oct", "k": base64.RawURLEncoding.EncodeToString([]byte("other"))},
+	}})
+	require.NoError(t, err)
+	file := tempFile(t, jwks)
+	defer os.Remove(file)
+
+	// the key must not replace the HMAC secret
+	_, err = NewVerifier(Option{HMACSecret: secret, JWKSFile: file})
+	assert.Error(t, err)
+}
+
+func TestJWKSWeakOctKey(t *testing.T) {
+	for _, k := range []string{"", base64.RawURLEncoding.EncodeToString(secret[:MinHMACKeySize-1])} {
+		keys := []map[string]string{{"kty": "oct", "kid": "hmac1", "k": k}}
+		if k == "" {
+			delete(keys[0], "k")
+		}
+		jwks, err := json.Marshal(map[string]interface{}{"keys": keys})
+		require.NoError(t, err)
+		file := tempFile(t, jwks)
+		defer os.Remove(file)
+
+		_, err = NewVerifier(Option{JWKSFile: file})
+		assert.Error(t, err)
+	}
+
+	// one empty key fails the whole file, so a token signed with an empty secret cannot verify
+	jwks, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "oct", "kid": "hmac1", "k": base64.RawURLEncoding.EncodeToString(secret)},
+		{"kty": "oct", "kid": "empty", "k": ""},
+	}})
+	require.NoError(t, err)
+	file := tempFile(t, jwks)
+	defer os.Remove(file)
+	v, err := NewVerifier(Option{JWKSFile: file})
+	if err == nil {
+		_, err = v.Verify(signHS256(t, "empty", nil, map[string]interface{}{"sub": "uid", "exp": exp}))
+	}
+	assert.Error(t, err)
+}
+
+func TestNewVerifierWithoutKey(t *testing.T) {
+	_, err := NewVerifier(Option{})
+	assert.Equal(t, ErrNoKey, err)
+}
+
+func TestContext(t *testing.T) {
+	_, ok := FromContext(context.Background())
+	assert.False(t, ok)
+	claims, ok := FromContext(NewContext(context.Background(), &Claims{Subject: "uid"}))
+	require.True(t, ok)
+	assert.Equal(t, "uid", claims.Subject)
+}
+
+func TestTokenFromHTTPRequest(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/v1/examples", nil)
+	r.Header.Set("Authorization", "Bearer abc.def.ghi")
+	assert.Equal(t, "abc.def.ghi", TokenFromHTTPRequest(r))
+	r.Header.Set("Authorization", "Basic 123456")
+	assert.Equal(t, "", TokenFromHTTPRequest(r))
+}
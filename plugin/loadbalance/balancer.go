@@ -0,0 +1,291 @@
+// Package loadbalance provides the grpc balancers used by qsf clients.
+//
+// The balancers are registered with balancer.Register under the names below, so any connection can
+// select them with grpc.WithBalancerName. They pick one of the ready nodes resolved for the target,
+// either randomly, round-robin or with smooth weighted round-robin. The weight of a node is read from
+// the "weight" key of its NodeData metadata, and a changed weight takes effect without reconnecting.
+//
+// Every balancer prefers the nodes in the zone of the client, see Locality.
+package loadbalance
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/resolver"
+)
+
+const (
+	RoundRobin         = "qsf_round_robin"
+	Random             = "qsf_random"
+	WeightedRoundRobin = "qsf_weighted_round_robin"
+	//节点元数据中的权重字段
+	WeightKey = "weight"
+	//未设置权重时的默认权重
+	DefaultWeight = 1
+	//权重上限，更大的权重按上限计，以限制一致性哈希环的大小
+	MaxWeight = 100
+)
+
+var (
+	ErrUnknownPolicy = errors.New("loadbalance: unknown load balance policy")
+)
+
+func init() {
+	balancer.Register(NewBalancerBuilder(RoundRobin, PickerBuilderFunc(newRoundRobinPicker)))
+	balancer.Register(NewBalancerBuilder(Random, PickerBuilderFunc(newRandomPicker)))
+	balancer.Register(NewBalancerBuilder(WeightedRoundRobin, PickerBuilderFunc(newWeightedRoundRobinPicker)))
+}
+
+// Node is a ready node, Address carries the latest metadata resolved for it.
+type Node struct {
+	SubConn balancer.SubConn
+	Address resolver.Address
+	stats   *endpointStats
+}
+
+// PickerBuilder builds the picker of the ready nodes. It is called whenever a node becomes ready or
+// not ready, and whenever the resolved metadata changes. nodes is never empty.
+type PickerBuilder interface {
+	Build(nodes []Node) balancer.Picker
+}
+
+type PickerBuilderFunc func(nodes []Node) balancer.Picker
+
+func (f PickerBuilderFunc) Build(nodes []Node) balancer.Picker {
+	return f(nodes)
+}
+
+// NewBalancerBuilder returns a balancer.Builder named name whose balancers connect to every resolved
+// address and pick with pb. Unlike base.NewBalancerBuilder, nodes are identified by address only, so
+// metadata updates keep the connection.
+func NewBalancerBuilder(name string, pb PickerBuilder) balancer.Builder {
+	return &balancerBuilder{name: name, pickerBuilder: pb}
+}
+
+type balancerBuilder struct {
+	name          string
+	pickerBuilder PickerBuilder
+	locality      *Locality //nil为DefaultLocality
+}
+
+func (bb *balancerBuilder) Build(cc balancer.ClientConn, opt balancer.BuildOptions) balancer.Balancer {
+	l := DefaultLocality()
+	if bb.locality != nil {
+		l = *bb.locality
+	}
+	return &qsfBalancer{
+		cc:            cc,
+		pickerBuilder: bb.pickerBuilder,
+		locality:      l,
+		subConns:      make(map[string]*subConn),
+		scStates:      make(map[balancer.SubConn]connectivity.State),
+		csEvltr:       new(balancer.ConnectivityStateEvaluator),
+		state:         connectivity.Idle,
+	}
+}
+
+func (bb *balancerBuilder) Name() string {
+	return bb.name
+}
+
+type subConn struct {
+	sc    balancer.SubConn
+	addr  resolver.Address
+	stats *endpointStats //latency and in-flight calls for the p2c balancers
+}
+
+// qsfBalancer follows the grpc base balancer. It is only called from the grpc balancer goroutine.
+type qsfBalancer struct {
+	cc            balancer.ClientConn
+	pickerBuilder PickerBuilder
+	locality      Locality
+	subConns      map[string]*subConn
+	scStates      map[balancer.SubConn]connectivity.State
+	csEvltr       *balancer.ConnectivityStateEvaluator
+	state         connectivity.State
+	picker        balancer.Picker
+}
+
+func (b *qsfBalancer) HandleResolvedAddrs(addrs []resolver.Address, err error) {
+	if err != nil {
+		grpclog.Infof("loadbalance: HandleResolvedAddrs called with error %v", err)
+		return
+	}
+	resolved := make(map[string]bool, len(addrs))
+	for _, a := range addrs {
+		resolved[a.Addr] = true
+		if s, ok := b.subConns[a.Addr]; ok {
+			s.addr = a
+			continue
+		}
+		sc, err := b.cc.NewSubConn([]resolver.Address{{Addr: a.Addr, Type: a.Type, ServerName: a.ServerName}}, balancer.NewSubConnOptions{})
+		if err != nil {
+			grpclog.Warningf("loadbalance: failed to create new SubConn: %v", err)
+			continue
+		}
+		b.subConns[a.Addr] = &subConn{sc: sc, addr: a, stats: new(endpointStats)}
+		b.scStates[sc] = connectivity.Idle
+		sc.Connect()
+	}
+	for addr, s := range b.subConns {
+		if !resolved[addr] {
+			// the state is kept in scStates until the SubConn is shut down, the stats go with the node
+			b.cc.RemoveSubConn(s.sc)
+			delete(b.subConns, addr)
+		}
+	}
+	// the metadata of the ready nodes may have changed
+	b.regeneratePicker()
+	b.cc.UpdateBalancerState(b.state, b.picker)
+}
+
+func (b *qsfBalancer) HandleSubConnStateChange(sc balancer.SubConn, s connectivity.State) {
+	oldS, ok := b.scStates[sc]
+	if !ok {
+		return
+	}
+	b.scStates[sc] = s
+	switch s {
+	case connectivity.Idle:
+		sc.Connect()
+	case connectivity.Shutdown:
+		delete(b.scStates, sc)
+	}
+	oldAggrState := b.state
+	b.state = b.csEvltr.RecordTransition(oldS, s)
+	if (s == connectivity.Ready) != (oldS == connectivity.Ready) ||
+		(b.state == connectivity.TransientFailure) != (oldAggrState == connectivity.TransientFailure) {
+		b.regeneratePicker()
+	}
+	b.cc.UpdateBalancerState(b.state, b.picker)
+}
+
+func (b *qsfBalancer) Close() {}
+
+func (b *qsfBalancer) regeneratePicker() {
+	var (
+		nodes []Node
+		all   []resolver.Address
+		l     = b.locality
+	)
+	if b.state == connectivity.TransientFailure {
+		b.picker = base.NewErrPicker(balancer.ErrTransientFailure)
+		return
+	}
+	for _, s := range b.subConns {
+		all = append(all, s.addr)
+		if b.scStates[s.sc] == connectivity.Ready {
+			nodes = append(nodes, Node{SubConn: s.sc, Address: s.addr, stats: s.stats})
+		}
+	}
+	nodes = localNodes(l, nodes, all)
+	if len(nodes) == 0 {
+		b.picker = base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+		return
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Address.Addr < nodes[j].Address.Addr
+	})
+	b.picker = newZonePicker(b.pickerBuilder.Build(nodes), nodes, l.Zone)
+}
+
+// Metadata returns the custom metadata of a resolved address.
+func Metadata(addr resolver.Address) map[string]string {
+	if nodeData, ok := addr.Metadata.(*registry.NodeData); ok && nodeData != nil {
+		return nodeData.Metadata
+	}
+	return nil
+}
+
+// Weight returns the weight of a resolved address, DefaultWeight when it is missing or invalid and at
+// most MaxWeight, so that a node cannot blow up the ring of the consistent-hash balancer.
+func Weight(addr resolver.Address) int {
+	weight, err := strconv.Atoi(Metadata(addr)[WeightKey])
+	if err != nil || weight <= 0 {
+		return DefaultWeight
+	}
+	if weight > MaxWeight {
+		return MaxWeight
+	}
+	return weight
+}
+
+type roundRobinPicker struct {
+	nodes []Node
+	mu    sync.Mutex
+	next  int
+}
+
+func newRoundRobinPicker(nodes []Node) balancer.Picker {
+	// start at a random node so that clients do not all hit the first one
+	return &roundRobinPicker{nodes: nodes, next: rand.Intn(len(nodes))}
+}
+
+func (p *roundRobinPicker) Pick(ctx context.Context, opts balancer.PickOptions) (balancer.SubConn, func(balancer.DoneInfo), error) {
+	p.mu.Lock()
+	sc := p.nodes[p.next].SubConn
+	p.next = (p.next + 1) % len(p.nodes)
+	p.mu.Unlock()
+	return sc, nil, nil
+}
+
+type randomPicker struct {
+	nodes []Node
+}
+
+func newRandomPicker(nodes []Node) balancer.Picker {
+	return &randomPicker{nodes: nodes}
+}
+
+func (p *randomPicker) Pick(ctx context.Context, opts balancer.PickOptions) (balancer.SubConn, func(balancer.DoneInfo), error) {
+	return p.nodes[rand.Intn(len(p.nodes))].SubConn, nil, nil
+}
+
+// weightedRoundRobinPicker is the smooth weighted round-robin of nginx: nodes are picked in proportion
+// to their weights, interleaved rather than in bursts.
+type weightedRoundRobinPicker struct {
+	nodes          []Node
+	weights        []int
+	currentWeights []int
+	mu             sync.Mutex
+}
+
+func newWeightedRoundRobinPicker(nodes []Node) balancer.Picker {
+	p := &weightedRoundRobinPicker{
+		nodes:          nodes,
+		weights:        make([]int, len(nodes)),
+		currentWeights: make([]int, len(nodes)),
+	}
+	for i, node := range nodes {
+		p.weights[i] = Weight(node.Address)
+	}
+	return p
+}
+
+func (p *weightedRoundRobinPicker) Pick(ctx context.Context, opts balancer.PickOptions) (balancer.SubConn, func(balancer.DoneInfo), error) {
+	var (
+		best  = -1
+		total int
+	)
+	p.mu.Lock()
+	for i, weight := range p.weights {
+		p.currentWeights[i] += weight
+		total += weight
+		if best < 0 || p.currentWeights[i] > p.currentWeights[best] {
+			best = i
+		}
+	}
+	p.currentWeights[best] -= total
+	p.mu.Unlock()
+	return p.nodes[best].SubConn, nil, nil
+}
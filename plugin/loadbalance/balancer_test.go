@@ -0,0 +1,132 @@
+package loadbalance
+
+import (
+	"testing"
+
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+)
+
+type fakeSubConn struct {
+	addr string
+}
+
+func (sc *fakeSubConn) UpdateAddresses([]resolver.Address) {}
+func (sc *fakeSubConn) Connect()                           {}
+
+// fakeClientConn records the SubConns and the latest picker of a balancer.
+type fakeClientConn struct {
+	balancer.ClientConn
+	subConns map[string]*fakeSubConn
+	removed  []string
+	state    connectivity.State
+	picker   balancer.Picker
+}
+
+func newFakeClientConn() *fakeClientConn {
+	return &fakeClientConn{subConns: make(map[string]*fakeSubConn)}
+}
+
+func (cc *fakeClientConn) NewSubConn(addrs []resolver.Address, opts balancer.NewSubConnOptions) (balancer.SubConn, error) {
+	sc := &fakeSubConn{addr: addrs[0].Addr}
+	cc.subConns[sc.addr] = sc
+	return sc, nil
+}
+
+func (cc *fakeClientConn) RemoveSubConn(sc balancer.SubConn) {
+	cc.removed = append(cc.removed, sc.(*fakeSubConn).addr)
+}
+
+func (cc *fakeClientConn) UpdateBalancerState(s connectivity.State, p balancer.Picker) {
+	cc.state = s
+	cc.picker = p
+}
+
+func weighted(addr string, weight string) resolver.Address {
+	return resolver.Address{Addr: addr, Metadata: &registry.NodeData{Addr: addr, Metadata: map[string]string{WeightKey: weight}}}
+}
+
+// startBalancer builds the balancer named name, resolves addrs and makes every node ready.
+func startBalancer(t *testing.T, name string, addrs ...resolver.Address) (balancer.Balancer, *fakeClientConn) {
+	builder := balancer.Get(name)
+	require.NotNil(t, builder)
+	cc := newFakeClientConn()
+	b := builder.Build(cc, balancer.BuildOptions{})
+	b.HandleResolvedAddrs(addrs, nil)
+	for _, a := range addrs {
+		b.HandleSubConnStateChange(cc.subConns[a.Addr], connectivity.Ready)
+	}
+	return b, cc
+}
+
+func pickN(t *testing.T, cc *fakeClientConn, n int) (picks []string) {
+	for i := 0; i < n; i++ {
+		sc, _, err := cc.picker.Pick(context.Background(), balancer.PickOptions{})
+		require.NoError(t, err)
+		picks = append(picks, sc.(*fakeSubConn).addr)
+	}
+	return
+}
+
+func count(picks []string) map[string]int {
+	counts := make(map[string]int)
+	for _, p := range picks {
+		counts[p]++
+	}
+	return counts
+}
+
+func TestRoundRobin(t *testing.T) {
+	_, cc := startBalancer(t, RoundRobin, weighted("a:1", "5"), weighted("b:1", "1"))
+	assert.Equal(t, connectivity.Ready, cc.state)
+	assert.Equal(t, map[string]int{"a:1": 5, "b:1": 5}, count(pickN(t, cc, 10)))
+}
+
+func TestRandom(t *testing.T) {
+	_, cc := startBalancer(t, Random, weighted("a:1", ""), weighted("b:1", ""))
+	counts := count(pickN(t, cc, 1000))
+	assert.InDelta(t, 500, counts["a:1"], 150)
+	assert.InDelta(t, 500, counts["b:1"], 150)
+}
+
+func TestSmoothWeightedRoundRobin(t *testing.T) {
+	b, cc := startBalancer(t, WeightedRoundRobin, weighted("a:1", "5"), weighted("b:1", "1"), weighted("c:1", "1"))
+	assert.Equal(t, []string{"a:1", "a:1", "b:1", "a:1", "c:1", "a:1", "a:1"}, pickN(t, cc, 7))
+
+	// a weight change in the registry applies without reconnecting
+	subConns := cc.subConns
+	b.HandleResolvedAddrs([]resolver.Address{weighted("a:1", "1"), weighted("b:1", "1"), weighted("c:1", "1")}, nil)
+	assert.Equal(t, subConns, cc.subConns)
+	assert.Empty(t, cc.removed)
+	assert.Equal(t, map[string]int{"a:1": 10, "b:1": 10, "c:1": 10}, count(pickN(t, cc, 30)))
+}
+
+func TestNodeUpdates(t *testing.T) {
+	b, cc := startBalancer(t, RoundRobin, weighted("a:1", ""), weighted("b:1", ""))
+
+	b.HandleSubConnStateChange(cc.subConns["a:1"], connectivity.TransientFailure)
+	assert.Equal(t, connectivity.Ready, cc.state)
+	assert.Equal(t, map[string]int{"b:1": 4}, count(pickN(t, cc, 4)))
+
+	b.HandleResolvedAddrs([]resolver.Address{weighted("a:1", "")}, nil)
+	assert.Equal(t, []string{"b:1"}, cc.removed)
+	_, _, err := cc.picker.Pick(context.Background(), balancer.PickOptions{})
+	assert.Equal(t, balancer.ErrNoSubConnAvailable, err)
+
+	b.HandleSubConnStateChange(cc.subConns["b:1"], connectivity.Shutdown)
+	b.HandleSubConnStateChange(cc.subConns["a:1"], connectivity.Ready)
+	assert.Equal(t, map[string]int{"a:1": 2}, count(pickN(t, cc, 2)))
+}
+
+func TestWeight(t *testing.T) {
+	assert.Equal(t, 3, Weight(weighted("a:1", "3")))
+	assert.Equal(t, MaxWeight, Weight(weighted("a:1", "1000000000")))
+	assert.Equal(t, DefaultWeight, Weight(weighted("a:1", "-1")))
+	assert.Equal(t, DefaultWeight, Weight(weighted("a:1", "x")))
+	assert.Equal(t, DefaultWeight, Weight(resolver.Address{Addr: "a:1"}))
+}
@@ -0,0 +1,116 @@
+package loadbalance
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	ConsistentHash = "qsf_consistent_hash"
+	//一致性哈希键的metadata字段
+	HashKeyMetadata = "qsf-hash-key"
+	//每单位权重的虚拟节点数
+	DefaultVirtualNodes = 160
+)
+
+func init() {
+	balancer.Register(NewConsistentHashBuilder(ConsistentHash, HashKeyMetadata, DefaultVirtualNodes))
+}
+
+type hashKey struct{}
+
+// WithHashKey returns a context whose calls are routed by key on a consistent-hash balancer. It takes
+// precedence over the hash key metadata.
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKey{}, key)
+}
+
+// NewConsistentHashBuilder returns a consistent-hash balancer named name. Calls are routed by the key
+// set with WithHashKey, or else by the outgoing metadata metadataKey, and calls without a key go to a
+// random node. Every node is placed on the ring virtualNodes times its weight, so adding or removing a
+// node only moves the keys of that node.
+func NewConsistentHashBuilder(name, metadataKey string, virtualNodes int) balancer.Builder {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	return NewBalancerBuilder(name, PickerBuilderFunc(func(nodes []Node) balancer.Picker {
+		return newConsistentHashPicker(nodes, metadataKey, virtualNodes)
+	}))
+}
+
+type ringEntry struct {
+	hash uint64
+	node int
+}
+
+type consistentHashPicker struct {
+	nodes       []Node
+	ring        []ringEntry
+	metadataKey string
+}
+
+func newConsistentHashPicker(nodes []Node, metadataKey string, virtualNodes int) *consistentHashPicker {
+	p := &consistentHashPicker{nodes: nodes, metadataKey: metadataKey}
+	for i, node := range nodes {
+		replicas := virtualNodes * Weight(node.Address)
+		for r := 0; r < replicas; r++ {
+			p.ring = append(p.ring, ringEntry{hash: hashOf(node.Address.Addr + "#" + strconv.Itoa(r)), node: i})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool {
+		return p.ring[i].hash < p.ring[j].hash
+	})
+	return p
+}
+
+func (p *consistentHashPicker) Pick(ctx context.Context, opts balancer.PickOptions) (balancer.SubConn, func(balancer.DoneInfo), error) {
+	key, ok := p.key(ctx)
+	if !ok {
+		return p.nodes[rand.Intn(len(p.nodes))].SubConn, nil, nil
+	}
+	return p.nodes[p.lookup(key)].SubConn, nil, nil
+}
+
+// lookup returns the index of the node owning key: the first ring entry at or after the hash of key.
+func (p *consistentHashPicker) lookup(key string) int {
+	hash := hashOf(key)
+	i := sort.Search(len(p.ring), func(i int) bool {
+		return p.ring[i].hash >= hash
+	})
+	if i == len(p.ring) {
+		i = 0
+	}
+	return p.ring[i].node
+}
+
+func (p *consistentHashPicker) key(ctx context.Context) (string, bool) {
+	if key, ok := ctx.Value(hashKey{}).(string); ok {
+		return key, true
+	}
+	if md, ok := metadata.FromOutgoingContext(ctx); ok {
+		if values := md.Get(p.metadataKey); len(values) > 0 {
+			return values[0], true
+		}
+	}
+	return "", false
+}
+
+// hashOf is 64-bit FNV-1a followed by the murmur3 finalizer, which spreads similar keys such as the
+// virtual nodes of one address over the whole ring.
+func hashOf(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,102 @@
+package loadbalance
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+)
+
+func route(t *testing.T, cc *fakeClientConn, keys int) map[string]string {
+	routes := make(map[string]string, keys)
+	for i := 0; i < keys; i++ {
+		key := "user-" + strconv.Itoa(i)
+		sc, _, err := cc.picker.Pick(WithHashKey(context.Background(), key), balancer.PickOptions{})
+		require.NoError(t, err)
+		routes[key] = sc.(*fakeSubConn).addr
+	}
+	return routes
+}
+
+func TestConsistentHashKey(t *testing.T) {
+	_, cc := startBalancer(t, ConsistentHash, weighted("a:1", ""), weighted("b:1", ""), weighted("c:1", ""))
+	ctx := metadata.AppendToOutgoingContext(context.Background(), HashKeyMetadata, "user-1")
+	first, _, err := cc.picker.Pick(ctx, balancer.PickOptions{})
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		sc, _, err := cc.picker.Pick(ctx, balancer.PickOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, first, sc)
+	}
+	// the per-call key takes precedence over the metadata
+	viaOption, _, err := cc.picker.Pick(WithHashKey(context.Background(), "user-1"), balancer.PickOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, first, viaOption)
+
+	// calls without a key are spread over the nodes
+	picks := count(pickN(t, cc, 300))
+	assert.Len(t, picks, 3)
+}
+
+func TestConsistentHashBalance(t *testing.T) {
+	_, cc := startBalancer(t, ConsistentHash, weighted("a:1", ""), weighted("b:1", ""), weighted("c:1", "2"))
+	counts := make(map[string]int)
+	for _, addr := range route(t, cc, 10000) {
+		counts[addr]++
+	}
+	assert.InDelta(t, 2500, counts["a:1"], 500)
+	assert.InDelta(t, 2500, counts["b:1"], 500)
+	assert.InDelta(t, 5000, counts["c:1"], 500)
+}
+
+func TestConsistentHashMaxWeight(t *testing.T) {
+	p := newConsistentHashPicker([]Node{{Address: weighted("a:1", "1000000000")}, {Address: weighted("b:1", "")}}, HashKeyMetadata, DefaultVirtualNodes)
+	assert.Len(t, p.ring, (MaxWeight+DefaultWeight)*DefaultVirtualNodes)
+}
+
+func TestConsistentHashMinimalMovement(t *testing.T) {
+	addrs := []resolver.Address{weighted("a:1", ""), weighted("b:1", ""), weighted("c:1", ""), weighted("d:1", "")}
+	b, cc := startBalancer(t, ConsistentHash, addrs...)
+	before := route(t, cc, 10000)
+
+	// a new node only takes keys from the others
+	b.HandleResolvedAddrs(append(addrs, weighted("e:1", "")), nil)
+	b.HandleSubConnStateChange(cc.subConns["e:1"], connectivity.Ready)
+	added := route(t, cc, 10000)
+	moved := 0
+	for key, addr := range added {
+		if addr != before[key] {
+			moved++
+			assert.Equal(t, "e:1", addr)
+		}
+	}
+	assert.InDelta(t, 2000, moved, 500)
+
+	// a removed node only gives its keys to the others
+	b.HandleResolvedAddrs(addrs[1:], nil)
+	removed := route(t, cc, 10000)
+	for key, addr := range removed {
+		if before[key] != "a:1" {
+			assert.Equal(t, before[key], addr)
+		} else {
+			assert.NotEqual(t, "a:1", addr)
+		}
+	}
+}
+
+func TestCustomConsistentHashBuilder(t *testing.T) {
+	balancer.Register(NewConsistentHashBuilder("test_user_hash", "qsf-userid", 0))
+	_, cc := startBalancer(t, "test_user_hash", weighted("a:1", ""), weighted("b:1", ""))
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "QSF-UserId", "42")
+	p := cc.picker.(*zonePicker).picker.(*consistentHashPicker)
+	key, ok := p.key(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "42", key)
+	assert.Len(t, p.ring, 2*DefaultVirtualNodes)
+}
@@ -0,0 +1,160 @@
+package loadbalance
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+)
+
+const (
+	LeastRequest = "qsf_least_request"
+	PeakEWMA     = "qsf_peak_ewma"
+	//延迟EWMA的衰减时间常数
+	DefaultDecay = 10 * time.Second
+	//节点没有延迟样本时的初始延迟
+	DefaultRTT = 100 * time.Millisecond
+)
+
+func init() {
+	balancer.Register(NewLeastRequestBuilder(LeastRequest))
+	balancer.Register(NewPeakEWMABuilder(PeakEWMA, DefaultDecay, DefaultRTT))
+}
+
+// NewLeastRequestBuilder returns a balancer named name that picks the node with fewer in-flight calls
+// out of two random nodes (power of two choices).
+func NewLeastRequestBuilder(name string) balancer.Builder {
+	return NewBalancerBuilder(name, PickerBuilderFunc(func(nodes []Node) balancer.Picker {
+		return newP2CPicker(nodes, 0, func(s *endpointStats) float64 {
+			return float64(atomic.LoadInt64(&s.inflight))
+		})
+	}))
+}
+
+// NewPeakEWMABuilder returns a balancer named name that picks out of two random nodes the one with the
+// lower cost, the peak EWMA of its latency times its in-flight calls plus one. The EWMA jumps to slower
+// samples at once and decays towards faster ones with the time constant decay, so a node that turns
+// slow loses its traffic immediately. Nodes without samples start at initialRTT.
+//
+// Latency is observed by UnaryClientInterceptor, streams only count as in-flight calls.
+func NewPeakEWMABuilder(name string, decay, initialRTT time.Duration) balancer.Builder {
+	return NewBalancerBuilder(name, PickerBuilderFunc(func(nodes []Node) balancer.Picker {
+		return newP2CPicker(nodes, decay, func(s *endpointStats) float64 {
+			return s.latency(initialRTT) * float64(atomic.LoadInt64(&s.inflight)+1)
+		})
+	}))
+}
+
+// endpointStats are kept per node by its balancer, so they survive picker rebuilds and are dropped
+// when the node is removed.
+type endpointStats struct {
+	inflight int64
+	mu       sync.Mutex
+	ewma     float64 //nanoseconds, 0 until the first sample
+	stamp    time.Time
+}
+
+// observe adds a latency sample.
+func (s *endpointStats) observe(rtt time.Duration, now time.Time, decay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sample := float64(rtt)
+	if s.ewma == 0 || sample > s.ewma {
+		s.ewma = sample
+	} else {
+		w := math.Exp(-float64(now.Sub(s.stamp)) / float64(decay))
+		s.ewma = s.ewma*w + sample*(1-w)
+	}
+	s.stamp = now
+}
+
+func (s *endpointStats) latency(initialRTT time.Duration) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ewma == 0 {
+		return float64(initialRTT)
+	}
+	return s.ewma
+}
+
+type p2cPicker struct {
+	nodes []Node
+	stats []*endpointStats
+	decay time.Duration //0 when latency is not observed
+	cost  func(s *endpointStats) float64
+	mu    sync.Mutex
+	rand  *rand.Rand
+}
+
+func newP2CPicker(nodes []Node, decay time.Duration, cost func(s *endpointStats) float64) *p2cPicker {
+	p := &p2cPicker{
+		nodes: nodes,
+		stats: make([]*endpointStats, len(nodes)),
+		decay: decay,
+		cost:  cost,
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for i, node := range nodes {
+		p.stats[i] = node.stats
+		if p.stats[i] == nil {
+			p.stats[i] = new(endpointStats)
+		}
+	}
+	return p
+}
+
+func (p *p2cPicker) Pick(ctx context.Context, opts balancer.PickOptions) (balancer.SubConn, func(balancer.DoneInfo), error) {
+	var (
+		chosen = 0
+	)
+	if len(p.nodes) > 1 {
+		p.mu.Lock()
+		a := p.rand.Intn(len(p.nodes))
+		b := p.rand.Intn(len(p.nodes) - 1)
+		p.mu.Unlock()
+		if b >= a {
+			b++
+		}
+		chosen = a
+		if p.cost(p.stats[b]) < p.cost(p.stats[a]) {
+			chosen = b
+		}
+	}
+	s := p.stats[chosen]
+	atomic.AddInt64(&s.inflight, 1)
+	if probe, ok := ctx.Value(probeKey{}).(*probe); ok && p.decay > 0 {
+		probe.stats = s
+		probe.decay = p.decay
+	}
+	return p.nodes[chosen].SubConn, func(balancer.DoneInfo) {
+		atomic.AddInt64(&s.inflight, -1)
+	}, nil
+}
+
+type probeKey struct{}
+
+// probe lets UnaryClientInterceptor learn the endpoint picked for its call.
+type probe struct {
+	stats *endpointStats
+	decay time.Duration
+}
+
+// UnaryClientInterceptor observes the latency of unary calls for the peak EWMA balancers. The qsf client
+// installs it under the "loadbalance" interceptor name.
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		p := new(probe)
+		start := time.Now()
+		err := invoker(context.WithValue(ctx, probeKey{}, p), method, req, reply, cc, opts...)
+		if p.stats != nil {
+			now := time.Now()
+			p.stats.observe(now.Sub(start), now, p.decay)
+		}
+		return err
+	}
+}
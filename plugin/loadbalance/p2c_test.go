@@ -0,0 +1,103 @@
+package loadbalance
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/resolver"
+)
+
+func statsOf(b balancer.Balancer, addr string) *endpointStats {
+	return b.(*qsfBalancer).subConns[addr].stats
+}
+
+func TestLeastRequest(t *testing.T) {
+	b, cc := startBalancer(t, LeastRequest, weighted("lr-a:1", ""), weighted("lr-b:1", ""))
+	var dones []func(balancer.DoneInfo)
+	// with two nodes both are always compared, so unfinished calls alternate
+	for i := 0; i < 10; i++ {
+		_, done, err := cc.picker.Pick(context.Background(), balancer.PickOptions{})
+		require.NoError(t, err)
+		dones = append(dones, done)
+	}
+	assert.EqualValues(t, 5, statsOf(b, "lr-a:1").inflight)
+	assert.EqualValues(t, 5, statsOf(b, "lr-b:1").inflight)
+	for _, done := range dones {
+		done(balancer.DoneInfo{})
+	}
+	assert.EqualValues(t, 0, statsOf(b, "lr-a:1").inflight)
+
+	statsOf(b, "lr-a:1").inflight = 5
+	assert.Equal(t, map[string]int{"lr-b:1": 3}, count(pickN(t, cc, 3)))
+}
+
+func TestPeakEWMA(t *testing.T) {
+	b, cc := startBalancer(t, PeakEWMA, weighted("ewma-fast:1", ""), weighted("ewma-slow:1", ""))
+	now := time.Now()
+	statsOf(b, "ewma-fast:1").observe(5*time.Millisecond, now, DefaultDecay)
+	statsOf(b, "ewma-slow:1").observe(500*time.Millisecond, now, DefaultDecay)
+	counts := count(pickN(t, cc, 50))
+	assert.Equal(t, 50, counts["ewma-fast:1"])
+
+	// in-flight calls raise the cost of the fast node until the slow one is picked too
+	for i := 0; i < 200; i++ {
+		cc.picker.Pick(context.Background(), balancer.PickOptions{})
+	}
+	assert.True(t, statsOf(b, "ewma-slow:1").inflight > 0)
+}
+
+func TestEWMAObserve(t *testing.T) {
+	s := new(endpointStats)
+	assert.Equal(t, float64(DefaultRTT), s.latency(DefaultRTT))
+	now := time.Now()
+	s.observe(10*time.Millisecond, now, time.Second)
+	assert.Equal(t, float64(10*time.Millisecond), s.latency(DefaultRTT))
+	// a slower sample is taken at once
+	s.observe(100*time.Millisecond, now, time.Second)
+	assert.Equal(t, float64(100*time.Millisecond), s.latency(DefaultRTT))
+	// faster samples decay towards the new latency with the time constant
+	s.observe(10*time.Millisecond, now.Add(time.Second), time.Second)
+	assert.InDelta(t, float64(10*time.Millisecond)+float64(90*time.Millisecond)/2.718281828, s.latency(DefaultRTT), float64(time.Millisecond))
+	s.observe(10*time.Millisecond, now.Add(time.Minute), time.Second)
+	assert.InDelta(t, float64(10*time.Millisecond), s.latency(DefaultRTT), float64(time.Millisecond))
+}
+
+func TestUnaryClientInterceptor(t *testing.T) {
+	b, cc := startBalancer(t, PeakEWMA, weighted("probe-a:1", ""))
+	invoker := func(ctx context.Context, method string, req, reply interface{}, conn *grpc.ClientConn, opts ...grpc.CallOption) error {
+		_, done, err := cc.picker.Pick(ctx, balancer.PickOptions{})
+		time.Sleep(20 * time.Millisecond)
+		done(balancer.DoneInfo{})
+		return err
+	}
+	require.NoError(t, UnaryClientInterceptor()(context.Background(), "/example.Example/Get", nil, nil, nil, invoker))
+	assert.True(t, statsOf(b, "probe-a:1").latency(DefaultRTT) >= float64(20*time.Millisecond))
+	assert.True(t, statsOf(b, "probe-a:1").latency(DefaultRTT) < float64(DefaultRTT))
+
+	// least request balancers do not observe latency
+	b, cc = startBalancer(t, LeastRequest, weighted("probe-b:1", ""))
+	require.NoError(t, UnaryClientInterceptor()(context.Background(), "/example.Example/Get", nil, nil, nil, invoker))
+	assert.Equal(t, float64(0), statsOf(b, "probe-b:1").ewma)
+}
+
+func TestStatsPerBalancer(t *testing.T) {
+	b1, cc1 := startBalancer(t, LeastRequest, weighted("a:1", ""), weighted("b:1", ""))
+	b2, _ := startBalancer(t, LeastRequest, weighted("a:1", ""))
+	_, done, err := cc1.picker.Pick(context.Background(), balancer.PickOptions{})
+	require.NoError(t, err)
+	defer done(balancer.DoneInfo{})
+	assert.EqualValues(t, 1, statsOf(b1, "a:1").inflight+statsOf(b1, "b:1").inflight)
+	assert.EqualValues(t, 0, statsOf(b2, "a:1").inflight)
+
+	// a removed node drops its stats
+	stats := statsOf(b1, "a:1")
+	b1.HandleResolvedAddrs([]resolver.Address{weighted("b:1", "")}, nil)
+	assert.NotContains(t, b1.(*qsfBalancer).subConns, "a:1")
+	b1.HandleResolvedAddrs([]resolver.Address{weighted("a:1", ""), weighted("b:1", "")}, nil)
+	assert.False(t, stats == statsOf(b1, "a:1"))
+}
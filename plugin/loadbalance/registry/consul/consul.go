@@ -0,0 +1,377 @@
+// Package consul is the registry backend on the HTTP API of a Consul agent. A node is registered as one
+// consul service per name with a TTL check, its version, region, zone and metadata are kept in the
+// service meta, and clients follow the passing instances with blocking queries.
+package consul
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/grpclog"
+)
+
+const (
+	// Kind is the name of the consul backend.
+	Kind = "consul"
+	//TTL检查的有效期
+	DefaultTTL = 10 * time.Second
+	//检查失败后consul删除服务的时间
+	DefaultDeregisterAfter = time.Minute
+	//阻塞查询的最长等待时间
+	DefaultWait = 5 * time.Minute
+
+	metaVersion  = "qsf-version"
+	metaRegion   = "qsf-region"
+	metaZone     = "qsf-zone"
+	metaPrefix   = "qsf-md-"
+	retryBackoff = time.Second
+)
+
+func init() {
+	registry.RegisterBackend(Kind, backend{})
+}
+
+type backend struct{}
+
+func (backend) NewRegistry(addrs []string) (registry.Registry, error) {
+	c, err := newClient(addrs)
+	if err != nil {
+		return nil, err
+	}
+	return NewRegistry(c, DefaultTTL), nil
+}
+
+func (backend) NewDiscovery(addrs []string) (registry.Discovery, error) {
+	c, err := newClient(addrs)
+	if err != nil {
+		return nil, err
+	}
+	return NewDiscovery(c), nil
+}
+
+// Client calls the HTTP API of the consul agents in addrs, trying them in order.
+type Client struct {
+	addrs []string
+	http  *http.Client
+}
+
+// NewClient returns a client of the agents, an address without a scheme is taken as http.
+func NewClient(addrs []string) (*Client, error) {
+	return newClient(addrs)
+}
+
+func newClient(addrs []string) (*Client, error) {
+	if len(addrs) == 0 {
+		return nil, registry.ErrNoAddrs
+	}
+	c := &Client{http: new(http.Client)}
+	for _, addr := range addrs {
+		if !strings.Contains(addr, "://") {
+			addr = "http://" + addr
+		}
+		c.addrs = append(c.addrs, strings.TrimSuffix(addr, "/"))
+	}
+	return c, nil
+}
+
+// do sends the request and decodes the response into out when it is not nil.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) (resp *http.Response, err error) {
+	var (
+		body []byte
+		req  *http.Request
+	)
+	if in != nil {
+		if body, err = json.Marshal(in); err != nil {
+			return
+		}
+	}
+	for _, addr := range c.addrs {
+		if req, err = http.NewRequest(method, addr+path, bytes.NewReader(body)); err != nil {
+			return
+		}
+		if resp, err = c.http.Do(req.WithContext(ctx)); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("consul: %s %s: %s", method, path, resp.Status)
+			return
+		}
+		if out != nil {
+			err = json.NewDecoder(resp.Body).Decode(out)
+		}
+		return
+	}
+	return
+}
+
+type agentService struct {
+	ID      string
+	Name    string
+	Tags    []string          `json:",omitempty"`
+	Address string            `json:",omitempty"`
+	Port    int               `json:",omitempty"`
+	Meta    map[string]string `json:",omitempty"`
+	Check   *agentCheck       `json:",omitempty"`
+}
+
+type agentCheck struct {
+	CheckID                        string
+	TTL                            string
+	DeregisterCriticalServiceAfter string
+}
+
+type serviceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		ID      string
+		Service string
+		Tags    []string
+		Address string
+		Port    int
+		Meta    map[string]string
+	}
+}
+
+// Registry registers a node into consul and passes its TTL checks until Deregister is called.
+type Registry struct {
+	client   *Client
+	ttl      time.Duration
+	mu       sync.Mutex
+	services []agentService
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func NewRegistry(client *Client, ttl time.Duration) *Registry {
+	return &Registry{client: client, ttl: ttl}
+}
+
+func (r *Registry) Register(ctx context.Context, service, nodeID string, node registry.NodeData) error {
+	host, portStr, err := net.SplitHostPort(node.Addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+	meta := map[string]string{metaVersion: node.Version, metaRegion: node.Region, metaZone: node.Zone}
+	for k, v := range node.Metadata {
+		meta[metaPrefix+k] = v
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err = r.deregister(ctx); err != nil {
+		return err
+	}
+	var services []agentService
+	for _, name := range registry.Names(service, node) {
+		id := name + "-" + nodeID
+		services = append(services, agentService{
+			ID:      id,
+			Name:    name,
+			Tags:    node.Tags,
+			Address: host,
+			Port:    port,
+			Meta:    meta,
+			Check: &agentCheck{
+				CheckID:                        "service:" + id,
+				TTL:                            r.ttl.String(),
+				DeregisterCriticalServiceAfter: DefaultDeregisterAfter.String(),
+			},
+		})
+	}
+	r.services = services
+	if err = r.register(ctx); err != nil {
+		r.deregister(ctx)
+		return err
+	}
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go r.heartbeat(r.stop, r.done)
+	return nil
+}
+
+// register registers the services and passes their checks, r.mu must be held.
+func (r *Registry) register(ctx context.Context) (err error) {
+	for i := range r.services {
+		if _, err = r.client.do(ctx, "PUT", "/v1/agent/service/register", &r.services[i], nil); err != nil {
+			return
+		}
+	}
+	return r.pass(ctx)
+}
+
+func (r *Registry) pass(ctx context.Context) (err error) {
+	for _, service := range r.services {
+		if _, err = r.client.do(ctx, "PUT", "/v1/agent/check/pass/"+url.PathEscape(service.Check.CheckID), nil, nil); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// heartbeat passes the checks three times per TTL, and registers the services again when the agent lost them.
+func (r *Registry) heartbeat(stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(r.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		r.mu.Lock()
+		ctx, cancel := context.WithTimeout(context.Background(), r.ttl/3)
+		err := r.pass(ctx)
+		cancel()
+		if err != nil {
+			grpclog.Println("Consul pass check error:", err)
+			//the pass may have used up its timeout, the register gets one of its own
+			ctx, cancel = context.WithTimeout(context.Background(), r.ttl/3)
+			if err = r.register(ctx); err != nil {
+				grpclog.Println("Consul register service error:", err)
+			}
+			cancel()
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *Registry) Deregister(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.deregister(ctx)
+}
+
+// deregister stops the heartbeat and deregisters the services, r.mu must be held.
+func (r *Registry) deregister(ctx context.Context) (err error) {
+	if r.stop != nil {
+		close(r.stop)
+		// the heartbeat may be waiting for r.mu
+		r.mu.Unlock()
+		<-r.done
+		r.mu.Lock()
+		r.stop = nil
+	}
+	for len(r.services) > 0 {
+		if _, err = r.client.do(ctx, "PUT", "/v1/agent/service/deregister/"+url.PathEscape(r.services[0].ID), nil, nil); err != nil {
+			return
+		}
+		r.services = r.services[1:]
+	}
+	return
+}
+
+func (r *Registry) Close() error {
+	return nil
+}
+
+// Discovery follows the passing instances of consul services.
+type Discovery struct {
+	client *Client
+}
+
+func NewDiscovery(client *Client) *Discovery {
+	return &Discovery{client: client}
+}
+
+func (d *Discovery) Watch(service string) (registry.Watcher, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &watcher{client: d.client, service: service, ctx: ctx, cancel: cancel}, nil
+}
+
+func (d *Discovery) Close() error {
+	return nil
+}
+
+type watcher struct {
+	client  *Client
+	service string
+	index   uint64
+	started bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func (w *watcher) Close() {
+	w.cancel()
+}
+
+// Next blocks on the health endpoint until the consul index moves, retrying every second on errors.
+func (w *watcher) Next() ([]registry.NodeData, error) {
+	for {
+		var entries []serviceEntry
+		path := fmt.Sprintf("/v1/health/service/%s?passing=1&index=%d&wait=%s", url.PathEscape(w.service), w.index, DefaultWait)
+		resp, err := w.client.do(w.ctx, "GET", path, nil, &entries)
+		if w.ctx.Err() != nil {
+			return nil, registry.ErrClosed
+		}
+		if err != nil {
+			grpclog.Println("Consul watch service error:", err)
+			select {
+			case <-time.After(retryBackoff):
+				continue
+			case <-w.ctx.Done():
+				return nil, registry.ErrClosed
+			}
+		}
+		index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+		if w.started && index == w.index {
+			continue
+		}
+		w.started = true
+		if index < w.index {
+			// the index went backwards, start over as consul recommends
+			index = 0
+		} else if index == 0 {
+			index = 1
+		}
+		w.index = index
+		return nodes(entries), nil
+	}
+}
+
+func nodes(entries []serviceEntry) []registry.NodeData {
+	nodes := make([]registry.NodeData, 0, len(entries))
+	for _, entry := range entries {
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		nodeData := registry.NodeData{
+			Addr:    net.JoinHostPort(host, strconv.Itoa(entry.Service.Port)),
+			Version: entry.Service.Meta[metaVersion],
+			Region:  entry.Service.Meta[metaRegion],
+			Zone:    entry.Service.Meta[metaZone],
+			Tags:    entry.Service.Tags,
+		}
+		for k, v := range entry.Service.Meta {
+			if strings.HasPrefix(k, metaPrefix) {
+				if nodeData.Metadata == nil {
+					nodeData.Metadata = make(map[string]string)
+				}
+				nodeData.Metadata[strings.TrimPrefix(k, metaPrefix)] = v
+			}
+		}
+		nodes = append(nodes, nodeData)
+	}
+	return nodes
+}
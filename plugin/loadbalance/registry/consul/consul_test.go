@@ -0,0 +1,255 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// fakeAgent serves the parts of the consul agent API used by the backend.
+type fakeAgent struct {
+	mu       sync.Mutex
+	index    uint64
+	changed  chan struct{} //closed on every change
+	services map[string]agentService
+	passing  map[string]bool //check id -> passing
+	stall    bool            //check passes hang until the request is canceled
+}
+
+func newFakeAgent() *fakeAgent {
+	return &fakeAgent{index: 1, changed: make(chan struct{}), services: make(map[string]agentService), passing: make(map[string]bool)}
+}
+
+// bump must be called with a.mu held.
+func (a *fakeAgent) bump() {
+	a.index++
+	close(a.changed)
+	a.changed = make(chan struct{})
+}
+
+// reset forgets every service, like a restarted agent.
+func (a *fakeAgent) reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.services = make(map[string]agentService)
+	a.passing = make(map[string]bool)
+	a.bump()
+}
+
+func (a *fakeAgent) serviceIDs() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var ids []string
+	for id := range a.services {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (a *fakeAgent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case r.Method == "PUT" && r.URL.Path == "/v1/agent/service/register":
+		var s agentService
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.services[s.ID] = s
+		a.passing[s.Check.CheckID] = false
+		a.bump()
+	case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/v1/agent/check/pass/"):
+		if a.stall {
+			a.mu.Unlock()
+			<-r.Context().Done()
+			a.mu.Lock()
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/v1/agent/check/pass/")
+		passing, ok := a.passing[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if !passing {
+			a.passing[id] = true
+			a.bump()
+		}
+	case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+		delete(a.services, id)
+		delete(a.passing, "service:"+id)
+		a.bump()
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/v1/health/service/"):
+		name := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+		index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+		for a.index <= index {
+			changed := a.changed
+			a.mu.Unlock()
+			select {
+			case <-changed:
+				a.mu.Lock()
+			case <-r.Context().Done():
+				a.mu.Lock()
+				return
+			}
+		}
+		entries := []serviceEntry{}
+		for _, s := range a.services {
+			if s.Name != name || !a.passing[s.Check.CheckID] {
+				continue
+			}
+			var entry serviceEntry
+			entry.Node.Address = "10.0.0.1"
+			entry.Service.ID = s.ID
+			entry.Service.Service = s.Name
+			entry.Service.Tags = s.Tags
+			entry.Service.Address = s.Address
+			entry.Service.Port = s.Port
+			entry.Service.Meta = s.Meta
+			entries = append(entries, entry)
+		}
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(a.index, 10))
+		json.NewEncoder(w).Encode(entries)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func start(t *testing.T) (*fakeAgent, *Client, func()) {
+	agent := newFakeAgent()
+	server := httptest.NewServer(agent)
+	client, err := NewClient([]string{strings.TrimPrefix(server.URL, "http://")})
+	require.NoError(t, err)
+	return agent, client, server.Close
+}
+
+// next waits for the next node list of w.
+func next(t *testing.T, w registry.Watcher) []registry.NodeData {
+	type result struct {
+		nodes []registry.NodeData
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		nodes, err := w.Next()
+		ch <- result{nodes, err}
+	}()
+	select {
+	case r := <-ch:
+		require.NoError(t, r.err)
+		return r.nodes
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for nodes")
+		return nil
+	}
+}
+
+func TestRegisterAndWatch(t *testing.T) {
+	_, client, stop := start(t)
+	defer stop()
+	r := NewRegistry(client, time.Minute)
+	d := NewDiscovery(client)
+	w, err := d.Watch("example")
+	require.NoError(t, err)
+	defer w.Close()
+	assert.Empty(t, next(t, w))
+
+	node := registry.NodeData{
+		Addr:     "127.0.0.1:9000",
+		Services: []string{"pkg.Example"},
+		Version:  "v1",
+		Zone:     "z1",
+		Tags:     []string{"canary"},
+		Metadata: map[string]string{"weight": "10"},
+	}
+	require.NoError(t, r.Register(context.Background(), "example", "node-1", node))
+	nodes := next(t, w)
+	for len(nodes) == 0 {
+		// the service shows up once its check passed
+		nodes = next(t, w)
+	}
+	require.Len(t, nodes, 1)
+	assert.Equal(t, registry.NodeData{
+		Addr:     "127.0.0.1:9000",
+		Version:  "v1",
+		Zone:     "z1",
+		Tags:     []string{"canary"},
+		Metadata: map[string]string{"weight": "10"},
+	}, nodes[0])
+
+	// the node is registered under its protobuf service names too
+	pw, err := d.Watch("pkg.Example")
+	require.NoError(t, err)
+	defer pw.Close()
+	assert.Len(t, next(t, pw), 1)
+
+	require.NoError(t, r.Deregister(context.Background()))
+	assert.Empty(t, next(t, w))
+}
+
+func TestHeartbeatRegistersAgain(t *testing.T) {
+	agent, client, stop := start(t)
+	defer stop()
+	r := NewRegistry(client, 30*time.Millisecond)
+	require.NoError(t, r.Register(context.Background(), "example", "node-1", registry.NodeData{Addr: "127.0.0.1:9000"}))
+	defer r.Deregister(context.Background())
+
+	agent.reset()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(agent.serviceIDs()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, []string{"example-node-1"}, agent.serviceIDs())
+}
+
+func TestHeartbeatRegistersAfterPassTimeout(t *testing.T) {
+	agent, client, stop := start(t)
+	defer stop()
+	r := NewRegistry(client, 30*time.Millisecond)
+	require.NoError(t, r.Register(context.Background(), "example", "node-1", registry.NodeData{Addr: "127.0.0.1:9000"}))
+	defer r.Deregister(context.Background())
+
+	// the pass times out, the register after it still reaches the agent
+	agent.reset()
+	agent.mu.Lock()
+	agent.stall = true
+	agent.mu.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(agent.serviceIDs()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, []string{"example-node-1"}, agent.serviceIDs())
+}
+
+func TestWatchClose(t *testing.T) {
+	_, client, stop := start(t)
+	defer stop()
+	w, err := NewDiscovery(client).Watch("example")
+	require.NoError(t, err)
+	next(t, w)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		w.Close()
+	}()
+	_, err = w.Next()
+	assert.Equal(t, registry.ErrClosed, err)
+}
+
+func TestServiceAddressFallback(t *testing.T) {
+	var entry serviceEntry
+	entry.Node.Address = "10.0.0.1"
+	entry.Service.Port = 9000
+	assert.Equal(t, "10.0.0.1:9000", nodes([]serviceEntry{entry})[0].Addr)
+}
@@ -0,0 +1,149 @@
+// Package dns is the registry backend on DNS SRV records. Nodes are not registered by the servers, the
+// service name is looked up as an SRV name, e.g. "_example._tcp.example.com" or the name of a kubernetes
+// headless service, and polled for changes.
+package dns
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/grpclog"
+)
+
+const (
+	// Kind is the name of the dns backend.
+	Kind = "dns"
+	//SRV记录的轮询间隔
+	DefaultInterval = 30 * time.Second
+	//SRV记录的权重写入节点元数据的键，同loadbalance.WeightKey
+	weightKey = "weight"
+)
+
+func init() {
+	registry.RegisterBackend(Kind, backend{})
+}
+
+type backend struct{}
+
+func (backend) NewRegistry(addrs []string) (registry.Registry, error) {
+	return registry.Nop{}, nil
+}
+
+// NewDiscovery looks up the names with the name servers in addrs, or with the system resolver when addrs is empty.
+func (backend) NewDiscovery(addrs []string) (registry.Discovery, error) {
+	r := net.DefaultResolver
+	if len(addrs) > 0 {
+		var (
+			next int
+			mu   sync.Mutex
+		)
+		r = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				mu.Lock()
+				server := addrs[next%len(addrs)]
+				next++
+				mu.Unlock()
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return NewDiscovery(func(ctx context.Context, name string) ([]*net.SRV, error) {
+		_, srvs, err := r.LookupSRV(ctx, "", "", name)
+		return srvs, err
+	}, DefaultInterval), nil
+}
+
+// LookupFunc returns the SRV records of name.
+type LookupFunc func(ctx context.Context, name string) ([]*net.SRV, error)
+
+// Discovery polls the SRV records of the services.
+type Discovery struct {
+	lookup   LookupFunc
+	interval time.Duration
+}
+
+func NewDiscovery(lookup LookupFunc, interval time.Duration) *Discovery {
+	return &Discovery{lookup: lookup, interval: interval}
+}
+
+func (d *Discovery) Watch(service string) (registry.Watcher, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &watcher{discovery: d, name: service, ctx: ctx, cancel: cancel}, nil
+}
+
+func (d *Discovery) Close() error {
+	return nil
+}
+
+type watcher struct {
+	discovery *Discovery
+	name      string
+	nodes     []registry.NodeData
+	started   bool
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+func (w *watcher) Close() {
+	w.cancel()
+}
+
+// Next returns the nodes once they differ from the last ones, a failed lookup keeps the last nodes.
+func (w *watcher) Next() ([]registry.NodeData, error) {
+	for {
+		if w.started {
+			select {
+			case <-time.After(w.discovery.interval):
+			case <-w.ctx.Done():
+				return nil, registry.ErrClosed
+			}
+		}
+		w.started = true
+		srvs, err := w.discovery.lookup(w.ctx, w.name)
+		if w.ctx.Err() != nil {
+			return nil, registry.ErrClosed
+		}
+		if err != nil {
+			grpclog.Println("DNS lookup SRV error:", err)
+			continue
+		}
+		nodes := nodes(srvs)
+		if w.nodes != nil && reflect.DeepEqual(nodes, w.nodes) {
+			continue
+		}
+		w.nodes = nodes
+		return nodes, nil
+	}
+}
+
+// nodes converts the records of the lowest priority to nodes sorted by address.
+func nodes(srvs []*net.SRV) []registry.NodeData {
+	nodes := []registry.NodeData{}
+	priority := uint16(0xffff)
+	for _, srv := range srvs {
+		if srv.Priority < priority {
+			priority = srv.Priority
+		}
+	}
+	for _, srv := range srvs {
+		if srv.Priority != priority {
+			continue
+		}
+		nodeData := registry.NodeData{Addr: net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))}
+		if srv.Weight > 0 {
+			nodeData.Metadata = map[string]string{weightKey: strconv.Itoa(int(srv.Weight))}
+		}
+		nodes = append(nodes, nodeData)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Addr < nodes[j].Addr })
+	return nodes
+}
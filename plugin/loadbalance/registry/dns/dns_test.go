@@ -0,0 +1,76 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// fakeDNS serves SRV records from memory.
+type fakeDNS struct {
+	mu      sync.Mutex
+	records map[string][]*net.SRV
+	err     error
+}
+
+func (f *fakeDNS) set(name string, srvs []*net.SRV, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.records[name] = srvs
+	f.err = err
+}
+
+func (f *fakeDNS) lookup(ctx context.Context, name string) ([]*net.SRV, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.records[name], f.err
+}
+
+func TestWatch(t *testing.T) {
+	f := &fakeDNS{records: map[string][]*net.SRV{
+		"_example._tcp.example.com": {
+			{Target: "b.example.com.", Port: 9000, Priority: 10, Weight: 5},
+			{Target: "a.example.com.", Port: 9000, Priority: 10},
+			{Target: "backup.example.com.", Port: 9000, Priority: 20},
+		},
+	}}
+	w, err := NewDiscovery(f.lookup, 10*time.Millisecond).Watch("_example._tcp.example.com")
+	require.NoError(t, err)
+	defer w.Close()
+	nodes, err := w.Next()
+	require.NoError(t, err)
+	assert.Equal(t, []registry.NodeData{
+		{Addr: "a.example.com:9000"},
+		{Addr: "b.example.com:9000", Metadata: map[string]string{"weight": "5"}},
+	}, nodes)
+
+	// failed lookups keep the nodes, Next only returns on changes
+	f.set("_example._tcp.example.com", nil, errors.New("timeout"))
+	time.Sleep(30 * time.Millisecond)
+	f.set("_example._tcp.example.com", []*net.SRV{{Target: "c.example.com.", Port: 9001}}, nil)
+	nodes, err = w.Next()
+	require.NoError(t, err)
+	assert.Equal(t, []registry.NodeData{{Addr: "c.example.com:9001"}}, nodes)
+}
+
+func TestWatchClose(t *testing.T) {
+	f := &fakeDNS{records: make(map[string][]*net.SRV)}
+	w, err := NewDiscovery(f.lookup, time.Hour).Watch("_example._tcp.example.com")
+	require.NoError(t, err)
+	nodes, err := w.Next()
+	require.NoError(t, err)
+	assert.Empty(t, nodes)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		w.Close()
+	}()
+	_, err = w.Next()
+	assert.Equal(t, registry.ErrClosed, err)
+}
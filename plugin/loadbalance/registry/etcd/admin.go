@@ -0,0 +1,103 @@
+package etcd
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	etcd3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"golang.org/x/net/context"
+)
+
+// ErrNodeNotFound is returned by DeleteNode when the node is not registered under the service.
+var ErrNodeNotFound = errors.New("node not found")
+
+// Service is a service name registered under the registry dir.
+type Service struct {
+	Name  string `json:"name"`
+	Nodes int    `json:"nodes"` //节点数
+}
+
+// Node is a node registered under a service.
+type Node struct {
+	ID    string   `json:"id"`
+	Key   string   `json:"key"`
+	Lease int64    `json:"lease"` //0表示没有租约
+	TTL   int64    `json:"ttl"`   //租约剩余秒数，-1表示没有租约或已过期
+	Data  NodeData `json:"data"`
+}
+
+// ListServices returns the services registered under dir sorted by name.
+func ListServices(ctx context.Context, client *etcd3.Client, dir string) ([]Service, error) {
+	resp, err := client.Get(ctx, dir+"/", etcd3.WithPrefix(), etcd3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, kv := range resp.Kvs {
+		name := strings.TrimPrefix(string(kv.Key), dir+"/")
+		i := strings.LastIndex(name, "/")
+		if i <= 0 {
+			continue
+		}
+		counts[name[:i]]++
+	}
+	services := make([]Service, 0, len(counts))
+	for name, nodes := range counts {
+		services = append(services, Service{Name: name, Nodes: nodes})
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	return services, nil
+}
+
+// ListNodes returns the nodes of service sorted by key, with the remaining TTL of their lease.
+func ListNodes(ctx context.Context, client *etcd3.Client, dir, service string) ([]Node, error) {
+	prefix := dir + "/" + service + "/"
+	resp, err := client.Get(ctx, prefix, etcd3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]Node, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		node := Node{ID: strings.TrimPrefix(string(kv.Key), prefix), Key: string(kv.Key), Lease: kv.Lease, TTL: -1}
+		if strings.Contains(node.ID, "/") {
+			// a key of a service nested under this one
+			continue
+		}
+		if err = json.Unmarshal(kv.Value, &node.Data); err != nil {
+			return nil, err
+		}
+		if kv.Lease != 0 {
+			ttl, err := client.TimeToLive(ctx, etcd3.LeaseID(kv.Lease))
+			if err != nil {
+				return nil, err
+			}
+			node.TTL = ttl.TTL
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// DeleteNode removes a node of service. The lease of the node is revoked, which also removes it from
+// the other names it was registered under; a node still running registers again with a new lease.
+func DeleteNode(ctx context.Context, client *etcd3.Client, dir, service, nodeID string) error {
+	key := dir + "/" + service + "/" + nodeID
+	resp, err := client.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) == 0 {
+		return ErrNodeNotFound
+	}
+	if lease := resp.Kvs[0].Lease; lease != 0 {
+		// the lease may have expired since the get
+		if _, err = client.Revoke(ctx, etcd3.LeaseID(lease)); err != rpctypes.ErrLeaseNotFound {
+			return err
+		}
+	}
+	_, err = client.Delete(ctx, key)
+	return err
+}
@@ -2,37 +2,147 @@ package etcd
 
 import (
 	"encoding/json"
-
+	"errors"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/cenk/backoff"
+	"github.com/chuangyou/qsf/constant"
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry"
 	etcd3 "github.com/coreos/etcd/clientv3"
-	//"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/grpclog"
 )
 
+const (
+	// Kind is the name of the etcd backend.
+	Kind = "etcd"
+	//租约丢失后重新注册的初始与最大重试间隔
+	DefaultMinRetryInterval = 500 * time.Millisecond
+	DefaultMaxRetryInterval = 30 * time.Second
+)
+
+// NodeData is the value registered for a node.
+type NodeData = registry.NodeData
+
+var (
+	errLeaseLost = errors.New("registry lease lost")
+
+	registeredGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "qsf_registry_registered",
+			Help: "Whether the node is registered in etcd with a live lease.",
+		}, []string{"service"})
+	leaseLostCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "qsf_registry_lease_lost_total",
+			Help: "Total number of times the etcd lease of the node was lost.",
+		}, []string{"service"})
+	registerFailedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "qsf_registry_register_failures_total",
+			Help: "Total number of failed attempts to register the node again after its lease was lost.",
+		}, []string{"service"})
+)
+
+func init() {
+	registry.RegisterBackend(Kind, backend{})
+}
+
+type backend struct{}
+
+func (backend) NewRegistry(addrs []string) (registry.Registry, error) {
+	if len(addrs) == 0 {
+		return nil, registry.ErrNoAddrs
+	}
+	return NewRegistry(Option{EtcdConfig: etcd3.Config{Endpoints: addrs}, RegistryDir: constant.DEFAULT_ETCD_PATH, Ttl: 10 * time.Second})
+}
+
+func (backend) NewDiscovery(addrs []string) (registry.Discovery, error) {
+	if len(addrs) == 0 {
+		return nil, registry.ErrNoAddrs
+	}
+	return NewDiscovery(constant.DEFAULT_ETCD_PATH, etcd3.Config{Endpoints: addrs})
+}
+
+// Collector returns the registration metrics, to be registered into a prometheus registry.
+func Collector() prometheus.Collector {
+	return collectors{registeredGauge, leaseLostCounter, registerFailedCounter}
+}
+
+type collectors []prometheus.Collector
+
+func (c collectors) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range c {
+		collector.Describe(ch)
+	}
+}
+
+func (c collectors) Collect(ch chan<- prometheus.Metric) {
+	for _, collector := range c {
+		collector.Collect(ch)
+	}
+}
+
+// EventType indicates the type of a registration event.
+type EventType int
+
+const (
+	// EventRegistered is sent when the keys of the node are put with a live lease
+	EventRegistered EventType = iota
+	// EventLost is sent when the lease of the node expired or its keepalive failed
+	EventLost
+	// EventRetryFailed is sent when registering the node again after EventLost failed
+	EventRetryFailed
+	// EventDeregistered is sent when the node is deregistered
+	EventDeregistered
+)
+
+// Event is a change of the registration of a node.
+type Event struct {
+	Type    EventType
+	Service string
+	Err     error //EventLost和EventRetryFailed的原因
+}
+
+// EtcdReigistry registers a node as "<RegistryDir>/<service>/<nodeID>" keys sharing one lease. A
+// supervisor keeps the lease alive and, when the lease is lost (etcd restarted, a long partition), grants
+// a new one and puts the keys again with exponential backoff until it succeeds.
 type EtcdReigistry struct {
-	etcd3Client *etcd3.Client
-	key         string
-	value       string
-	ttl         time.Duration
-	ctx         context.Context
-	cancel      context.CancelFunc
-	deregister  chan struct{}
+	etcd3Client      *etcd3.Client
+	registryDir      string
+	ttl              time.Duration
+	minRetryInterval time.Duration
+	maxRetryInterval time.Duration
+	ctx              context.Context
+	cancel           context.CancelFunc
+	mu               sync.Mutex
+	current          *registration
+	registered       int32
+	eventMu          sync.Mutex
+	eventReceivers   []chan Event
 }
 
 type Option struct {
-	EtcdConfig  etcd3.Config
-	RegistryDir string
-	ServiceName string
-	NodeID      string
-	NData       NodeData
-	Ttl         time.Duration
+	EtcdConfig       etcd3.Config
+	RegistryDir      string
+	Ttl              time.Duration
+	MinRetryInterval time.Duration //0表示DefaultMinRetryInterval
+	MaxRetryInterval time.Duration //0表示DefaultMaxRetryInterval
 }
 
-type NodeData struct {
-	Addr     string
-	Metadata map[string]string
+// registration is one Register call, supervised until Deregister.
+type registration struct {
+	service string
+	keys    []string
+	value   string
+	lease   etcd3.LeaseID
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
 }
 
 func NewRegistry(option Option) (*EtcdReigistry, error) {
@@ -40,95 +150,203 @@ func NewRegistry(option Option) (*EtcdReigistry, error) {
 	if err != nil {
 		return nil, err
 	}
+	return newRegistry(client, option), nil
+}
 
-	val, err := json.Marshal(option.NData)
-	if err != nil {
-		return nil, err
+func newRegistry(client *etcd3.Client, option Option) *EtcdReigistry {
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &EtcdReigistry{
+		etcd3Client:      client,
+		registryDir:      option.RegistryDir,
+		ttl:              option.Ttl,
+		minRetryInterval: option.MinRetryInterval,
+		maxRetryInterval: option.MaxRetryInterval,
+		ctx:              ctx,
+		cancel:           cancel,
+	}
+	if e.minRetryInterval <= 0 {
+		e.minRetryInterval = DefaultMinRetryInterval
+	}
+	if e.maxRetryInterval <= 0 {
+		e.maxRetryInterval = DefaultMaxRetryInterval
 	}
+	return e
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	registry := &EtcdReigistry{
-		etcd3Client: client,
-		key:         option.RegistryDir + "/" + option.ServiceName + "/" + option.NodeID,
-		value:       string(val),
-		ttl:         option.Ttl,
-		ctx:         ctx,
-		cancel:      cancel,
-		deregister:  make(chan struct{}),
+// Subscribe returns a channel of registration events. The channel keeps the last 100 events, older
+// ones are dropped when it is not read.
+func (e *EtcdReigistry) Subscribe() <-chan Event {
+	ch := make(chan Event, 100)
+	e.eventMu.Lock()
+	e.eventReceivers = append(e.eventReceivers, ch)
+	e.eventMu.Unlock()
+	return ch
+}
+
+// sendEvent never blocks, it runs under the locks of the registry: a full receiver drops its oldest event.
+func (e *EtcdReigistry) sendEvent(event Event) {
+	e.eventMu.Lock()
+	defer e.eventMu.Unlock()
+	for _, receiver := range e.eventReceivers {
+		select {
+		case receiver <- event:
+			continue
+		default:
+		}
+		select {
+		case <-receiver:
+		default:
+		}
+		select {
+		case receiver <- event:
+		default:
+		}
+	}
+}
+
+// Registered reports whether the node is registered with a live lease.
+func (e *EtcdReigistry) Registered() bool {
+	return atomic.LoadInt32(&e.registered) == 1
+}
+
+func (e *EtcdReigistry) setRegistered(service string, registered bool) {
+	if registered {
+		atomic.StoreInt32(&e.registered, 1)
+		registeredGauge.WithLabelValues(service).Set(1)
+	} else {
+		atomic.StoreInt32(&e.registered, 0)
+		registeredGauge.WithLabelValues(service).Set(0)
 	}
-	return registry, nil
 }
 
-func (e *EtcdReigistry) Register() error {
-	resp, err := e.etcd3Client.Grant(e.ctx, int64(e.ttl.Seconds()))
+// Register puts the node into etcd and supervises its lease until Deregister is called. Only the first
+// attempt is bound to ctx and its error returned, later ones are reported by Subscribe.
+func (e *EtcdReigistry) Register(ctx context.Context, service, nodeID string, node NodeData) error {
+	val, err := json.Marshal(node)
 	if err != nil {
 		return err
 	}
-	if _, err := e.etcd3Client.Put(e.ctx, e.key, e.value, etcd3.WithLease(resp.ID)); err != nil {
-		grpclog.Printf("grpclb: set key '%s' with ttl to etcd3 failed: %s", e.key, err.Error())
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err = e.deregister(ctx); err != nil {
 		return err
 	}
+	r := &registration{service: service, value: string(val), done: make(chan struct{})}
+	for _, name := range registry.Names(service, node) {
+		r.keys = append(r.keys, e.registryDir+"/"+name+"/"+nodeID)
+	}
+	r.ctx, r.cancel = context.WithCancel(e.ctx)
+	ka, err := e.put(ctx, r)
+	if err != nil {
+		r.cancel()
+		return err
+	}
+	e.current = r
+	e.setRegistered(service, true)
+	e.sendEvent(Event{Type: EventRegistered, Service: service})
+	go e.supervise(r, ka)
+	return nil
+}
 
-	if _, err := e.etcd3Client.KeepAlive(e.ctx, resp.ID); err != nil {
-		grpclog.Printf("grpclb: refresh service '%s' with ttl to etcd3 failed: %s", e.key, err.Error())
+// put grants a lease, puts the keys with it and starts its keepalive.
+func (e *EtcdReigistry) put(ctx context.Context, r *registration) (<-chan *etcd3.LeaseKeepAliveResponse, error) {
+	resp, err := e.etcd3Client.Grant(ctx, int64(e.ttl.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+	// all keys of the node share one lease, so they expire together
+	puts := make([]etcd3.Op, 0, len(r.keys))
+	for _, key := range r.keys {
+		puts = append(puts, etcd3.OpPut(key, r.value, etcd3.WithLease(resp.ID)))
+	}
+	if _, err = e.etcd3Client.Txn(ctx).Then(puts...).Commit(); err != nil {
+		grpclog.Printf("grpclb: set keys '%v' with ttl to etcd3 failed: %s", r.keys, err.Error())
+		e.etcd3Client.Revoke(ctx, resp.ID)
+		return nil, err
+	}
+	ka, err := e.etcd3Client.KeepAlive(r.ctx, resp.ID)
+	if err != nil {
+		grpclog.Printf("grpclb: refresh service '%v' with ttl to etcd3 failed: %s", r.keys, err.Error())
+		e.etcd3Client.Revoke(ctx, resp.ID)
+		return nil, err
+	}
+	r.lease = resp.ID
+	return ka, nil
+}
+
+// supervise waits for the keepalive of the lease to end, then registers the node again with backoff.
+func (e *EtcdReigistry) supervise(r *registration, ka <-chan *etcd3.LeaseKeepAliveResponse) {
+	defer close(r.done)
+	for {
+		for range ka {
+		}
+		if r.ctx.Err() != nil {
+			return
+		}
+		grpclog.Printf("grpclb: lease of '%v' lost, registering again", r.keys)
+		e.setRegistered(r.service, false)
+		leaseLostCounter.WithLabelValues(r.service).Inc()
+		e.sendEvent(Event{Type: EventLost, Service: r.service, Err: errLeaseLost})
+		b := backoff.NewExponentialBackOff()
+		b.InitialInterval = e.minRetryInterval
+		b.MaxInterval = e.maxRetryInterval
+		b.MaxElapsedTime = 0
+		b.Reset()
+		for {
+			ctx, cancel := context.WithTimeout(r.ctx, e.ttl)
+			var err error
+			ka, err = e.put(ctx, r)
+			cancel()
+			if err == nil {
+				break
+			}
+			if r.ctx.Err() != nil {
+				return
+			}
+			registerFailedCounter.WithLabelValues(r.service).Inc()
+			e.sendEvent(Event{Type: EventRetryFailed, Service: r.service, Err: err})
+			select {
+			case <-time.After(b.NextBackOff()):
+			case <-r.ctx.Done():
+				return
+			}
+		}
+		e.setRegistered(r.service, true)
+		e.sendEvent(Event{Type: EventRegistered, Service: r.service})
+	}
+}
+
+// Deregister stops the supervisor and deletes the keys of the node, revoking the lease stops its keepalive.
+func (e *EtcdReigistry) Deregister(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.deregister(ctx)
+}
+
+func (e *EtcdReigistry) deregister(ctx context.Context) error {
+	r := e.current
+	if r == nil {
+		return nil
+	}
+	r.cancel()
+	<-r.done
+	e.setRegistered(r.service, false)
+	deletes := make([]etcd3.Op, 0, len(r.keys))
+	for _, key := range r.keys {
+		deletes = append(deletes, etcd3.OpDelete(key))
+	}
+	if _, err := e.etcd3Client.Txn(ctx).Then(deletes...).Commit(); err != nil {
+		return err
+	}
+	if _, err := e.etcd3Client.Revoke(ctx, r.lease); err != nil && err != rpctypes.ErrLeaseNotFound {
 		return err
 	}
-	// wait deregister then delete
-	go func() {
-		<-e.deregister
-		e.etcd3Client.Delete(e.ctx, e.key)
-		e.deregister <- struct{}{}
-	}()
-	//	insertFunc := func() error {
-	//		resp, err := e.etcd3Client.Grant(e.ctx, int64(e.ttl.Seconds()))
-	//		if err != nil {
-	//			return err
-	//		}
-	//		_, err = e.etcd3Client.Get(e.ctx, e.key)
-	//		if err != nil {
-	//			if err == rpctypes.ErrKeyNotFound {
-	//				if _, err := e.etcd3Client.Put(e.ctx, e.key, e.value, etcd3.WithLease(resp.ID)); err != nil {
-	//					grpclog.Printf("grpclb: set key '%s' with ttl to etcd3 failed: %s", e.key, err.Error())
-	//				}
-	//			} else {
-	//				grpclog.Printf("grpclb: key '%s' connect to etcd3 failed: %s", e.key, err.Error())
-	//			}
-	//			return err
-	//		} else {
-	//			// refresh set to true for not notifying the watcher
-	//			if _, err := e.etcd3Client.Put(e.ctx, e.key, e.value, etcd3.WithLease(resp.ID)); err != nil {
-	//				grpclog.Printf("grpclb: refresh key '%s' with ttl to etcd3 failed: %s", e.key, err.Error())
-	//				return err
-	//			}
-	//		}
-	//		return nil
-	//	}
-
-	//	err := insertFunc()
-	//	if err != nil {
-	//		return err
-	//	}
-
-	//	ticker := time.NewTicker(e.ttl / 5)
-	//	for {
-	//		select {
-	//		case <-ticker.C:
-	//			insertFunc()
-	//		case <-e.ctx.Done():
-	//			ticker.Stop()
-	//			if _, err := e.etcd3Client.Delete(context.Background(), e.key); err != nil {
-	//				grpclog.Printf("grpclb: deregister '%s' failed: %s", e.key, err.Error())
-	//			}
-	//			return nil
-	//		}
-	//	}
-
-	//	return nil
+	e.current = nil
+	e.sendEvent(Event{Type: EventDeregistered, Service: r.service})
 	return nil
 }
 
-// UnRegister delete registered service from etcd
-func (e *EtcdReigistry) UnRegister() {
-	e.deregister <- struct{}{}
-	<-e.deregister
+func (e *EtcdReigistry) Close() error {
+	e.cancel()
+	return e.etcd3Client.Close()
 }
@@ -0,0 +1,112 @@
+package etcd
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/chuangyou/qsf/internal/etcdtest"
+	etcd3 "github.com/coreos/etcd/clientv3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func startEtcd(t *testing.T) (*etcdtest.Server, etcd3.Config) {
+	s, err := etcdtest.NewServer()
+	require.NoError(t, err)
+	return s, etcd3.Config{Endpoints: s.Endpoints(), DialTimeout: 5 * time.Second}
+}
+
+// waitEvent waits for the next event of type typ, skipping the others.
+func waitEvent(t *testing.T, events <-chan Event, typ EventType) Event {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Type == typ {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for event %d", typ)
+		}
+	}
+}
+
+func TestSendEvent(t *testing.T) {
+	e := &EtcdReigistry{}
+	events := e.Subscribe()
+	// a receiver that is not read keeps the last 100 events
+	for i := 0; i < 150; i++ {
+		e.sendEvent(Event{Type: EventRegistered, Service: strconv.Itoa(i)})
+	}
+	require.Len(t, events, 100)
+	assert.Equal(t, "50", (<-events).Service)
+	for len(events) > 1 {
+		<-events
+	}
+	assert.Equal(t, "149", (<-events).Service)
+}
+
+func TestRegister(t *testing.T) {
+	s, cfg := startEtcd(t)
+	defer s.Close()
+	r, err := NewRegistry(Option{EtcdConfig: cfg, RegistryDir: "/qsf.service", Ttl: 10 * time.Second})
+	require.NoError(t, err)
+	defer r.Close()
+	events := r.Subscribe()
+
+	node := NodeData{Addr: "127.0.0.1:9000", Services: []string{"pkg.Example"}}
+	require.NoError(t, r.Register(context.Background(), "example", "node-1", node))
+	waitEvent(t, events, EventRegistered)
+	assert.True(t, r.Registered())
+	assert.Equal(t, []string{"/qsf.service/example/node-1", "/qsf.service/pkg.Example/node-1"}, s.Keys("/qsf.service/"))
+	assert.Len(t, s.Leases(), 1)
+
+	require.NoError(t, r.Deregister(context.Background()))
+	waitEvent(t, events, EventDeregistered)
+	assert.False(t, r.Registered())
+	assert.Empty(t, s.Keys("/qsf.service/"))
+	assert.Empty(t, s.Leases())
+}
+
+func TestLeaseLost(t *testing.T) {
+	s, cfg := startEtcd(t)
+	defer s.Close()
+	r, err := NewRegistry(Option{EtcdConfig: cfg, RegistryDir: "/qsf.service", Ttl: time.Second, MinRetryInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer r.Close()
+	events := r.Subscribe()
+	require.NoError(t, r.Register(context.Background(), "example", "node-1", NodeData{Addr: "127.0.0.1:9000"}))
+	lease := s.Leases()[0]
+
+	s.ExpireLease(lease)
+	assert.Empty(t, s.Keys("/qsf.service/"))
+	assert.Equal(t, errLeaseLost, waitEvent(t, events, EventLost).Err)
+	waitEvent(t, events, EventRegistered)
+	assert.True(t, r.Registered())
+	assert.Equal(t, []string{"/qsf.service/example/node-1"}, s.Keys("/qsf.service/"))
+	assert.NotEqual(t, []int64{lease}, s.Leases())
+}
+
+func TestEtcdRestart(t *testing.T) {
+	s, cfg := startEtcd(t)
+	defer s.Close()
+	r, err := NewRegistry(Option{EtcdConfig: cfg, RegistryDir: "/qsf.service", Ttl: time.Second, MinRetryInterval: 10 * time.Millisecond, MaxRetryInterval: 100 * time.Millisecond})
+	require.NoError(t, err)
+	defer r.Close()
+	events := r.Subscribe()
+	require.NoError(t, r.Register(context.Background(), "example", "node-1", NodeData{Addr: "127.0.0.1:9000"}))
+
+	// etcd is unreachable for longer than the ttl, so the lease expires
+	s.Stop()
+	waitEvent(t, events, EventLost)
+	assert.False(t, r.Registered())
+	waitEvent(t, events, EventRetryFailed)
+	assert.Empty(t, s.Keys("/qsf.service/"))
+
+	require.NoError(t, s.Start())
+	waitEvent(t, events, EventRegistered)
+	assert.True(t, r.Registered())
+	assert.Equal(t, []string{"/qsf.service/example/node-1"}, s.Keys("/qsf.service/"))
+}
@@ -1,34 +1,168 @@
 package etcd
 
 import (
-	"errors"
-	"fmt"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"time"
 
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry"
 	etcd3 "github.com/coreos/etcd/clientv3"
-	"google.golang.org/grpc/naming"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/grpclog"
 )
 
-// EtcdResolver is an implementation of grpc.naming.Resolver
-type EtcdResolver struct {
-	Config      etcd3.Config
-	RegistryDir string
-	ServiceName string
+// resyncInterval is the wait between two failed attempts to read the nodes.
+const resyncInterval = time.Second
+
+// Discovery watches the nodes registered in etcd by EtcdReigistry.
+type Discovery struct {
+	client      *etcd3.Client
+	registryDir string
+}
+
+func NewDiscovery(registryDir string, cfg etcd3.Config) (*Discovery, error) {
+	client, err := etcd3.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Discovery{client: client, registryDir: registryDir}, nil
+}
+
+func (d *Discovery) Watch(service string) (registry.Watcher, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &watcher{
+		client: d.client,
+		// the trailing slash keeps "example" from matching the nodes of "example2"
+		prefix: d.registryDir + "/" + service + "/",
+		nodes:  make(map[string]NodeData),
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+func (d *Discovery) Close() error {
+	return d.client.Close()
+}
+
+// watcher keeps the nodes of a service by key. It reads them all, then applies the watch events from
+// the next revision on, and reads them all again when the watch fails, e.g. after a compaction.
+type watcher struct {
+	client      *etcd3.Client
+	prefix      string
+	nodes       map[string]NodeData //key -> node
+	rev         int64               //revision of nodes
+	started     bool
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wch         etcd3.WatchChan
+	watchCancel context.CancelFunc
 }
 
-func NewResolver(registryDir, serviceName string, cfg etcd3.Config) naming.Resolver {
-	return &EtcdResolver{RegistryDir: registryDir, ServiceName: serviceName, Config: cfg}
+func (w *watcher) Close() {
+	w.cancel()
 }
 
-// Resolve to resolve the service from etcd
-func (er *EtcdResolver) Resolve(target string) (naming.Watcher, error) {
-	if er.ServiceName == "" {
-		return nil, errors.New("no service name provided")
+func (w *watcher) closed() bool {
+	return w.ctx.Err() != nil || w.client.Ctx().Err() != nil
+}
+
+// Next returns the nodes at once on the first call, then after every watch response or resync that changed them.
+func (w *watcher) Next() ([]NodeData, error) {
+	for {
+		if w.wch == nil {
+			changed, err := w.sync()
+			if err != nil {
+				if w.closed() {
+					return nil, registry.ErrClosed
+				}
+				grpclog.Println("Etcd watcher get key error:", err)
+				select {
+				case <-time.After(resyncInterval):
+					continue
+				case <-w.ctx.Done():
+					return nil, registry.ErrClosed
+				}
+			}
+			if changed || !w.started {
+				w.started = true
+				return w.list(), nil
+			}
+			continue
+		}
+		wresp, ok := <-w.wch
+		if !ok || wresp.Err() != nil {
+			if w.closed() {
+				return nil, registry.ErrClosed
+			}
+			if ok {
+				grpclog.Printf("Etcd watcher of '%s' resyncs at revision %d: %v", w.prefix, w.rev, wresp.Err())
+			}
+			w.watchCancel()
+			w.wch = nil
+			continue
+		}
+		if len(wresp.Events) == 0 {
+			continue
+		}
+		// a response holds every event of a revision, e.g. all keys of a registration or a lease
+		for _, ev := range wresp.Events {
+			switch ev.Type {
+			case mvccpb.PUT:
+				if nodeData, ok := parse(ev.Kv); ok {
+					w.nodes[string(ev.Kv.Key)] = nodeData
+				}
+			case mvccpb.DELETE:
+				// a deleted key carries no value
+				delete(w.nodes, string(ev.Kv.Key))
+			}
+		}
+		w.rev = wresp.Header.Revision
+		return w.list(), nil
 	}
-	client, err := etcd3.New(er.Config)
+}
+
+// sync reads all nodes and watches them from the next revision, it reports whether the nodes changed.
+func (w *watcher) sync() (bool, error) {
+	resp, err := w.client.Get(w.ctx, w.prefix, etcd3.WithPrefix())
 	if err != nil {
-		return nil, err
+		return false, err
+	}
+	nodes := make(map[string]NodeData, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		if nodeData, ok := parse(kv); ok {
+			nodes[string(kv.Key)] = nodeData
+		}
 	}
+	changed := !reflect.DeepEqual(nodes, w.nodes)
+	w.nodes = nodes
+	w.rev = resp.Header.Revision
+	var ctx context.Context
+	ctx, w.watchCancel = context.WithCancel(w.ctx)
+	w.wch = w.client.Watch(ctx, w.prefix, etcd3.WithPrefix(), etcd3.WithRev(w.rev+1))
+	return changed, nil
+}
+
+func parse(kv *mvccpb.KeyValue) (NodeData, bool) {
+	var nodeData NodeData
+	if err := json.Unmarshal(kv.Value, &nodeData); err != nil {
+		grpclog.Println("Parse node data error:", err)
+		return nodeData, false
+	}
+	return nodeData, true
+}
 
-	key := fmt.Sprintf("%s/%s", er.RegistryDir, er.ServiceName)
-	return newEtcdWatcher(key, client), nil
+// list returns the nodes sorted by key.
+func (w *watcher) list() []NodeData {
+	keys := make([]string, 0, len(w.nodes))
+	for key := range w.nodes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	nodes := make([]NodeData, 0, len(keys))
+	for _, key := range keys {
+		nodes = append(nodes, w.nodes[key])
+	}
+	return nodes
 }
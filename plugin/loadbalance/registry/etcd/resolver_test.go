@@ -0,0 +1,120 @@
+package etcd
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/chuangyou/qsf/internal/etcdtest"
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry"
+	etcd3 "github.com/coreos/etcd/clientv3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func nodeValue(t *testing.T, addr string) string {
+	val, err := json.Marshal(NodeData{Addr: addr})
+	require.NoError(t, err)
+	return string(val)
+}
+
+// nextAddrs waits for the next nodes of w and returns their addresses.
+func nextAddrs(t *testing.T, w registry.Watcher) []string {
+	type result struct {
+		nodes []NodeData
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		nodes, err := w.Next()
+		ch <- result{nodes, err}
+	}()
+	select {
+	case r := <-ch:
+		require.NoError(t, r.err)
+		addrs := make([]string, 0, len(r.nodes))
+		for _, node := range r.nodes {
+			addrs = append(addrs, node.Addr)
+		}
+		return addrs
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for nodes")
+	}
+	return nil
+}
+
+func startWatch(t *testing.T) (*etcdtest.Server, *etcd3.Client, registry.Watcher, func()) {
+	s, cfg := startEtcd(t)
+	d, err := NewDiscovery("/qsf.service", cfg)
+	require.NoError(t, err)
+	client, err := etcd3.New(cfg)
+	require.NoError(t, err)
+	w, err := d.Watch("example")
+	require.NoError(t, err)
+	return s, client, w, func() {
+		w.Close()
+		client.Close()
+		d.Close()
+		s.Close()
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s, client, w, stop := startWatch(t)
+	defer stop()
+	ctx := context.Background()
+	s.Put("/qsf.service/example/node-1", nodeValue(t, "127.0.0.1:9001"))
+	s.Put("/qsf.service/example2/node-1", nodeValue(t, "127.0.0.1:9100"))
+
+	assert.Equal(t, []string{"127.0.0.1:9001"}, nextAddrs(t, w))
+
+	_, err := client.Put(ctx, "/qsf.service/example/node-2", nodeValue(t, "127.0.0.1:9002"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:9001", "127.0.0.1:9002"}, nextAddrs(t, w))
+
+	// the keys written in one txn come in one update
+	_, err = client.Txn(ctx).Then(
+		etcd3.OpDelete("/qsf.service/example/node-1"),
+		etcd3.OpPut("/qsf.service/example/node-3", nodeValue(t, "127.0.0.1:9003")),
+	).Commit()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:9002", "127.0.0.1:9003"}, nextAddrs(t, w))
+
+	_, err = client.Delete(ctx, "/qsf.service/example/", etcd3.WithPrefix())
+	require.NoError(t, err)
+	assert.Empty(t, nextAddrs(t, w))
+
+	w.Close()
+	_, err = w.Next()
+	assert.Equal(t, registry.ErrClosed, err)
+}
+
+func TestWatchReconnect(t *testing.T) {
+	s, _, w, stop := startWatch(t)
+	defer stop()
+	s.Put("/qsf.service/example/node-1", nodeValue(t, "127.0.0.1:9001"))
+	assert.Equal(t, []string{"127.0.0.1:9001"}, nextAddrs(t, w))
+
+	// the changes made while the watcher is disconnected are received once it connects again
+	s.Stop()
+	s.Put("/qsf.service/example/node-2", nodeValue(t, "127.0.0.1:9002"))
+	require.NoError(t, s.Start())
+	assert.Equal(t, []string{"127.0.0.1:9001", "127.0.0.1:9002"}, nextAddrs(t, w))
+}
+
+func TestWatchCompacted(t *testing.T) {
+	s, _, w, stop := startWatch(t)
+	defer stop()
+	s.Put("/qsf.service/example/node-1", nodeValue(t, "127.0.0.1:9001"))
+	s.Put("/qsf.service/example/node-2", nodeValue(t, "127.0.0.1:9002"))
+	assert.Equal(t, []string{"127.0.0.1:9001", "127.0.0.1:9002"}, nextAddrs(t, w))
+
+	// the events missed while disconnected are compacted, so the watcher reads the nodes again
+	s.Stop()
+	s.Put("/qsf.service/example/node-3", nodeValue(t, "127.0.0.1:9003"))
+	s.Delete("/qsf.service/example/node-1")
+	s.Compact(s.Revision())
+	require.NoError(t, s.Start())
+	assert.Equal(t, []string{"127.0.0.1:9002", "127.0.0.1:9003"}, nextAddrs(t, w))
+}
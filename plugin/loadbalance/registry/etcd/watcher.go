@@ -1,112 +0,0 @@
-package etcd
-
-import (
-	"encoding/json"
-
-	etcd3 "github.com/coreos/etcd/clientv3"
-	"github.com/coreos/etcd/mvcc/mvccpb"
-	"golang.org/x/net/context"
-	"google.golang.org/grpc/grpclog"
-	"google.golang.org/grpc/naming"
-)
-
-// EtcdWatcher is the implementation of grpc.naming.Watcher
-type EtcdWatcher struct {
-	key           string
-	client        *etcd3.Client
-	ctx           context.Context
-	cancel        context.CancelFunc
-	isInitialized bool
-}
-
-func (w *EtcdWatcher) Close() {
-	w.cancel()
-}
-
-func newEtcdWatcher(key string, cli *etcd3.Client) naming.Watcher {
-	ctx, cancel := context.WithCancel(context.Background())
-	w := &EtcdWatcher{
-		key:    key,
-		client: cli,
-		ctx:    ctx,
-		//updates: make([]*naming.Update, 0),
-		cancel: cancel,
-	}
-	return w
-}
-
-func (w *EtcdWatcher) Next() ([]*naming.Update, error) {
-	// check if is initialized
-	//updates := make([]*naming.Update, 0)
-	if !w.isInitialized {
-		// query addresses from etcd
-		resp, err := w.client.Get(w.ctx, w.key, etcd3.WithPrefix())
-		if err == nil {
-			addrs := extractAddrs(resp)
-			if len(addrs) > 0 {
-				updates := make([]*naming.Update, 0)
-				for _, addr := range addrs {
-					v := addr
-					updates = append(updates, &naming.Update{Op: naming.Add, Addr: v.Addr, Metadata: &v.Metadata})
-				}
-				//w.updates = updates
-				w.isInitialized = true
-				return updates, nil
-			}
-		} else {
-			grpclog.Println("Etcd Watcher Get key error:", err)
-		}
-	}
-	//generate etcd Watcher
-	rch := w.client.Watch(w.ctx, w.key, etcd3.WithPrefix())
-	for wresp := range rch {
-		for _, ev := range wresp.Events {
-			switch ev.Type {
-			case mvccpb.PUT:
-				nodeData := NodeData{}
-				err := json.Unmarshal([]byte(ev.Kv.Value), &nodeData)
-				if err != nil {
-					grpclog.Println("Parse node data error:", err)
-					continue
-				}
-				return []*naming.Update{{Op: naming.Add,
-					Addr:     nodeData.Addr,
-					Metadata: &nodeData.Metadata}}, nil
-			case mvccpb.DELETE:
-				nodeData := NodeData{}
-				err := json.Unmarshal([]byte(ev.Kv.Value), &nodeData)
-				if err != nil {
-					grpclog.Println("Parse node data error:", err)
-					continue
-				}
-				return []*naming.Update{{Op: naming.Delete,
-					Addr:     nodeData.Addr,
-					Metadata: &nodeData.Metadata}}, nil
-			}
-		}
-	}
-	return nil, nil
-
-}
-
-func extractAddrs(resp *etcd3.GetResponse) []NodeData {
-	addrs := []NodeData{}
-
-	if resp == nil || resp.Kvs == nil {
-		return addrs
-	}
-
-	for i := range resp.Kvs {
-		if v := resp.Kvs[i].Value; v != nil {
-			nodeData := NodeData{}
-			err := json.Unmarshal(v, &nodeData)
-			if err != nil {
-				grpclog.Println("Parse node data error:", err)
-				continue
-			}
-			addrs = append(addrs, nodeData)
-		}
-	}
-
-	return addrs
-}
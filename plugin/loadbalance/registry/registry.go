@@ -0,0 +1,130 @@
+// Package registry defines how qsf nodes are registered and discovered. A backend (etcd, consul,
+// zookeeper, dns, static) implements Registry for servers and Discovery for clients, and registers
+// itself by name with RegisterBackend from its init function.
+package registry
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	ErrUnknownBackend = errors.New("unknown registry backend")
+	ErrNoAddrs        = errors.New("no registry address provided")
+	ErrClosed         = errors.New("registry watcher closed")
+)
+
+// NodeData is the value registered for a node. Besides the qsf service name, the node is registered under
+// every protobuf service name in Services, so clients can resolve either name.
+type NodeData struct {
+	Addr     string
+	Services []string          //节点提供的protobuf服务全名
+	Version  string            //服务版本
+	Region   string            //节点所在地域
+	Zone     string            //节点所在可用区
+	Tags     []string          //服务标签
+	Metadata map[string]string //自定义元数据
+}
+
+// Registry registers a server node.
+type Registry interface {
+	// Register registers node under service and every name of node.Services, and keeps it registered
+	// until Deregister is called. Registering again replaces the previous registration.
+	Register(ctx context.Context, service, nodeID string, node NodeData) error
+	// Deregister removes the node registered last, it does nothing when no node is registered.
+	Deregister(ctx context.Context) error
+	Close() error
+}
+
+// Discovery watches the nodes of services.
+type Discovery interface {
+	Watch(service string) (Watcher, error)
+	Close() error
+}
+
+// Watcher follows the nodes of one service.
+type Watcher interface {
+	// Next returns the current nodes at once on the first call, then blocks until they change.
+	// It returns ErrClosed after Close, Next may be called again after any other error.
+	Next() ([]NodeData, error)
+	Close()
+}
+
+// Backend creates the registry and the discovery of one kind from the registry addresses.
+type Backend interface {
+	NewRegistry(addrs []string) (Registry, error)
+	NewDiscovery(addrs []string) (Discovery, error)
+}
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]Backend)
+)
+
+// RegisterBackend makes a backend available by name, registering a name twice replaces the backend.
+func RegisterBackend(name string, backend Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends[name] = backend
+}
+
+// Backends returns the sorted names of the registered backends.
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func backend(kind string) (Backend, error) {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	backend, ok := backends[kind]
+	if !ok {
+		return nil, ErrUnknownBackend
+	}
+	return backend, nil
+}
+
+// NewRegistry returns the registry of the backend kind.
+func NewRegistry(kind string, addrs []string) (Registry, error) {
+	backend, err := backend(kind)
+	if err != nil {
+		return nil, err
+	}
+	return backend.NewRegistry(addrs)
+}
+
+// NewDiscovery returns the discovery of the backend kind.
+func NewDiscovery(kind string, addrs []string) (Discovery, error) {
+	backend, err := backend(kind)
+	if err != nil {
+		return nil, err
+	}
+	return backend.NewDiscovery(addrs)
+}
+
+// Nop is a Registry that registers nothing, for backends where nodes are not registered by the server.
+type Nop struct{}
+
+func (Nop) Register(ctx context.Context, service, nodeID string, node NodeData) error { return nil }
+func (Nop) Deregister(ctx context.Context) error                                      { return nil }
+func (Nop) Close() error                                                              { return nil }
+
+// Names returns service followed by the other names in node.Services, the names a node is registered under.
+func Names(service string, node NodeData) []string {
+	names := []string{service}
+	for _, name := range node.Services {
+		if name != service {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,119 @@
+package registry
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/resolver"
+)
+
+// fakeDiscovery hands out one watcher sending the node lists written to updates.
+type fakeDiscovery struct {
+	updates chan []NodeData
+	closed  chan struct{}
+	service string
+}
+
+func (d *fakeDiscovery) Watch(service string) (Watcher, error) {
+	d.service = service
+	return fakeWatcher{d}, nil
+}
+
+func (d *fakeDiscovery) Close() error { return nil }
+
+type fakeWatcher struct {
+	d *fakeDiscovery
+}
+
+func (w fakeWatcher) Next() ([]NodeData, error) {
+	select {
+	case nodes := <-w.d.updates:
+		if nodes == nil {
+			return nil, errors.New("watch error")
+		}
+		return nodes, nil
+	case <-w.d.closed:
+		return nil, ErrClosed
+	}
+}
+
+func (w fakeWatcher) Close() { close(w.d.closed) }
+
+type fakeClientConn struct {
+	addrs chan []resolver.Address
+}
+
+func (cc *fakeClientConn) NewAddress(addrs []resolver.Address)   { cc.addrs <- addrs }
+func (cc *fakeClientConn) NewServiceConfig(serviceConfig string) {}
+
+type discoveryFunc func(addrs []string) (Discovery, error)
+
+func (f discoveryFunc) NewRegistry(addrs []string) (Registry, error)   { return Nop{}, nil }
+func (f discoveryFunc) NewDiscovery(addrs []string) (Discovery, error) { return f(addrs) }
+
+func TestResolver(t *testing.T) {
+	d := &fakeDiscovery{updates: make(chan []NodeData), closed: make(chan struct{})}
+	RegisterBackend("fake", discoveryFunc(func(addrs []string) (Discovery, error) { return d, nil }))
+	assert.Contains(t, Backends(), "fake")
+	discovery, err := NewDiscovery("fake", nil)
+	require.NoError(t, err)
+
+	cc := &fakeClientConn{addrs: make(chan []resolver.Address, 1)}
+	r, err := NewResolverBuilder(discovery).Build(resolver.Target{Scheme: Scheme, Endpoint: "example"}, cc, resolver.BuildOption{})
+	require.NoError(t, err)
+	assert.Equal(t, "example", d.service)
+
+	d.updates <- []NodeData{{Addr: "b:1", Zone: "z1"}, {Addr: "a:1"}}
+	select {
+	case addrs := <-cc.addrs:
+		require.Len(t, addrs, 2)
+		assert.Equal(t, "a:1", addrs[0].Addr)
+		assert.Equal(t, &NodeData{Addr: "b:1", Zone: "z1"}, addrs[1].Metadata)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for addresses")
+	}
+	// the resolver keeps watching after an error
+	d.updates <- nil
+	d.updates <- []NodeData{{Addr: "c:1"}}
+	select {
+	case addrs := <-cc.addrs:
+		require.Len(t, addrs, 1)
+		assert.Equal(t, "c:1", addrs[0].Addr)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for addresses")
+	}
+	d.updates <- nil
+	r.Close()
+
+	_, err = NewResolverBuilder(discovery).Build(resolver.Target{Scheme: Scheme}, cc, resolver.BuildOption{})
+	assert.Equal(t, errNoServiceName, err)
+	_, err = NewRegistry("unknown", nil)
+	assert.Equal(t, ErrUnknownBackend, err)
+}
+
+func TestResolverAuthority(t *testing.T) {
+	assert.Equal(t, "qsf:///example", Target("example"))
+	assert.Equal(t, "qsf://etcd-1/example", AuthorityTarget("etcd-1", "example"))
+
+	b := NewResolverBuilder(nil)
+	d := &fakeDiscovery{updates: make(chan []NodeData), closed: make(chan struct{})}
+	b.Add("etcd-1", d)
+	cc := &fakeClientConn{addrs: make(chan []resolver.Address, 1)}
+	r, err := b.Build(resolver.Target{Scheme: Scheme, Authority: "etcd-1", Endpoint: "example"}, cc, resolver.BuildOption{})
+	require.NoError(t, err)
+	assert.Equal(t, "example", d.service)
+	r.Close()
+
+	_, err = b.Build(resolver.Target{Scheme: Scheme, Authority: "etcd-2", Endpoint: "example"}, cc, resolver.BuildOption{})
+	assert.Equal(t, errNoDiscovery, err)
+	b.Remove("etcd-1")
+	_, err = b.Build(resolver.Target{Scheme: Scheme, Authority: "etcd-1", Endpoint: "example"}, cc, resolver.BuildOption{})
+	assert.Equal(t, errNoDiscovery, err)
+}
+
+func TestNames(t *testing.T) {
+	assert.Equal(t, []string{"example", "pkg.Example"}, Names("example", NodeData{Services: []string{"example", "pkg.Example"}}))
+}
@@ -0,0 +1,149 @@
+package registry
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cenk/backoff"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/resolver"
+)
+
+// Scheme is the target scheme of the qsf resolver, as in "qsf:///example" or "qsf://<authority>/example".
+const Scheme = "qsf"
+
+// watchRetryInterval is the first wait before watching again after an error.
+const watchRetryInterval = 100 * time.Millisecond
+
+var (
+	errNoServiceName = errors.New("no service name provided")
+	errNoDiscovery   = errors.New("no discovery for the target authority")
+	// DefaultResolver is the resolver registered for Scheme. Clients add the discovery of each registry
+	// under an authority of its own, so that clients on different registries coexist in a process.
+	DefaultResolver = NewResolverBuilder(nil)
+)
+
+func init() {
+	resolver.Register(DefaultResolver)
+}
+
+// Target returns the dial target of serviceName, which is either the qsf service name or a protobuf service full name.
+// It is resolved by the Discovery of DefaultResolver.
+func Target(serviceName string) string {
+	return AuthorityTarget("", serviceName)
+}
+
+// AuthorityTarget returns the dial target of serviceName resolved by the discovery added for authority.
+func AuthorityTarget(authority, serviceName string) string {
+	return Scheme + "://" + authority + "/" + serviceName
+}
+
+// ResolverBuilder is a resolver.Builder resolving "qsf://<authority>/<service>" targets to the nodes of the
+// discovery added for the authority, or of Discovery for the other authorities such as "qsf:///<service>".
+// Every address carries the *NodeData of its node as Metadata.
+type ResolverBuilder struct {
+	Discovery   Discovery
+	mu          sync.RWMutex
+	discoveries map[string]Discovery
+}
+
+func NewResolverBuilder(discovery Discovery) *ResolverBuilder {
+	return &ResolverBuilder{Discovery: discovery, discoveries: make(map[string]Discovery)}
+}
+
+// Add resolves the targets of authority with discovery, from the next dial on.
+func (b *ResolverBuilder) Add(authority string, discovery Discovery) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.discoveries[authority] = discovery
+}
+
+// Remove stops resolving the targets of authority, the resolvers already built keep watching.
+func (b *ResolverBuilder) Remove(authority string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.discoveries, authority)
+}
+
+func (b *ResolverBuilder) Scheme() string {
+	return Scheme
+}
+
+// Build watches the nodes of target.Endpoint until the resolver is closed.
+func (b *ResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOption) (resolver.Resolver, error) {
+	if target.Endpoint == "" {
+		return nil, errNoServiceName
+	}
+	b.mu.RLock()
+	discovery, ok := b.discoveries[target.Authority]
+	b.mu.RUnlock()
+	if !ok {
+		discovery = b.Discovery
+	}
+	if discovery == nil {
+		return nil, errNoDiscovery
+	}
+	watcher, err := discovery.Watch(target.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	r := &discoveryResolver{watcher: watcher, cc: cc, closed: make(chan struct{})}
+	r.wg.Add(1)
+	go r.watch()
+	return r, nil
+}
+
+type discoveryResolver struct {
+	watcher Watcher
+	cc      resolver.ClientConn
+	closed  chan struct{}
+	wg      sync.WaitGroup
+}
+
+func (r *discoveryResolver) ResolveNow(opt resolver.ResolveNowOption) {}
+
+func (r *discoveryResolver) Close() {
+	close(r.closed)
+	r.watcher.Close()
+	r.wg.Wait()
+}
+
+// watch follows the nodes until the resolver is closed, the watch is retried with backoff after an error
+// and the last nodes stay in use meanwhile.
+func (r *discoveryResolver) watch() {
+	defer r.wg.Done()
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = watchRetryInterval
+	b.MaxElapsedTime = 0
+	b.Reset()
+	for {
+		nodes, err := r.watcher.Next()
+		if err == ErrClosed {
+			return
+		}
+		if err != nil {
+			grpclog.Println("Registry resolver watch error:", err)
+			select {
+			case <-time.After(b.NextBackOff()):
+			case <-r.closed:
+				return
+			}
+			continue
+		}
+		b.Reset()
+		r.cc.NewAddress(Addresses(nodes))
+	}
+}
+
+// Addresses converts nodes to resolver addresses sorted by address.
+func Addresses(nodes []NodeData) []resolver.Address {
+	addrs := make([]resolver.Address, 0, len(nodes))
+	for i := range nodes {
+		nodeData := nodes[i]
+		addrs = append(addrs, resolver.Address{Addr: nodeData.Addr, Metadata: &nodeData})
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Addr < addrs[j].Addr })
+	return addrs
+}
@@ -0,0 +1,101 @@
+// Package static is the registry backend on a fixed list of addresses: every service resolves to the
+// registry addresses and servers register nothing. It also resolves "qsf-static:///<addr>,<addr>"
+// targets for clients connecting to the nodes directly.
+package static
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry"
+	"google.golang.org/grpc/resolver"
+)
+
+const (
+	// Kind is the name of the static backend.
+	Kind = "static"
+	// Scheme is the target scheme of the direct-connect resolver.
+	Scheme = "qsf-static"
+)
+
+func init() {
+	registry.RegisterBackend(Kind, backend{})
+	resolver.Register(resolverBuilder{})
+}
+
+// Target returns the dial target resolving to addrs.
+func Target(addrs ...string) string {
+	return Scheme + ":///" + strings.Join(addrs, ",")
+}
+
+// resolverBuilder resolves the comma separated addresses of the target endpoint.
+type resolverBuilder struct{}
+
+func (resolverBuilder) Scheme() string {
+	return Scheme
+}
+
+func (resolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOption) (resolver.Resolver, error) {
+	discovery, err := backend{}.NewDiscovery(strings.Split(target.Endpoint, ","))
+	if err != nil {
+		return nil, err
+	}
+	return registry.NewResolverBuilder(discovery).Build(target, cc, opts)
+}
+
+type backend struct{}
+
+func (backend) NewRegistry(addrs []string) (registry.Registry, error) {
+	return registry.Nop{}, nil
+}
+
+func (backend) NewDiscovery(addrs []string) (registry.Discovery, error) {
+	nodes := make([]registry.NodeData, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			nodes = append(nodes, registry.NodeData{Addr: addr})
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, registry.ErrNoAddrs
+	}
+	return NewDiscovery(nodes...), nil
+}
+
+// Discovery resolves every service to the same nodes.
+type Discovery struct {
+	nodes []registry.NodeData
+}
+
+func NewDiscovery(nodes ...registry.NodeData) *Discovery {
+	return &Discovery{nodes: nodes}
+}
+
+func (d *Discovery) Watch(service string) (registry.Watcher, error) {
+	return &watcher{nodes: d.nodes, closed: make(chan struct{})}, nil
+}
+
+func (d *Discovery) Close() error {
+	return nil
+}
+
+type watcher struct {
+	nodes     []registry.NodeData
+	sent      bool
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Next returns the nodes on the first call, then blocks until Close.
+func (w *watcher) Next() ([]registry.NodeData, error) {
+	if !w.sent {
+		w.sent = true
+		return w.nodes, nil
+	}
+	<-w.closed
+	return nil, registry.ErrClosed
+}
+
+func (w *watcher) Close() {
+	w.closeOnce.Do(func() { close(w.closed) })
+}
@@ -0,0 +1,30 @@
+package static
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatch(t *testing.T) {
+	d, err := registry.NewDiscovery(Kind, []string{"127.0.0.1:9000", "127.0.0.1:9001"})
+	require.NoError(t, err)
+	w, err := d.Watch("example")
+	require.NoError(t, err)
+	nodes, err := w.Next()
+	require.NoError(t, err)
+	assert.Equal(t, []registry.NodeData{{Addr: "127.0.0.1:9000"}, {Addr: "127.0.0.1:9001"}}, nodes)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		w.Close()
+	}()
+	_, err = w.Next()
+	assert.Equal(t, registry.ErrClosed, err)
+
+	_, err = registry.NewDiscovery(Kind, nil)
+	assert.Equal(t, registry.ErrNoAddrs, err)
+}
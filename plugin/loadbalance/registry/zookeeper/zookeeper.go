@@ -0,0 +1,275 @@
+// Package zookeeper is the registry backend on ZooKeeper. A node is an ephemeral znode
+// "<root>/<service>/<nodeID>" holding its json NodeData, one per name it is registered under, and
+// clients follow the children of "<root>/<service>".
+package zookeeper
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chuangyou/qsf/constant"
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry"
+	"github.com/samuel/go-zookeeper/zk"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/grpclog"
+)
+
+const (
+	// Kind is the name of the zookeeper backend.
+	Kind = "zookeeper"
+	//会话超时时间，超时后临时节点被删除
+	DefaultSessionTimeout = 10 * time.Second
+
+	retryBackoff = time.Second
+)
+
+func init() {
+	registry.RegisterBackend(Kind, backend{})
+}
+
+type backend struct{}
+
+func (backend) NewRegistry(addrs []string) (registry.Registry, error) {
+	if len(addrs) == 0 {
+		return nil, registry.ErrNoAddrs
+	}
+	conn, events, err := zk.Connect(addrs, DefaultSessionTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return NewRegistry(conn, events, constant.DEFAULT_ETCD_PATH), nil
+}
+
+func (backend) NewDiscovery(addrs []string) (registry.Discovery, error) {
+	if len(addrs) == 0 {
+		return nil, registry.ErrNoAddrs
+	}
+	conn, _, err := zk.Connect(addrs, DefaultSessionTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return NewDiscovery(conn, constant.DEFAULT_ETCD_PATH), nil
+}
+
+// Conn is the part of *zk.Conn used by the backend.
+type Conn interface {
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	Delete(path string, version int32) error
+	Get(path string) ([]byte, *zk.Stat, error)
+	Exists(path string) (bool, *zk.Stat, error)
+	ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error)
+	ExistsW(path string) (bool, *zk.Stat, <-chan zk.Event, error)
+	SessionID() int64
+	Close()
+}
+
+// Registry creates the ephemeral znodes of a node, and creates them again when the session expired.
+type Registry struct {
+	conn      Conn
+	root      string
+	mu        sync.Mutex
+	nodes     map[string][]byte //path -> data
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewRegistry returns a registry on conn, events are the session events of conn.
+func NewRegistry(conn Conn, events <-chan zk.Event, root string) *Registry {
+	r := &Registry{conn: conn, root: root, nodes: make(map[string][]byte), done: make(chan struct{})}
+	go r.watchSession(events)
+	return r
+}
+
+func (r *Registry) watchSession(events <-chan zk.Event) {
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if ev.Type == zk.EventSession && ev.State == zk.StateHasSession {
+				r.mu.Lock()
+				for path, data := range r.nodes {
+					//a reconnect within the session keeps the znodes, only a new session needs them again
+					if r.owned(path) {
+						continue
+					}
+					if err := r.create(path, data); err != nil {
+						grpclog.Printf("grpclb: create znode '%s' failed: %s", path, err.Error())
+					}
+				}
+				r.mu.Unlock()
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// owned reports whether the ephemeral znode exists and belongs to the current session.
+func (r *Registry) owned(path string) bool {
+	exists, stat, err := r.conn.Exists(path)
+	return err == nil && exists && stat.EphemeralOwner == r.conn.SessionID()
+}
+
+// create creates the ephemeral znode and its missing parents. A znode left by a previous session of the
+// node is replaced.
+func (r *Registry) create(path string, data []byte) error {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i := 1; i < len(parts); i++ {
+		parent := "/" + strings.Join(parts[:i], "/")
+		if _, err := r.conn.Create(parent, nil, 0, zk.WorldACL(zk.PermAll)); err != nil && err != zk.ErrNodeExists {
+			return err
+		}
+	}
+	_, err := r.conn.Create(path, data, zk.FlagEphemeral, zk.WorldACL(zk.PermAll))
+	if err == zk.ErrNodeExists {
+		if err = r.conn.Delete(path, -1); err != nil && err != zk.ErrNoNode {
+			return err
+		}
+		_, err = r.conn.Create(path, data, zk.FlagEphemeral, zk.WorldACL(zk.PermAll))
+	}
+	return err
+}
+
+func (r *Registry) Register(ctx context.Context, service, nodeID string, node registry.NodeData) error {
+	data, err := json.Marshal(node)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err = r.deregister(); err != nil {
+		return err
+	}
+	for _, name := range registry.Names(service, node) {
+		path := r.root + "/" + name + "/" + nodeID
+		r.nodes[path] = data
+		if err = r.create(path, data); err != nil {
+			r.deregister()
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Registry) Deregister(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.deregister()
+}
+
+func (r *Registry) deregister() error {
+	for path := range r.nodes {
+		if err := r.conn.Delete(path, -1); err != nil && err != zk.ErrNoNode {
+			return err
+		}
+		delete(r.nodes, path)
+	}
+	return nil
+}
+
+func (r *Registry) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.conn.Close()
+	})
+	return nil
+}
+
+// Discovery follows the children of "<root>/<service>".
+type Discovery struct {
+	conn Conn
+	root string
+}
+
+func NewDiscovery(conn Conn, root string) *Discovery {
+	return &Discovery{conn: conn, root: root}
+}
+
+func (d *Discovery) Watch(service string) (registry.Watcher, error) {
+	return &watcher{conn: d.conn, path: d.root + "/" + service, closed: make(chan struct{})}, nil
+}
+
+func (d *Discovery) Close() error {
+	d.conn.Close()
+	return nil
+}
+
+type watcher struct {
+	conn      Conn
+	path      string
+	ch        <-chan zk.Event //the watch set by the last list
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (w *watcher) Close() {
+	w.closeOnce.Do(func() { close(w.closed) })
+}
+
+func (w *watcher) Next() ([]registry.NodeData, error) {
+	for {
+		if w.ch != nil {
+			select {
+			case <-w.ch:
+			case <-w.closed:
+				return nil, registry.ErrClosed
+			}
+		}
+		nodes, ch, err := w.list()
+		if err != nil {
+			grpclog.Println("Zookeeper watch service error:", err)
+			select {
+			case <-time.After(retryBackoff):
+				continue
+			case <-w.closed:
+				return nil, registry.ErrClosed
+			}
+		}
+		w.ch = ch
+		return nodes, nil
+	}
+}
+
+// list returns the nodes sorted by znode name and a watch firing when they change.
+func (w *watcher) list() ([]registry.NodeData, <-chan zk.Event, error) {
+	for {
+		children, _, ch, err := w.conn.ChildrenW(w.path)
+		if err == zk.ErrNoNode {
+			// no node has registered the service yet
+			exists, _, ech, err := w.conn.ExistsW(w.path)
+			if err != nil {
+				return nil, nil, err
+			}
+			if exists {
+				continue
+			}
+			return nil, ech, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		sort.Strings(children)
+		nodes := make([]registry.NodeData, 0, len(children))
+		for _, child := range children {
+			data, _, err := w.conn.Get(w.path + "/" + child)
+			if err == zk.ErrNoNode {
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			var nodeData registry.NodeData
+			if err := json.Unmarshal(data, &nodeData); err != nil {
+				grpclog.Println("Parse node data error:", err)
+				continue
+			}
+			nodes = append(nodes, nodeData)
+		}
+		return nodes, ch, nil
+	}
+}
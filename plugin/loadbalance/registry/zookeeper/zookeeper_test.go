@@ -0,0 +1,262 @@
+package zookeeper
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry"
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// fakeConn is an in-memory znode tree with one-shot child and exists watches.
+type fakeConn struct {
+	mu         sync.Mutex
+	nodes      map[string][]byte
+	owners     map[string]int64 //ephemeral znode -> session
+	session    int64
+	creates    int
+	childWatch map[string][]chan zk.Event
+	existWatch map[string][]chan zk.Event
+	events     chan zk.Event
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		nodes:      map[string][]byte{"/": nil},
+		owners:     make(map[string]int64),
+		session:    1,
+		childWatch: make(map[string][]chan zk.Event),
+		existWatch: make(map[string][]chan zk.Event),
+		events:     make(chan zk.Event, 1),
+	}
+}
+
+// fire must be called with c.mu held.
+func (c *fakeConn) fire(watches map[string][]chan zk.Event, p string, typ zk.EventType) {
+	for _, ch := range watches[p] {
+		ch <- zk.Event{Type: typ, Path: p}
+	}
+	delete(watches, p)
+}
+
+func (c *fakeConn) Create(p string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.nodes[p]; ok {
+		return "", zk.ErrNodeExists
+	}
+	if _, ok := c.nodes[path.Dir(p)]; !ok {
+		return "", zk.ErrNoNode
+	}
+	c.nodes[p] = data
+	if flags&zk.FlagEphemeral != 0 {
+		c.owners[p] = c.session
+		c.creates++
+	}
+	c.fire(c.existWatch, p, zk.EventNodeCreated)
+	c.fire(c.childWatch, path.Dir(p), zk.EventNodeChildrenChanged)
+	return p, nil
+}
+
+func (c *fakeConn) Delete(p string, version int32) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.delete(p)
+}
+
+func (c *fakeConn) delete(p string) error {
+	if _, ok := c.nodes[p]; !ok {
+		return zk.ErrNoNode
+	}
+	delete(c.nodes, p)
+	delete(c.owners, p)
+	c.fire(c.childWatch, path.Dir(p), zk.EventNodeChildrenChanged)
+	return nil
+}
+
+func (c *fakeConn) Get(p string) ([]byte, *zk.Stat, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.nodes[p]
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	return data, &zk.Stat{}, nil
+}
+
+func (c *fakeConn) Exists(p string) (bool, *zk.Stat, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.nodes[p]
+	return ok, &zk.Stat{EphemeralOwner: c.owners[p]}, nil
+}
+
+func (c *fakeConn) ChildrenW(p string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.nodes[p]; !ok {
+		return nil, nil, nil, zk.ErrNoNode
+	}
+	var children []string
+	for node := range c.nodes {
+		if node != "/" && path.Dir(node) == p {
+			children = append(children, path.Base(node))
+		}
+	}
+	ch := make(chan zk.Event, 1)
+	c.childWatch[p] = append(c.childWatch[p], ch)
+	return children, &zk.Stat{}, ch, nil
+}
+
+func (c *fakeConn) ExistsW(p string) (bool, *zk.Stat, <-chan zk.Event, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.nodes[p]
+	ch := make(chan zk.Event, 1)
+	c.existWatch[p] = append(c.existWatch[p], ch)
+	return ok, &zk.Stat{}, ch, nil
+}
+
+func (c *fakeConn) SessionID() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.session
+}
+
+func (c *fakeConn) Close() {}
+
+// expire starts a new session, dropping the ephemeral znodes of the old one unless keep, then reports
+// it and returns once the registry handled the event.
+func (c *fakeConn) expire(keep bool) {
+	c.mu.Lock()
+	c.session++
+	if !keep {
+		for p := range c.owners {
+			c.delete(p)
+		}
+	}
+	c.mu.Unlock()
+	c.reconnect()
+}
+
+// reconnect reports a session and returns once the registry handled the event: the events channel
+// holds one event, so the second following event is only taken after the first one was handled.
+func (c *fakeConn) reconnect() {
+	c.events <- zk.Event{Type: zk.EventSession, State: zk.StateHasSession}
+	c.events <- zk.Event{Type: zk.EventSession, State: zk.StateConnecting}
+	c.events <- zk.Event{Type: zk.EventSession, State: zk.StateConnecting}
+}
+
+func (c *fakeConn) stat() (creates int, owners map[string]int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	owners = make(map[string]int64)
+	for p, owner := range c.owners {
+		owners[p] = owner
+	}
+	return c.creates, owners
+}
+
+func (c *fakeConn) paths(prefix string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var paths []string
+	for p := range c.nodes {
+		if strings.HasPrefix(p, prefix) {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+func next(t *testing.T, w registry.Watcher) []registry.NodeData {
+	ch := make(chan []registry.NodeData, 1)
+	go func() {
+		nodes, err := w.Next()
+		assert.NoError(t, err)
+		ch <- nodes
+	}()
+	select {
+	case nodes := <-ch:
+		return nodes
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for nodes")
+		return nil
+	}
+}
+
+func TestRegisterAndWatch(t *testing.T) {
+	conn := newFakeConn()
+	r := NewRegistry(conn, conn.events, "/qsf.service")
+	d := NewDiscovery(conn, "/qsf.service")
+	w, err := d.Watch("example")
+	require.NoError(t, err)
+	defer w.Close()
+	assert.Empty(t, next(t, w))
+
+	node := registry.NodeData{Addr: "127.0.0.1:9000", Services: []string{"pkg.Example"}, Version: "v1"}
+	require.NoError(t, r.Register(context.Background(), "example", "node-1", node))
+	assert.Equal(t, []registry.NodeData{node}, next(t, w))
+	assert.Len(t, conn.paths("/qsf.service/pkg.Example/"), 1)
+
+	require.NoError(t, r.Register(context.Background(), "example", "node-2", registry.NodeData{Addr: "127.0.0.1:9001"}))
+	nodes := next(t, w)
+	for len(nodes) != 1 || nodes[0].Addr != "127.0.0.1:9001" {
+		// the old znode is deleted before the new one is created
+		nodes = next(t, w)
+	}
+	assert.Empty(t, conn.paths("/qsf.service/pkg.Example/"))
+
+	require.NoError(t, r.Deregister(context.Background()))
+	assert.Empty(t, next(t, w))
+}
+
+func TestSessionExpired(t *testing.T) {
+	conn := newFakeConn()
+	r := NewRegistry(conn, conn.events, "/qsf.service")
+	defer r.Close()
+	require.NoError(t, r.Register(context.Background(), "example", "node-1", registry.NodeData{Addr: "127.0.0.1:9000"}))
+
+	conn.expire(false)
+	assert.Equal(t, []string{"/qsf.service/example/node-1"}, conn.paths("/qsf.service/example/"))
+	_, owners := conn.stat()
+	assert.Equal(t, map[string]int64{"/qsf.service/example/node-1": 2}, owners)
+
+	// a znode of the old session not yet removed by the server is replaced
+	conn.expire(true)
+	_, owners = conn.stat()
+	assert.Equal(t, map[string]int64{"/qsf.service/example/node-1": 3}, owners)
+
+	// a reconnect within the session keeps the znode
+	creates, _ := conn.stat()
+	conn.reconnect()
+	after, owners := conn.stat()
+	assert.Equal(t, creates, after)
+	assert.Equal(t, map[string]int64{"/qsf.service/example/node-1": 3}, owners)
+}
+
+func TestRegistryCloseTwice(t *testing.T) {
+	conn := newFakeConn()
+	r := NewRegistry(conn, conn.events, "/qsf.service")
+	assert.NoError(t, r.Close())
+	assert.NoError(t, r.Close())
+}
+
+func TestWatchClose(t *testing.T) {
+	conn := newFakeConn()
+	w, err := NewDiscovery(conn, "/qsf.service").Watch("example")
+	require.NoError(t, err)
+	next(t, w)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		w.Close()
+	}()
+	_, err = w.Next()
+	assert.Equal(t, registry.ErrClosed, err)
+}
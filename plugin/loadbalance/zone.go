@@ -0,0 +1,151 @@
+package loadbalance
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/chuangyou/qsf/internal/grpcmethod"
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/resolver"
+)
+
+const (
+	//可用区与地域的环境变量
+	EnvZone   = "QSF_ZONE"
+	EnvRegion = "QSF_REGION"
+	//本地健康节点比例低于该值时溢出到其他可用区
+	DefaultSpillover = 0.5
+)
+
+// Locality is where the client runs. The qsf balancers only pick nodes of the same zone while at least
+// Spillover of the zone's nodes are ready, then nodes of the same region, and then every node.
+// They use DefaultLocality unless they are registered with a locality by LocalBalancer.
+type Locality struct {
+	Region    string
+	Zone      string
+	Spillover float64 //0表示DefaultSpillover
+}
+
+var (
+	localMu        sync.Mutex
+	localBalancers = make(map[string]bool) //已注册的带地域的balancer名称
+	zoneCalls      = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "grpc_client_zone_handled_total",
+			Help: "Total number of RPCs completed on the client, by the zone of the server that handled them.",
+		}, []string{"grpc_service", "grpc_method", "grpc_zone", "grpc_local_zone"})
+)
+
+// DefaultLocality returns the locality read from QSF_REGION and QSF_ZONE.
+func DefaultLocality() Locality {
+	return Locality{Region: os.Getenv(EnvRegion), Zone: os.Getenv(EnvZone), Spillover: DefaultSpillover}
+}
+
+// LocalBalancer registers the balancer name with the locality l under a name of its own and returns that
+// name, to be dialed with grpc.WithBalancerName. Every connection dialed with the returned name prefers
+// the nodes near l, while the other connections of the process keep their own locality. Balancers that
+// are not built by NewBalancerBuilder have no locality, their name is returned as is.
+func LocalBalancer(name string, l Locality) (localName string, err error) {
+	if l.Spillover <= 0 {
+		l.Spillover = DefaultSpillover
+	}
+	localMu.Lock()
+	defer localMu.Unlock()
+	localName = fmt.Sprintf("%s@%s/%s/%g", name, l.Region, l.Zone, l.Spillover)
+	if localBalancers[localName] {
+		return
+	}
+	builder := balancer.Get(name)
+	if builder == nil {
+		return "", ErrUnknownPolicy
+	}
+	bb, ok := builder.(*balancerBuilder)
+	if !ok {
+		return name, nil
+	}
+	balancer.Register(&balancerBuilder{name: localName, pickerBuilder: bb.pickerBuilder, locality: &l})
+	localBalancers[localName] = true
+	return
+}
+
+// ZoneCollector returns the counter of calls by serving zone, to be registered into a prometheus registry.
+func ZoneCollector() prometheus.Collector {
+	return zoneCalls
+}
+
+// Zone returns the zone and the region of a resolved address.
+func Zone(addr resolver.Address) (zone, region string) {
+	if nodeData, ok := addr.Metadata.(*registry.NodeData); ok && nodeData != nil {
+		return nodeData.Zone, nodeData.Region
+	}
+	return "", ""
+}
+
+// localNodes returns the ready nodes of the nearest locality with enough ready capacity, all is every resolved address.
+func localNodes(l Locality, ready []Node, all []resolver.Address) []Node {
+	tiers := []func(addr resolver.Address) bool{
+		func(addr resolver.Address) bool {
+			zone, _ := Zone(addr)
+			return l.Zone != "" && zone == l.Zone
+		},
+		func(addr resolver.Address) bool {
+			_, region := Zone(addr)
+			return l.Region != "" && region == l.Region
+		},
+	}
+	for _, local := range tiers {
+		var (
+			total int
+			nodes []Node
+		)
+		for _, addr := range all {
+			if local(addr) {
+				total++
+			}
+		}
+		for _, node := range ready {
+			if local(node.Address) {
+				nodes = append(nodes, node)
+			}
+		}
+		if len(nodes) > 0 && float64(len(nodes)) >= l.Spillover*float64(total) {
+			return nodes
+		}
+	}
+	return ready
+}
+
+// zonePicker counts the calls of the picker it wraps by the zone of the picked node.
+type zonePicker struct {
+	picker    balancer.Picker
+	zones     map[balancer.SubConn]string
+	localZone string
+}
+
+func newZonePicker(picker balancer.Picker, nodes []Node, localZone string) *zonePicker {
+	p := &zonePicker{picker: picker, zones: make(map[balancer.SubConn]string, len(nodes)), localZone: localZone}
+	for _, node := range nodes {
+		p.zones[node.SubConn], _ = Zone(node.Address)
+	}
+	return p
+}
+
+func (p *zonePicker) Pick(ctx context.Context, opts balancer.PickOptions) (balancer.SubConn, func(balancer.DoneInfo), error) {
+	sc, done, err := p.picker.Pick(ctx, opts)
+	if err != nil {
+		return sc, done, err
+	}
+	zone := p.zones[sc]
+	service, method := grpcmethod.Split(opts.FullMethodName)
+	return sc, func(info balancer.DoneInfo) {
+		zoneCalls.WithLabelValues(service, method, zone, strconv.FormatBool(zone == p.localZone)).Inc()
+		if done != nil {
+			done(info)
+		}
+	}, nil
+}
@@ -0,0 +1,90 @@
+package loadbalance
+
+import (
+	"testing"
+
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+)
+
+func zoned(addr, region, zone string) resolver.Address {
+	return resolver.Address{Addr: addr, Metadata: &registry.NodeData{Addr: addr, Region: region, Zone: zone}}
+}
+
+// localBalancer registers the round-robin balancer with the locality l.
+func localBalancer(t *testing.T, l Locality) string {
+	name, err := LocalBalancer(RoundRobin, l)
+	require.NoError(t, err)
+	return name
+}
+
+func TestPreferLocalZone(t *testing.T) {
+	addrs := []resolver.Address{
+		zoned("a:1", "cn-east", "cn-east-1"),
+		zoned("b:1", "cn-east", "cn-east-1"),
+		zoned("c:1", "cn-east", "cn-east-2"),
+		zoned("d:1", "cn-north", "cn-north-1"),
+	}
+	b, cc := startBalancer(t, localBalancer(t, Locality{Region: "cn-east", Zone: "cn-east-1"}), addrs...)
+	assert.Equal(t, map[string]int{"a:1": 5, "b:1": 5}, count(pickN(t, cc, 10)))
+
+	// half of the zone is still ready
+	b.HandleSubConnStateChange(cc.subConns["a:1"], connectivity.TransientFailure)
+	assert.Equal(t, map[string]int{"b:1": 4}, count(pickN(t, cc, 4)))
+
+	// below the threshold the calls spill over to the region
+	b.HandleResolvedAddrs(append(addrs, zoned("e:1", "cn-east", "cn-east-1")), nil)
+	assert.Equal(t, map[string]int{"b:1": 2, "c:1": 2}, count(pickN(t, cc, 4)))
+
+	// and to every zone once the region has no ready node
+	b.HandleSubConnStateChange(cc.subConns["b:1"], connectivity.TransientFailure)
+	b.HandleSubConnStateChange(cc.subConns["c:1"], connectivity.TransientFailure)
+	assert.Equal(t, map[string]int{"d:1": 2}, count(pickN(t, cc, 2)))
+}
+
+func TestNoLocality(t *testing.T) {
+	_, cc := startBalancer(t, localBalancer(t, Locality{}), zoned("a:1", "cn-east", "cn-east-1"), zoned("b:1", "cn-north", "cn-north-1"))
+	assert.Equal(t, map[string]int{"a:1": 2, "b:1": 2}, count(pickN(t, cc, 4)))
+}
+
+func TestLocalBalancers(t *testing.T) {
+	addrs := []resolver.Address{zoned("a:1", "cn-east", "cn-east-1"), zoned("b:1", "cn-north", "cn-north-1")}
+	east := localBalancer(t, Locality{Zone: "cn-east-1"})
+	assert.Equal(t, east, localBalancer(t, Locality{Zone: "cn-east-1", Spillover: DefaultSpillover}))
+	north := localBalancer(t, Locality{Zone: "cn-north-1"})
+	assert.NotEqual(t, east, north)
+
+	// each connection keeps its own locality
+	_, eastCC := startBalancer(t, east, addrs...)
+	_, northCC := startBalancer(t, north, addrs...)
+	assert.Equal(t, map[string]int{"a:1": 2}, count(pickN(t, eastCC, 2)))
+	assert.Equal(t, map[string]int{"b:1": 2}, count(pickN(t, northCC, 2)))
+
+	_, err := LocalBalancer("unknown", Locality{})
+	assert.Equal(t, ErrUnknownPolicy, err)
+}
+
+func TestSpilloverThreshold(t *testing.T) {
+	ready := []Node{{Address: zoned("a:1", "", "z1")}, {Address: zoned("c:1", "", "z2")}}
+	all := []resolver.Address{zoned("a:1", "", "z1"), zoned("b:1", "", "z1"), zoned("c:1", "", "z2")}
+	assert.Len(t, localNodes(Locality{Zone: "z1", Spillover: 0.5}, ready, all), 1)
+	assert.Len(t, localNodes(Locality{Zone: "z1", Spillover: 0.8}, ready, all), 2)
+	assert.Len(t, localNodes(Locality{Zone: "z3", Spillover: 0.5}, ready, all), 2)
+}
+
+func TestZoneMetrics(t *testing.T) {
+	_, cc := startBalancer(t, localBalancer(t, Locality{Zone: "zm-1"}), zoned("zm-a:1", "", "zm-1"))
+	counter := zoneCalls.WithLabelValues("example.Example", "Get", "zm-1", "true")
+	before := testutil.ToFloat64(counter)
+	sc, done, err := cc.picker.Pick(context.Background(), balancer.PickOptions{FullMethodName: "/example.Example/Get"})
+	require.NoError(t, err)
+	require.NotNil(t, sc)
+	done(balancer.DoneInfo{})
+	assert.Equal(t, before+1, testutil.ToFloat64(counter))
+}
@@ -6,6 +6,7 @@ package grpc_prometheus
 import (
 	"time"
 
+	"github.com/chuangyou/qsf/internal/grpcmethod"
 	"google.golang.org/grpc/codes"
 )
 
@@ -25,7 +26,7 @@ func newServerReporter(m *ServerMetrics, rpcType grpcType, fullMethod string) *s
 	if r.metrics.serverHandledHistogramEnabled {
 		r.startTime = time.Now()
 	}
-	r.serviceName, r.methodName = splitMethodName(fullMethod)
+	r.serviceName, r.methodName = grpcmethod.Split(fullMethod)
 	r.metrics.serverStartedCounter.WithLabelValues(string(r.rpcType), r.serviceName, r.methodName).Inc()
 	return r
 }
@@ -4,8 +4,6 @@
 package grpc_prometheus
 
 import (
-	"strings"
-
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 )
@@ -28,14 +26,6 @@ var (
 	}
 )
 
-func splitMethodName(fullMethodName string) (string, string) {
-	fullMethodName = strings.TrimPrefix(fullMethodName, "/") // remove leading slash
-	if i := strings.Index(fullMethodName, "/"); i >= 0 {
-		return fullMethodName[:i], fullMethodName[i+1:]
-	}
-	return "unknown", "unknown"
-}
-
 func typeFromMethodInfo(mInfo *grpc.MethodInfo) grpcType {
 	if !mInfo.IsClientStream && !mInfo.IsServerStream {
 		return Unary
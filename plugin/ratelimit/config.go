@@ -0,0 +1,38 @@
+package ratelimit
+
+import (
+	"errors"
+
+	"github.com/chuangyou/qsf/plugin/config"
+)
+
+// ConfigItem is the config center item of the service rate limit.
+const ConfigItem = "ratelimit"
+
+type Config struct {
+	Rate int `json:"rate"` //每个时间单位允许的请求数
+}
+
+// Watch updates the rate of rl from the ConfigItem.
+func Watch(s config.Subscriber, rl *RateLimiter) (cancel func(), err error) {
+	return s.Subscribe(ConfigItem, &Config{}, func(v interface{}) error {
+		rate := v.(*Config).Rate
+		if rate < 1 {
+			return errors.New("ratelimit rate must be positive")
+		}
+		rl.UpdateRate(rate)
+		return nil
+	})
+}
+
+// WatchQuota updates the quota of the cluster from the ConfigItem, the rate is the total of all nodes.
+func WatchQuota(s config.Subscriber, l *DistributedLimiter) (cancel func(), err error) {
+	return s.Subscribe(ConfigItem, &Config{}, func(v interface{}) error {
+		rate := v.(*Config).Rate
+		if rate < 1 {
+			return errors.New("ratelimit rate must be positive")
+		}
+		l.SetQuota(rate)
+		return nil
+	})
+}
@@ -0,0 +1,247 @@
+package ratelimit
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenk/backoff"
+	"github.com/chuangyou/qsf/constant"
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry"
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry/etcd"
+	etcd3 "github.com/coreos/etcd/clientv3"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/grpclog"
+)
+
+type DistributedOption struct {
+	EtcdConfig       etcd3.Config  //设置DialTimeout时etcd不可用会导致创建失败，不设置则以LocalRate启动
+	Dir              string        //配额路径，默认constant.DEFAULT_RATELIMIT_PATH
+	Name             string        //限流名称，同名的节点共享配额，通常为服务名
+	NodeID           string        //节点ID
+	Quota            int           //所有节点每个时间单位的总请求数
+	Per              time.Duration //时间单位，默认1秒
+	LocalRate        int           //etcd不可用时本节点每个时间单位的请求数，默认Quota
+	Ttl              time.Duration //节点租约TTL，默认10秒
+	MinRetryInterval time.Duration //0表示etcd.DefaultMinRetryInterval
+	MaxRetryInterval time.Duration //0表示etcd.DefaultMaxRetryInterval
+}
+
+// DistributedLimiter shares a quota among the nodes limiting the same name. Every node joins as
+// "<Dir>/<Name>/<NodeID>" with a lease through the etcd registry and takes an equal share of the quota,
+// rebalanced as nodes join and leave. The node uses LocalRate until it joins by Join, and while its lease is lost, e.g. etcd is unreachable, the node falls
+// back to LocalRate.
+type DistributedLimiter struct {
+	limiter     *RateLimiter
+	name        string
+	nodeID      string
+	quota       int64
+	quotaC      chan struct{}
+	localRate   int
+	ttl         time.Duration
+	minRetry    time.Duration
+	maxRetry    time.Duration
+	registry    *etcd.EtcdReigistry
+	discovery   *etcd.Discovery
+	watcher     registry.Watcher
+	events      <-chan etcd.Event
+	distributed int32
+	joinOnce    sync.Once
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+}
+
+// NewDistributedLimiter starts at LocalRate, the node takes its share once it joined by Join.
+func NewDistributedLimiter(option DistributedOption) (*DistributedLimiter, error) {
+	if option.Name == "" || option.NodeID == "" || option.Quota < 1 {
+		return nil, errors.New("distributed ratelimit config error")
+	}
+	if option.Dir == "" {
+		option.Dir = constant.DEFAULT_RATELIMIT_PATH
+	}
+	if option.LocalRate < 1 {
+		option.LocalRate = option.Quota
+	}
+	if option.Ttl <= 0 {
+		option.Ttl = 10 * time.Second
+	}
+	if option.MinRetryInterval <= 0 {
+		option.MinRetryInterval = etcd.DefaultMinRetryInterval
+	}
+	if option.MaxRetryInterval <= 0 {
+		option.MaxRetryInterval = etcd.DefaultMaxRetryInterval
+	}
+	r, err := etcd.NewRegistry(etcd.Option{
+		EtcdConfig:       option.EtcdConfig,
+		RegistryDir:      option.Dir,
+		Ttl:              option.Ttl,
+		MinRetryInterval: option.MinRetryInterval,
+		MaxRetryInterval: option.MaxRetryInterval,
+	})
+	if err != nil {
+		return nil, err
+	}
+	d, err := etcd.NewDiscovery(option.Dir, option.EtcdConfig)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	w, err := d.Watch(option.Name)
+	if err != nil {
+		r.Close()
+		d.Close()
+		return nil, err
+	}
+	l := &DistributedLimiter{
+		limiter:   New(option.LocalRate, option.Per),
+		name:      option.Name,
+		nodeID:    option.NodeID,
+		quota:     int64(option.Quota),
+		quotaC:    make(chan struct{}, 1),
+		localRate: option.LocalRate,
+		ttl:       option.Ttl,
+		minRetry:  option.MinRetryInterval,
+		maxRetry:  option.MaxRetryInterval,
+		registry:  r,
+		discovery: d,
+		watcher:   w,
+		events:    r.Subscribe(),
+	}
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	return l, nil
+}
+
+// Join registers the node in the background and applies its share from then on, a service joins once
+// it is able to serve its share. Join is a no-op after the first call.
+func (l *DistributedLimiter) Join() {
+	l.joinOnce.Do(func() {
+		l.wg.Add(2)
+		go l.join()
+		go l.run()
+	})
+}
+
+// RateLimiter returns the limiter of the node, to be used as server.Config.RateLimter.
+func (l *DistributedLimiter) RateLimiter() *RateLimiter {
+	return l.limiter
+}
+
+// Distributed reports whether the node limits itself to its share of the quota, false while it uses LocalRate.
+func (l *DistributedLimiter) Distributed() bool {
+	return atomic.LoadInt32(&l.distributed) == 1
+}
+
+// SetQuota replaces the quota of the cluster, every node rebalances its share when the ratelimit config item changes.
+func (l *DistributedLimiter) SetQuota(quota int) {
+	atomic.StoreInt64(&l.quota, int64(quota))
+	select {
+	case l.quotaC <- struct{}{}:
+	default:
+	}
+}
+
+// Quota returns the quota of the cluster.
+func (l *DistributedLimiter) Quota() int {
+	return int(atomic.LoadInt64(&l.quota))
+}
+
+// join registers the node until it succeeds, the registry keeps it registered afterwards.
+func (l *DistributedLimiter) join() {
+	defer l.wg.Done()
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = l.minRetry
+	b.MaxInterval = l.maxRetry
+	b.MaxElapsedTime = 0
+	b.Reset()
+	for {
+		ctx, cancel := context.WithTimeout(l.ctx, l.ttl)
+		err := l.registry.Register(ctx, l.name, l.nodeID, registry.NodeData{Addr: l.nodeID})
+		cancel()
+		if err == nil || l.ctx.Err() != nil {
+			return
+		}
+		grpclog.Printf("ratelimit: join '%s' error: %v", l.name, err)
+		select {
+		case <-time.After(b.NextBackOff()):
+		case <-l.ctx.Done():
+			return
+		}
+	}
+}
+
+// run applies the share of the node every time the nodes or the registration of the node change.
+func (l *DistributedLimiter) run() {
+	var (
+		nodes      = make(chan []registry.NodeData)
+		current    []registry.NodeData
+		registered bool
+	)
+	defer l.wg.Done()
+	go func() {
+		for {
+			list, err := l.watcher.Next()
+			if err != nil {
+				return
+			}
+			select {
+			case nodes <- list:
+			case <-l.ctx.Done():
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case current = <-nodes:
+		case <-l.quotaC:
+		case event := <-l.events:
+			registered = event.Type == etcd.EventRegistered || registered && event.Type == etcd.EventRetryFailed
+		case <-l.ctx.Done():
+			return
+		}
+		l.apply(registered, current)
+	}
+}
+
+// apply divides the quota evenly, the nodes sorted first take the remainder.
+func (l *DistributedLimiter) apply(registered bool, nodes []registry.NodeData) {
+	rate := l.localRate
+	if registered {
+		index, count := len(nodes), len(nodes)+1
+		for i, node := range nodes {
+			if node.Addr == l.nodeID {
+				index, count = i, len(nodes)
+				break
+			}
+		}
+		quota := l.Quota()
+		rate = quota / count
+		if index < quota%count {
+			rate++
+		}
+		if rate < 1 {
+			rate = 1
+		}
+		atomic.StoreInt32(&l.distributed, 1)
+	} else {
+		atomic.StoreInt32(&l.distributed, 0)
+	}
+	if rate != l.limiter.Rate() {
+		l.limiter.UpdateRate(rate)
+	}
+}
+
+// Close leaves the quota if the node joined, so that the other nodes take its share at once.
+func (l *DistributedLimiter) Close() error {
+	l.cancel()
+	l.watcher.Close()
+	l.wg.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), l.ttl)
+	defer cancel()
+	err := l.registry.Deregister(ctx)
+	l.registry.Close()
+	l.discovery.Close()
+	return err
+}
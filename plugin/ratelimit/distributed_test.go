@@ -0,0 +1,137 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chuangyou/qsf/internal/etcdtest"
+	etcd3 "github.com/coreos/etcd/clientv3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newDistributed(t *testing.T, s *etcdtest.Server, nodeID string, quota, localRate int) *DistributedLimiter {
+	l, err := NewDistributedLimiter(DistributedOption{
+		EtcdConfig:       etcd3.Config{Endpoints: s.Endpoints()},
+		Name:             "example",
+		NodeID:           nodeID,
+		Quota:            quota,
+		LocalRate:        localRate,
+		Ttl:              time.Second,
+		MinRetryInterval: 50 * time.Millisecond,
+		MaxRetryInterval: 200 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	l.Join()
+	return l
+}
+
+// waitRates waits until the limiters use rates, in order.
+func waitRates(t *testing.T, rates []int, limiters ...*DistributedLimiter) {
+	current := func() []int {
+		list := make([]int, 0, len(limiters))
+		for _, l := range limiters {
+			list = append(list, l.RateLimiter().Rate())
+		}
+		return list
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for !assert.ObjectsAreEqual(rates, current()) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, rates, current())
+}
+
+func TestDistributedShares(t *testing.T) {
+	s, err := etcdtest.NewServer()
+	require.NoError(t, err)
+	defer s.Close()
+
+	l1 := newDistributed(t, s, "node-1", 10, 8)
+	defer l1.Close()
+	waitRates(t, []int{10}, l1)
+	assert.True(t, l1.Distributed())
+
+	l2 := newDistributed(t, s, "node-2", 10, 8)
+	defer l2.Close()
+	l3 := newDistributed(t, s, "node-3", 10, 8)
+	waitRates(t, []int{4, 3, 3}, l1, l2, l3)
+	assert.Equal(t, []string{"/qsf.ratelimit/example/node-1", "/qsf.ratelimit/example/node-2", "/qsf.ratelimit/example/node-3"},
+		s.Keys("/qsf.ratelimit/"))
+
+	// a node leaving gives its share to the others
+	require.NoError(t, l3.Close())
+	waitRates(t, []int{5, 5}, l1, l2)
+
+	// every node gets the quota from the config center
+	l1.SetQuota(7)
+	l2.SetQuota(7)
+	waitRates(t, []int{4, 3}, l1, l2)
+	assert.Equal(t, 7, l1.Quota())
+}
+
+func TestDistributedFallback(t *testing.T) {
+	s, err := etcdtest.NewServer()
+	require.NoError(t, err)
+	defer s.Close()
+
+	l1 := newDistributed(t, s, "node-1", 10, 8)
+	defer l1.Close()
+	l2 := newDistributed(t, s, "node-2", 10, 8)
+	defer l2.Close()
+	waitRates(t, []int{5, 5}, l1, l2)
+
+	// without etcd the leases are lost and the nodes use their local rate
+	s.Stop()
+	waitRates(t, []int{8, 8}, l1, l2)
+	assert.False(t, l1.Distributed())
+
+	require.NoError(t, s.Start())
+	waitRates(t, []int{5, 5}, l1, l2)
+	assert.True(t, l2.Distributed())
+}
+
+func TestDistributedUnreachable(t *testing.T) {
+	s, err := etcdtest.NewServer()
+	require.NoError(t, err)
+	defer s.Close()
+	s.Stop()
+
+	// the node starts at its local rate and joins once etcd is reachable
+	l := newDistributed(t, s, "node-1", 10, 8)
+	defer l.Close()
+	assert.Equal(t, 8, l.RateLimiter().Rate())
+	assert.False(t, l.Distributed())
+	require.NoError(t, s.Start())
+	waitRates(t, []int{10}, l)
+}
+
+func TestDistributedJoin(t *testing.T) {
+	s, err := etcdtest.NewServer()
+	require.NoError(t, err)
+	defer s.Close()
+
+	l, err := NewDistributedLimiter(DistributedOption{
+		EtcdConfig: etcd3.Config{Endpoints: s.Endpoints()},
+		Name:       "example",
+		NodeID:     "node-1",
+		Quota:      10,
+		LocalRate:  8,
+	})
+	require.NoError(t, err)
+	defer l.Close()
+	// the node does not take a share before it joins
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, s.Keys("/qsf.ratelimit/"))
+	assert.Equal(t, 8, l.RateLimiter().Rate())
+
+	l.Join()
+	l.Join()
+	waitRates(t, []int{10}, l)
+	assert.Equal(t, []string{"/qsf.ratelimit/example/node-1"}, s.Keys("/qsf.ratelimit/"))
+}
+
+func TestNewDistributedLimiterError(t *testing.T) {
+	_, err := NewDistributedLimiter(DistributedOption{Name: "example", NodeID: "node-1"})
+	assert.Error(t, err)
+}
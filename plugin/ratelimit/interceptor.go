@@ -1,7 +1,9 @@
 package ratelimit
 
 import (
-	"strconv"
+	"fmt"
+	"math"
+	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
@@ -14,7 +16,7 @@ func UnaryServerInterceptor(rl *RateLimiter) grpc.UnaryServerInterceptor {
 		if !rl.Limit() {
 			return handler(ctx, req)
 		} else {
-			return nil, grpc_error.ResourceExhausted("服务并发限制", "当前服务最大并发数为"+strconv.FormatUint(rl.rate, 10)+"，请稍后重试。", 30)
+			return nil, rateError(rl)
 		}
 	}
 }
@@ -23,7 +25,15 @@ func StreamServerInterceptor(rl *RateLimiter) grpc.StreamServerInterceptor {
 		if !rl.Limit() {
 			return handler(srv, stream)
 		} else {
-			return grpc_error.ResourceExhausted("服务并发限制", "当前服务最大并发数为"+strconv.FormatUint(rl.rate, 10)+"，请稍后重试。", 30)
+			return rateError(rl)
 		}
 	}
 }
+
+// rateError reports the rate of the service, the rate is a number of requests per unit and not a concurrency
+// limit, see plugin/concurrency for that.
+func rateError(rl *RateLimiter) error {
+	per := time.Duration(rl.unit)
+	return grpc_error.ResourceExhausted("服务限流", fmt.Sprintf("当前服务最大请求数为每%s %d次，请稍后重试。", per, rl.Rate()),
+		int64(math.Ceil(per.Seconds())))
+}
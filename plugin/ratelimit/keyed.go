@@ -0,0 +1,195 @@
+package ratelimit
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/chuangyou/qsf/grpc_error"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// DefaultMaxKeys is the number of keys a KeyedLimiter keeps when maxKeys is not positive.
+const DefaultMaxKeys = 10000
+
+var (
+	ErrNoMethod = errors.New("ratelimit: rule without method")
+	ErrNoRate   = errors.New("ratelimit: rule rate must be positive")
+)
+
+// KeyFunc returns the key a call is limited by, the calls with the same key share the rate of a rule.
+type KeyFunc func(ctx context.Context) string
+
+// MetadataKey limits calls by the first value of the incoming metadata name, such as the user id the
+// gateway forwards as "qsf-userid". Calls without it share the empty key.
+func MetadataKey(name string) KeyFunc {
+	return func(ctx context.Context) string {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if values := md.Get(name); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+}
+
+// PeerKey limits calls by the IP of the peer.
+func PeerKey(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// Rule limits the calls of the methods it matches. Method is a full method name ("/pkg.Service/Method")
+// or a path.Match pattern ("/pkg.Service/*"), "*" matches every method. When several rules match, the
+// exact method wins, then the longest pattern.
+type Rule struct {
+	Method string        //方法全名或通配符
+	Rate   int           //每个时间单位允许的请求数
+	Per    time.Duration //时间单位，默认1秒
+	Key    KeyFunc       //限流维度，如MetadataKey、PeerKey，为空时匹配方法的所有调用共享
+}
+
+// KeyedLimiter limits calls by rule and key. Each key of a rule has its own RateLimiter, the least
+// recently used ones are evicted above maxKeys. It is safe for concurrent use.
+type KeyedLimiter struct {
+	rules   []Rule
+	maxKeys int
+	mu      sync.Mutex
+	lru     *list.List //front is the most recently used
+	keys    map[limiterKey]*list.Element
+}
+
+type limiterKey struct {
+	rule int
+	key  string
+}
+
+type limiterEntry struct {
+	key     limiterKey
+	limiter *RateLimiter
+}
+
+func NewKeyedLimiter(rules []Rule, maxKeys int) (*KeyedLimiter, error) {
+	for _, rule := range rules {
+		if rule.Method == "" {
+			return nil, ErrNoMethod
+		}
+		if _, err := path.Match(rule.Method, ""); err != nil {
+			return nil, err
+		}
+		if rule.Rate < 1 {
+			return nil, ErrNoRate
+		}
+	}
+	if maxKeys <= 0 {
+		maxKeys = DefaultMaxKeys
+	}
+	return &KeyedLimiter{
+		rules:   append([]Rule(nil), rules...),
+		maxKeys: maxKeys,
+		lru:     list.New(),
+		keys:    make(map[limiterKey]*list.Element),
+	}, nil
+}
+
+// Limit returns true if the rate of the rule matching fullMethod was exceeded for the key of the call,
+// and the rule. Methods without a rule are not limited.
+func (l *KeyedLimiter) Limit(ctx context.Context, fullMethod string) (bool, *Rule) {
+	i := l.match(fullMethod)
+	if i < 0 {
+		return false, nil
+	}
+	rule := &l.rules[i]
+	key := limiterKey{rule: i}
+	if rule.Key != nil {
+		key.key = rule.Key(ctx)
+	}
+	return l.limiter(key, rule).Limit(), rule
+}
+
+// Len returns the number of keys kept.
+func (l *KeyedLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lru.Len()
+}
+
+func (l *KeyedLimiter) limiter(key limiterKey, rule *Rule) *RateLimiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.keys[key]; ok {
+		l.lru.MoveToFront(e)
+		return e.Value.(*limiterEntry).limiter
+	}
+	entry := &limiterEntry{key: key, limiter: New(rule.Rate, rule.Per)}
+	l.keys[key] = l.lru.PushFront(entry)
+	for l.lru.Len() > l.maxKeys {
+		oldest := l.lru.Back()
+		l.lru.Remove(oldest)
+		delete(l.keys, oldest.Value.(*limiterEntry).key)
+	}
+	return entry.limiter
+}
+
+func (l *KeyedLimiter) match(fullMethod string) (matched int) {
+	matched = -1
+	for i := range l.rules {
+		method := l.rules[i].Method
+		if method == fullMethod {
+			return i
+		}
+		if method == "*" {
+			if matched < 0 {
+				matched = i
+			}
+			continue
+		}
+		if ok, _ := path.Match(method, fullMethod); ok {
+			if matched < 0 || l.rules[matched].Method == "*" || len(method) > len(l.rules[matched].Method) {
+				matched = i
+			}
+		}
+	}
+	return
+}
+
+func (l *KeyedLimiter) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if limited, rule := l.Limit(ctx, info.FullMethod); limited {
+			return nil, limitError(info.FullMethod, rule)
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (l *KeyedLimiter) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if limited, rule := l.Limit(stream.Context(), info.FullMethod); limited {
+			return limitError(info.FullMethod, rule)
+		}
+		return handler(srv, stream)
+	}
+}
+
+func limitError(fullMethod string, rule *Rule) error {
+	per := rule.Per
+	if per <= 0 {
+		per = time.Second
+	}
+	return grpc_error.ResourceExhausted("方法限流", fmt.Sprintf("%s的最大请求数为每%s %d次，请稍后重试。", fullMethod, per, rule.Rate),
+		int64(math.Ceil(per.Seconds())))
+}
@@ -0,0 +1,106 @@
+package ratelimit
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func userContext(user string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("qsf-userid", user))
+}
+
+func TestKeyedLimiterRules(t *testing.T) {
+	l, err := NewKeyedLimiter([]Rule{
+		{Method: "*", Rate: 100},
+		{Method: "/pkg.Service/*", Rate: 3},
+		{Method: "/pkg.Service/Report", Rate: 1},
+	}, 0)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// the exact method wins, then the longest pattern
+	limited, rule := l.Limit(ctx, "/pkg.Service/Report")
+	assert.False(t, limited)
+	assert.Equal(t, "/pkg.Service/Report", rule.Method)
+	limited, _ = l.Limit(ctx, "/pkg.Service/Report")
+	assert.True(t, limited)
+
+	for i := 0; i < 3; i++ {
+		limited, rule = l.Limit(ctx, "/pkg.Service/Get")
+		assert.False(t, limited)
+	}
+	assert.Equal(t, "/pkg.Service/*", rule.Method)
+	limited, _ = l.Limit(ctx, "/pkg.Service/List")
+	assert.True(t, limited, "the methods of a pattern share the rate of the rule")
+
+	limited, rule = l.Limit(ctx, "/other.Service/Get")
+	assert.False(t, limited)
+	assert.Equal(t, "*", rule.Method)
+
+	l, err = NewKeyedLimiter([]Rule{{Method: "/pkg.Service/Report", Rate: 1}}, 0)
+	require.NoError(t, err)
+	limited, rule = l.Limit(ctx, "/pkg.Service/Get")
+	assert.False(t, limited)
+	assert.Nil(t, rule)
+}
+
+func TestKeyedLimiterKeys(t *testing.T) {
+	l, err := NewKeyedLimiter([]Rule{{Method: "*", Rate: 1, Per: time.Hour, Key: MetadataKey("qsf-userid")}}, 2)
+	require.NoError(t, err)
+
+	limited, _ := l.Limit(userContext("a"), "/pkg.Service/Get")
+	assert.False(t, limited)
+	limited, _ = l.Limit(userContext("a"), "/pkg.Service/Get")
+	assert.True(t, limited)
+	limited, _ = l.Limit(userContext("b"), "/pkg.Service/Get")
+	assert.False(t, limited, "one caller does not use the rate of another")
+
+	// "a" is the least recently used key once "c" is added, evicting it resets its rate
+	l.Limit(userContext("b"), "/pkg.Service/Get")
+	l.Limit(userContext("c"), "/pkg.Service/Get")
+	assert.Equal(t, 2, l.Len())
+	limited, _ = l.Limit(userContext("a"), "/pkg.Service/Get")
+	assert.False(t, limited)
+	limited, _ = l.Limit(userContext("c"), "/pkg.Service/Get")
+	assert.True(t, limited)
+}
+
+func TestPeerKey(t *testing.T) {
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}})
+	assert.Equal(t, "10.0.0.1", PeerKey(ctx))
+	assert.Equal(t, "", PeerKey(context.Background()))
+}
+
+func TestKeyedLimiterInterceptor(t *testing.T) {
+	l, err := NewKeyedLimiter([]Rule{{Method: "/pkg.Service/Get", Rate: 1, Per: 2 * time.Second}}, 0)
+	require.NoError(t, err)
+	interceptor := l.UnaryServerInterceptor()
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "ok", nil }
+	info := &grpc.UnaryServerInfo{FullMethod: "/pkg.Service/Get"}
+
+	resp, err := interceptor(context.Background(), nil, info, handler)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", resp)
+	_, err = interceptor(context.Background(), nil, info, handler)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Len(t, status.Convert(err).Details(), 2)
+}
+
+func TestNewKeyedLimiterError(t *testing.T) {
+	_, err := NewKeyedLimiter([]Rule{{Rate: 1}}, 0)
+	assert.Equal(t, ErrNoMethod, err)
+	_, err = NewKeyedLimiter([]Rule{{Method: "/pkg.Service/Get"}}, 0)
+	assert.Equal(t, ErrNoRate, err)
+	_, err = NewKeyedLimiter([]Rule{{Method: "/pkg.Service/[", Rate: 1}}, 0)
+	assert.Error(t, err)
+}
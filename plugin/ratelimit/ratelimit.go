@@ -36,6 +36,11 @@ func (rl *RateLimiter) UpdateRate(rate int) {
 	atomic.StoreUint64(&rl.max, uint64(rate)*rl.unit)
 }
 
+// Rate returns the allowed rate
+func (rl *RateLimiter) Rate() int {
+	return int(atomic.LoadUint64(&rl.rate))
+}
+
 // Limit returns true if rate was exceeded
 func (rl *RateLimiter) Limit() bool {
 	// Calculate the number of ns that have passed since our last call
@@ -5,115 +5,111 @@ import (
 	"testing"
 	"time"
 
-	. "github.com/onsi/ginkgo"
-	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/assert"
 )
 
-var _ = Describe("RateLimiter", func() {
+func TestLimitSmallRate(t *testing.T) {
+	var count int
+	rl := New(10, time.Minute)
+	for !rl.Limit() {
+		count++
+	}
+	assert.Equal(t, 10, count)
+}
 
-	It("should accurately rate-limit at small rates", func() {
-		var count int
-		rl := New(10, time.Minute)
-		for !rl.Limit() {
-			count++
-		}
-		Expect(count).To(Equal(10))
-	})
+func TestLimitLargeRate(t *testing.T) {
+	var count int
+	rl := New(100000, time.Hour)
+	for !rl.Limit() {
+		count++
+	}
+	assert.InDelta(t, 100000, count, 10)
+}
 
-	It("should accurately rate-limit at large rates", func() {
-		var count int
-		rl := New(100000, time.Hour)
-		for !rl.Limit() {
-			count++
-		}
-		Expect(count).To(BeNumerically("~", 100000, 10))
-	})
+func TestLimitLargeInterval(t *testing.T) {
+	var count int
+	rl := New(100, 360*24*time.Hour)
+	for !rl.Limit() {
+		count++
+	}
+	assert.Equal(t, 100, count)
+}
 
-	It("should accurately rate-limit at large intervals", func() {
-		var count int
-		rl := New(100, 360*24*time.Hour)
-		for !rl.Limit() {
+func TestLimitIncreaseAllowance(t *testing.T) {
+	n := 25
+	rl := New(n, 50*time.Millisecond)
+	for i := 0; i < n; i++ {
+		assert.False(t, rl.Limit(), "on cycle %d", i)
+	}
+	assert.True(t, rl.Limit())
+	deadline := time.Now().Add(60 * time.Millisecond)
+	for rl.Limit() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.False(t, rl.Limit())
+}
+
+func TestLimitSpreadAllowance(t *testing.T) {
+	var count int
+	rl := New(5, 10*time.Millisecond)
+	start := time.Now()
+	for time.Since(start) < 100*time.Millisecond {
+		if !rl.Limit() {
 			count++
 		}
-		Expect(count).To(Equal(100))
-	})
-
-	It("should correctly increase allowance", func() {
-		n := 25
-		rl := New(n, 50*time.Millisecond)
-		for i := 0; i < n; i++ {
-			Expect(rl.Limit()).To(BeFalse(), "on cycle %d", i)
-		}
-		Expect(rl.Limit()).To(BeTrue())
-		Eventually(rl.Limit, "60ms", "10ms").Should(BeFalse())
-	})
-
-	It("should correctly spread allowance", func() {
-		var count int
-		rl := New(5, 10*time.Millisecond)
-		start := time.Now()
-		for time.Since(start) < 100*time.Millisecond {
-			if !rl.Limit() {
-				count++
+	}
+	assert.InDelta(t, 54, count, 1)
+}
+
+func TestUndo(t *testing.T) {
+	rl := New(5, time.Minute)
+
+	for i := 0; i < 5; i++ {
+		assert.False(t, rl.Limit())
+	}
+	assert.True(t, rl.Limit())
+
+	rl.Undo()
+	assert.False(t, rl.Limit())
+	assert.True(t, rl.Limit())
+}
+
+func TestLimitConcurrent(t *testing.T) {
+	c := 100
+	n := 100
+	wg := sync.WaitGroup{}
+	rl := New(c*n, time.Hour)
+	for i := 0; i < c; i++ {
+		wg.Add(1)
+
+		go func(thread int) {
+			defer wg.Done()
+
+			for j := 0; j < n; j++ {
+				assert.False(t, rl.Limit(), "thread %d, cycle %d", thread, j)
 			}
-		}
-		Expect(count).To(BeNumerically("~", 54, 1))
-	})
-
-	It("should undo", func() {
-		rl := New(5, time.Minute)
-
-		Expect(rl.Limit()).To(BeFalse())
-		Expect(rl.Limit()).To(BeFalse())
-		Expect(rl.Limit()).To(BeFalse())
-		Expect(rl.Limit()).To(BeFalse())
-		Expect(rl.Limit()).To(BeFalse())
-		Expect(rl.Limit()).To(BeTrue())
-
-		rl.Undo()
-		Expect(rl.Limit()).To(BeFalse())
-		Expect(rl.Limit()).To(BeTrue())
-	})
-
-	It("should be thread-safe", func() {
-		c := 100
-		n := 100
-		wg := sync.WaitGroup{}
-		rl := New(c*n, time.Hour)
-		for i := 0; i < c; i++ {
-			wg.Add(1)
-
-			go func(thread int) {
-				defer GinkgoRecover()
-				defer wg.Done()
-
-				for j := 0; j < n; j++ {
-					Expect(rl.Limit()).To(BeFalse(), "thread %d, cycle %d", thread, j)
-				}
-			}(i)
-		}
-		wg.Wait()
-		Expect(rl.Limit()).To(BeTrue())
-	})
-
-	It("should allow to upate rate", func() {
-		var count int
-		rl := New(5, 50*time.Millisecond)
-		for !rl.Limit() {
-			count++
-		}
-		Expect(count).To(Equal(5))
+		}(i)
+	}
+	wg.Wait()
+	assert.True(t, rl.Limit())
+}
 
-		rl.UpdateRate(10)
-		time.Sleep(50 * time.Millisecond)
+func TestUpdateRate(t *testing.T) {
+	var count int
+	rl := New(5, 50*time.Millisecond)
+	for !rl.Limit() {
+		count++
+	}
+	assert.Equal(t, 5, count)
 
-		for !rl.Limit() {
-			count++
-		}
-		Expect(count).To(Equal(15))
-	})
+	rl.UpdateRate(10)
+	time.Sleep(50 * time.Millisecond)
 
-})
+	for !rl.Limit() {
+		count++
+	}
+	assert.Equal(t, 15, count)
+}
 
 // --------------------------------------------------------------------
 
@@ -125,10 +121,3 @@ func BenchmarkLimit(b *testing.B) {
 		rl.Limit()
 	}
 }
-
-// --------------------------------------------------------------------
-
-func TestGinkgoSuite(t *testing.T) {
-	RegisterFailHandler(Fail)
-	RunSpecs(t, "github.com/bsm/ratelimit")
-}
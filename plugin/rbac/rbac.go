@@ -0,0 +1,292 @@
+// Package rbac enforces per-method authorization policies on grpc services.
+//
+// A policy maps full method names ("/pkg.Service/Method") or path.Match patterns ("/pkg.Service/Admin*",
+// "/pkg.Service/*") to the roles, scopes or caller identities a caller needs. The pattern "*" matches
+// every method. When several rules match, the exact method wins, then the longest pattern.
+//
+// The caller is described by the claims of its JWT (jwt.FromContext) and its TLS certificate
+// (credential.PeerCertificate), so the rbac interceptor must run after the auth interceptor.
+package rbac
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/chuangyou/qsf/grpc_error"
+	"github.com/chuangyou/qsf/plugin/credential"
+	"github.com/chuangyou/qsf/plugin/jwt"
+	etcd3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/grpc-ecosystem/go-grpc-middleware/auth"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/grpclog"
+)
+
+// resyncInterval is the wait between two failed attempts to read the policy.
+const resyncInterval = time.Second
+
+var (
+	ErrNoMethod = errors.New("rbac: policy rule without method")
+)
+
+type Rule struct {
+	Method  string   `json:"method"`            //方法全名或通配符
+	Public  bool     `json:"public,omitempty"`  //公开方法，不需要认证
+	Roles   []string `json:"roles,omitempty"`   //需要其中任意一个角色
+	Scopes  []string `json:"scopes,omitempty"`  //需要全部scope
+	Callers []string `json:"callers,omitempty"` //允许的调用方身份（JWT sub或证书CN）
+}
+
+type Policy struct {
+	Rules        []Rule `json:"rules"`
+	DefaultAllow bool   `json:"default_allow,omitempty"` //没有匹配规则时是否允许，默认拒绝
+}
+
+// Subject describes the caller of a method.
+type Subject struct {
+	Identities []string
+	Roles      []string
+	Scopes     []string
+}
+
+// Authorizer checks calls against a policy that can be replaced at runtime. It is safe for concurrent use.
+type Authorizer struct {
+	policy atomic.Value
+	// SubjectFunc describes the caller, DefaultSubject is used when it is nil.
+	SubjectFunc func(ctx context.Context) Subject
+}
+
+func NewAuthorizer(policy *Policy) *Authorizer {
+	a := new(Authorizer)
+	a.SetPolicy(policy)
+	return a
+}
+
+// SetPolicy replaces the policy.
+func (a *Authorizer) SetPolicy(policy *Policy) {
+	if policy == nil {
+		policy = new(Policy)
+	}
+	a.policy.Store(policy)
+}
+
+// Policy returns the current policy.
+func (a *Authorizer) Policy() *Policy {
+	return a.policy.Load().(*Policy)
+}
+
+// IsPublic reports whether fullMethod can be called without authentication.
+func (a *Authorizer) IsPublic(fullMethod string) bool {
+	rule := a.Policy().match(fullMethod)
+	return rule != nil && rule.Public
+}
+
+// Authorize returns grpc_error.PermissionDenied if the caller in ctx may not call fullMethod.
+func (a *Authorizer) Authorize(ctx context.Context, fullMethod string) error {
+	policy := a.Policy()
+	rule := policy.match(fullMethod)
+	if rule == nil {
+		if policy.DefaultAllow {
+			return nil
+		}
+		return grpc_error.PermissionDenied("no policy allows " + fullMethod)
+	}
+	if rule.Public {
+		return nil
+	}
+	subjectFunc := a.SubjectFunc
+	if subjectFunc == nil {
+		subjectFunc = DefaultSubject
+	}
+	subject := subjectFunc(ctx)
+	if len(rule.Callers) > 0 && !containsAny(rule.Callers, subject.Identities) {
+		return grpc_error.PermissionDenied("caller is not allowed to call " + fullMethod)
+	}
+	if len(rule.Roles) > 0 && !containsAny(rule.Roles, subject.Roles) {
+		return grpc_error.PermissionDenied(fullMethod + " requires one of roles: " + strings.Join(rule.Roles, ","))
+	}
+	for _, scope := range rule.Scopes {
+		if !containsAny([]string{scope}, subject.Scopes) {
+			return grpc_error.PermissionDenied(fullMethod + " requires scope: " + scope)
+		}
+	}
+	return nil
+}
+
+// UnaryServerInterceptor authorizes unary calls. Like grpc_auth, services overriding the authentication
+// with AuthFuncOverride (such as the health service) are not checked.
+func (a *Authorizer) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if _, ok := info.Server.(grpc_auth.ServiceAuthFuncOverride); ok {
+			return handler(ctx, req)
+		}
+		if err := a.Authorize(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor authorizes streaming calls, except for services with AuthFuncOverride.
+func (a *Authorizer) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if _, ok := srv.(grpc_auth.ServiceAuthFuncOverride); ok {
+			return handler(srv, stream)
+		}
+		if err := a.Authorize(stream.Context(), info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, stream)
+	}
+}
+
+// DefaultSubject takes the identities, roles ("roles" or "role") and scopes ("scope" or "scp") from the
+// JWT claims, and the common name of the TLS certificate as another identity.
+func DefaultSubject(ctx context.Context) (subject Subject) {
+	if claims, ok := jwt.FromContext(ctx); ok {
+		if claims.Subject != "" {
+			subject.Identities = append(subject.Identities, claims.Subject)
+		}
+		subject.Roles = append(claims.StringsClaim("roles"), claims.StringsClaim("role")...)
+		subject.Scopes = append(claims.StringsClaim("scope"), claims.StringsClaim("scp")...)
+	}
+	if cn := credential.PeerCommonName(ctx); cn != "" {
+		subject.Identities = append(subject.Identities, cn)
+	}
+	return
+}
+
+// ParsePolicy decodes a JSON policy.
+func ParsePolicy(data []byte) (policy *Policy, err error) {
+	policy = new(Policy)
+	if err = json.Unmarshal(data, policy); err != nil {
+		return nil, err
+	}
+	for _, rule := range policy.Rules {
+		if rule.Method == "" {
+			return nil, ErrNoMethod
+		}
+		if _, err = path.Match(rule.Method, ""); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// LoadPolicyFile reads a JSON policy from file.
+func LoadPolicyFile(file string) (*Policy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(data)
+}
+
+// WatchEtcd loads the JSON policy stored under key and keeps the authorizer updated until ctx is done.
+// Invalid policies are logged and ignored, a deleted key keeps the last policy. When the watch fails,
+// e.g. after a compaction, the policy is read again and watched from the current revision.
+func (a *Authorizer) WatchEtcd(ctx context.Context, client *etcd3.Client, key string) (err error) {
+	var (
+		resp   *etcd3.GetResponse
+		policy *Policy
+	)
+	resp, err = client.Get(ctx, key)
+	if err != nil {
+		return
+	}
+	if len(resp.Kvs) > 0 {
+		policy, err = ParsePolicy(resp.Kvs[0].Value)
+		if err != nil {
+			return
+		}
+		a.SetPolicy(policy)
+	}
+	go a.watchEtcd(ctx, client, key, resp.Header.Revision)
+	return
+}
+
+func (a *Authorizer) watchEtcd(ctx context.Context, client *etcd3.Client, key string, rev int64) {
+	for {
+		wctx, cancel := context.WithCancel(ctx)
+		for wresp := range client.Watch(wctx, key, etcd3.WithRev(rev+1)) {
+			if wresp.Err() != nil {
+				grpclog.Printf("rbac: watch of '%s' resyncs at revision %d: %v", key, rev, wresp.Err())
+				break
+			}
+			for _, ev := range wresp.Events {
+				if ev.Type == mvccpb.PUT {
+					a.setPolicy(ev.Kv.Value)
+				}
+			}
+			rev = wresp.Header.Revision
+		}
+		cancel()
+		for {
+			if ctx.Err() != nil || client.Ctx().Err() != nil {
+				return
+			}
+			resp, err := client.Get(ctx, key)
+			if err == nil {
+				if len(resp.Kvs) > 0 {
+					a.setPolicy(resp.Kvs[0].Value)
+				}
+				rev = resp.Header.Revision
+				break
+			}
+			grpclog.Println("rbac: get policy error:", err)
+			select {
+			case <-time.After(resyncInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// setPolicy replaces the policy by a watched one, keeping the current policy if it is invalid.
+func (a *Authorizer) setPolicy(data []byte) {
+	policy, err := ParsePolicy(data)
+	if err != nil {
+		grpclog.Println("rbac: parse policy error:", err)
+		return
+	}
+	a.SetPolicy(policy)
+}
+
+func (p *Policy) match(fullMethod string) (matched *Rule) {
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Method == fullMethod {
+			return rule
+		}
+		if rule.Method == "*" {
+			if matched == nil {
+				matched = rule
+			}
+			continue
+		}
+		if ok, _ := path.Match(rule.Method, fullMethod); ok {
+			if matched == nil || matched.Method == "*" || len(rule.Method) > len(matched.Method) {
+				matched = rule
+			}
+		}
+	}
+	return
+}
+
+func containsAny(allowed, values []string) bool {
+	for _, a := range allowed {
+		for _, v := range values {
+			if a == v {
+				return true
+			}
+		}
+	}
+	return false
+}
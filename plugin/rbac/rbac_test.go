@@ -0,0 +1,188 @@
+package rbac
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/chuangyou/qsf/internal/etcdtest"
+	"github.com/chuangyou/qsf/plugin/jwt"
+	etcd3 "github.com/coreos/etcd/clientv3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const policyJSON = `{
+	"rules": [
+		{"method": "/example.Example/Public", "public": true},
+		{"method": "/example.Example/*", "roles": ["user", "admin"]},
+		{"method": "/example.Example/Admin*", "roles": ["admin"], "scopes": ["example:write"]},
+		{"method": "/example.Example/AdminReset", "callers": ["ops"]},
+		{"method": "*", "callers": ["gateway"]}
+	]
+}`
+
+func callerContext(sub string, extra map[string]interface{}) context.Context {
+	return jwt.NewContext(context.Background(), &jwt.Claims{Subject: sub, Extra: extra})
+}
+
+func newTestAuthorizer(t *testing.T) *Authorizer {
+	policy, err := ParsePolicy([]byte(policyJSON))
+	require.NoError(t, err)
+	return NewAuthorizer(policy)
+}
+
+func TestMatchPrecedence(t *testing.T) {
+	a := newTestAuthorizer(t)
+	assert.Equal(t, "/example.Example/AdminReset", a.Policy().match("/example.Example/AdminReset").Method)
+	assert.Equal(t, "/example.Example/Admin*", a.Policy().match("/example.Example/AdminList").Method)
+	assert.Equal(t, "/example.Example/*", a.Policy().match("/example.Example/Get").Method)
+	assert.Equal(t, "*", a.Policy().match("/other.Other/Get").Method)
+	assert.Nil(t, new(Policy).match("/example.Example/Get"))
+}
+
+func TestAuthorize(t *testing.T) {
+	a := newTestAuthorizer(t)
+	user := callerContext("u1", map[string]interface{}{"roles": []interface{}{"user"}})
+	admin := callerContext("u2", map[string]interface{}{"role": "admin", "scope": "example:read example:write"})
+	readOnlyAdmin := callerContext("u3", map[string]interface{}{"role": "admin", "scp": []interface{}{"example:read"}})
+
+	assert.NoError(t, a.Authorize(context.Background(), "/example.Example/Public"))
+	assert.True(t, a.IsPublic("/example.Example/Public"))
+	assert.False(t, a.IsPublic("/example.Example/Get"))
+
+	assert.NoError(t, a.Authorize(user, "/example.Example/Get"))
+	assert.Equal(t, codes.PermissionDenied, status.Code(a.Authorize(context.Background(), "/example.Example/Get")))
+
+	assert.NoError(t, a.Authorize(admin, "/example.Example/AdminList"))
+	assert.Equal(t, codes.PermissionDenied, status.Code(a.Authorize(user, "/example.Example/AdminList")))
+	assert.Equal(t, codes.PermissionDenied, status.Code(a.Authorize(readOnlyAdmin, "/example.Example/AdminList")))
+
+	assert.NoError(t, a.Authorize(callerContext("ops", nil), "/example.Example/AdminReset"))
+	assert.Equal(t, codes.PermissionDenied, status.Code(a.Authorize(admin, "/example.Example/AdminReset")))
+
+	assert.NoError(t, a.Authorize(callerContext("gateway", nil), "/other.Other/Get"))
+	assert.Equal(t, codes.PermissionDenied, status.Code(a.Authorize(user, "/other.Other/Get")))
+}
+
+func TestDefaultAllow(t *testing.T) {
+	a := NewAuthorizer(nil)
+	assert.Equal(t, codes.PermissionDenied, status.Code(a.Authorize(context.Background(), "/example.Example/Get")))
+	a.SetPolicy(&Policy{DefaultAllow: true})
+	assert.NoError(t, a.Authorize(context.Background(), "/example.Example/Get"))
+}
+
+func TestSubjectFunc(t *testing.T) {
+	a := NewAuthorizer(&Policy{Rules: []Rule{{Method: "*", Roles: []string{"admin"}}}})
+	a.SubjectFunc = func(ctx context.Context) Subject {
+		return Subject{Roles: []string{"admin"}}
+	}
+	assert.NoError(t, a.Authorize(context.Background(), "/example.Example/Get"))
+}
+
+func TestParsePolicy(t *testing.T) {
+	_, err := ParsePolicy([]byte(`{"rules": [{"roles": ["admin"]}]}`))
+	assert.Equal(t, ErrNoMethod, err)
+	_, err = ParsePolicy([]byte(`{"rules": [{"method": "/example.Example/["}]}`))
+	assert.Error(t, err)
+	_, err = ParsePolicy([]byte(`{"rules": `))
+	assert.Error(t, err)
+}
+
+func TestLoadPolicyFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "qsf-rbac")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(policyJSON)
+	require.NoError(t, err)
+	f.Close()
+
+	policy, err := LoadPolicyFile(f.Name())
+	require.NoError(t, err)
+	assert.Len(t, policy.Rules, 5)
+}
+
+type overrideService struct{}
+
+func (overrideService) AuthFuncOverride(ctx context.Context, fullMethodName string) (context.Context, error) {
+	return ctx, nil
+}
+
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+func TestInterceptors(t *testing.T) {
+	a := newTestAuthorizer(t)
+	called := false
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		called = true
+		return nil, nil
+	}
+	_, err := a.UnaryServerInterceptor()(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/example.Example/Get"}, handler)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.False(t, called)
+	_, err = a.UnaryServerInterceptor()(callerContext("u1", map[string]interface{}{"role": "user"}), nil, &grpc.UnaryServerInfo{FullMethod: "/example.Example/Get"}, handler)
+	assert.NoError(t, err)
+	assert.True(t, called)
+
+	_, err = a.UnaryServerInterceptor()(context.Background(), nil, &grpc.UnaryServerInfo{Server: overrideService{}, FullMethod: "/grpc.health.v1.Health/Check"}, handler)
+	assert.NoError(t, err)
+
+	streamHandler := func(srv interface{}, stream grpc.ServerStream) error {
+		return nil
+	}
+	err = a.StreamServerInterceptor()(nil, &contextStream{ctx: context.Background()}, &grpc.StreamServerInfo{FullMethod: "/example.Example/Get"}, streamHandler)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	err = a.StreamServerInterceptor()(nil, &contextStream{ctx: context.Background()}, &grpc.StreamServerInfo{FullMethod: "/example.Example/Public"}, streamHandler)
+	assert.NoError(t, err)
+}
+
+// waitPolicy waits until the policy of a has n rules.
+func waitPolicy(t *testing.T, a *Authorizer, n int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for len(a.Policy().Rules) != n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Len(t, a.Policy().Rules, n)
+}
+
+func TestWatchEtcd(t *testing.T) {
+	s, err := etcdtest.NewServer()
+	require.NoError(t, err)
+	defer s.Close()
+	client, err := etcd3.New(etcd3.Config{Endpoints: s.Endpoints()})
+	require.NoError(t, err)
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s.Put("/policy", policyJSON)
+	a := NewAuthorizer(nil)
+	require.NoError(t, a.WatchEtcd(ctx, client, "/policy"))
+	require.Len(t, a.Policy().Rules, 5)
+	s.Put("/policy", `{"rules": [{"method": "*", "public": true}]}`)
+	waitPolicy(t, a, 1)
+
+	// the changes missed while disconnected are compacted, so the policy is read again
+	s.Stop()
+	s.Put("/policy", `{"rules": [{"method": "*", "public": true}, {"method": "/a.A/B"}]}`)
+	s.Put("/other", "x")
+	s.Compact(s.Revision())
+	require.NoError(t, s.Start())
+	waitPolicy(t, a, 2)
+
+	// and watched from the current revision
+	s.Put("/policy", policyJSON)
+	waitPolicy(t, a, 5)
+}
@@ -0,0 +1,79 @@
+// Package recovery turns panics in grpc handlers into grpc_error.Internal errors instead of crashing the node.
+package recovery
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"strings"
+
+	"github.com/chuangyou/qsf/grpc_error"
+	"github.com/chuangyou/qsf/internal/grpcmethod"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// Recovery recovers panics of grpc handlers and counts them. It implements prometheus.Collector,
+// so it can be registered on the registry of the service monitor.
+type Recovery struct {
+	debug        bool
+	panicCounter *prom.CounterVec
+}
+
+// New returns a Recovery. In debug mode the returned errors carry an errdetails.DebugInfo with the panic stack.
+func New(debug bool) *Recovery {
+	return &Recovery{
+		debug: debug,
+		panicCounter: prom.NewCounterVec(
+			prom.CounterOpts{
+				Name: "grpc_server_panics_total",
+				Help: "Total number of panics recovered in gRPC handlers.",
+			}, []string{"grpc_service", "grpc_method"}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (r *Recovery) Describe(ch chan<- *prom.Desc) {
+	r.panicCounter.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (r *Recovery) Collect(ch chan<- prom.Metric) {
+	r.panicCounter.Collect(ch)
+}
+
+// UnaryServerInterceptor recovers panics of unary handlers.
+func (r *Recovery) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = r.recovered(info.FullMethod, p)
+			}
+		}()
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor recovers panics of stream handlers.
+func (r *Recovery) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = r.recovered(info.FullMethod, p)
+			}
+		}()
+		return handler(srv, stream)
+	}
+}
+
+func (r *Recovery) recovered(fullMethod string, p interface{}) error {
+	stack := string(debug.Stack())
+	log.Printf("grpc handler %s panic: %v\n%s", fullMethod, p, stack)
+	service, method := grpcmethod.Split(fullMethod)
+	r.panicCounter.WithLabelValues(service, method).Inc()
+	if r.debug {
+		return grpc_error.InternalWithDebugInfo(fmt.Sprint(p), strings.Split(strings.TrimSpace(stack), "\n"))
+	}
+	return grpc_error.Internal()
+}
@@ -0,0 +1,58 @@
+package recovery
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const fullMethod = "/chuangyou.touyuan.example.v1.ExampleService/GetExample"
+
+func panicHandler(ctx context.Context, req interface{}) (interface{}, error) {
+	panic("boom")
+}
+
+func TestUnaryServerInterceptorRecovers(t *testing.T) {
+	r := New(false)
+	_, err := r.UnaryServerInterceptor()(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: fullMethod}, panicHandler)
+	st := status.Convert(err)
+	assert.Equal(t, codes.Internal, st.Code())
+	assert.Empty(t, st.Details())
+	assert.Equal(t, float64(1), testutil.ToFloat64(r.panicCounter.WithLabelValues("chuangyou.touyuan.example.v1.ExampleService", "GetExample")))
+}
+
+func TestUnaryServerInterceptorDebugInfo(t *testing.T) {
+	r := New(true)
+	_, err := r.UnaryServerInterceptor()(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: fullMethod}, panicHandler)
+	st := status.Convert(err)
+	require.Equal(t, codes.Internal, st.Code())
+	require.Len(t, st.Details(), 1)
+	info, ok := st.Details()[0].(*epb.DebugInfo)
+	require.True(t, ok)
+	assert.Equal(t, "boom", info.Detail)
+	assert.NotEmpty(t, info.StackEntries)
+}
+
+func TestStreamServerInterceptorRecovers(t *testing.T) {
+	r := New(false)
+	err := r.StreamServerInterceptor()(nil, nil, &grpc.StreamServerInfo{FullMethod: fullMethod}, func(srv interface{}, stream grpc.ServerStream) error {
+		panic("boom")
+	})
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
+
+func TestPassThrough(t *testing.T) {
+	r := New(true)
+	resp, err := r.UnaryServerInterceptor()(context.Background(), "req", &grpc.UnaryServerInfo{FullMethod: fullMethod}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return req, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "req", resp)
+}
@@ -0,0 +1,151 @@
+// Package validator validates grpc requests before they reach the handler.
+//
+// A request is validated when it has a Validate() error method, or a ValidateAll() error method which
+// takes precedence, as generated by protoc-gen-validate. Every violation is reported in a single
+// errdetails.BadRequest, so the gateway returns all of them in one 400 response.
+package validator
+
+import (
+	"strings"
+
+	"github.com/chuangyou/qsf/grpc_error"
+	"golang.org/x/net/context"
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+)
+
+type validator interface {
+	Validate() error
+}
+
+type allValidator interface {
+	ValidateAll() error
+}
+
+// fieldError is implemented by the field errors generated by protoc-gen-validate and by FieldError.
+type fieldError interface {
+	Field() string
+	Reason() string
+}
+
+// multiError is implemented by the MultiError types generated by protoc-gen-validate and by Errors.
+type multiError interface {
+	AllErrors() []error
+}
+
+// FieldError is a violation of a single field, for requests with hand-written Validate methods.
+type FieldError struct {
+	FieldName   string
+	Description string
+}
+
+func (e FieldError) Field() string {
+	return e.FieldName
+}
+func (e FieldError) Reason() string {
+	return e.Description
+}
+func (e FieldError) Error() string {
+	return e.FieldName + ": " + e.Description
+}
+
+// Errors collects the violations of a request, for requests with hand-written Validate methods.
+// A nil or empty Errors should not be returned as an error; use Err.
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+func (e Errors) AllErrors() []error {
+	return e
+}
+
+// Err returns nil when there is no violation.
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// UnaryServerInterceptor validates unary requests.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := Validate(req); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor validates every message received on a stream.
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &validatingStream{ServerStream: stream})
+	}
+}
+
+type validatingStream struct {
+	grpc.ServerStream
+}
+
+func (s *validatingStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return Validate(m)
+}
+
+// Validate validates req and returns a grpc_error.BadRequest listing every violation, or nil.
+func Validate(req interface{}) error {
+	var (
+		err error
+	)
+	if v, ok := req.(allValidator); ok {
+		err = v.ValidateAll()
+	} else if v, ok := req.(validator); ok {
+		err = v.Validate()
+	}
+	if err == nil {
+		return nil
+	}
+	return grpc_error.BadRequest(fieldViolations("", err))
+}
+
+func fieldViolations(prefix string, err error) (violations []*epb.BadRequest_FieldViolation) {
+	if m, ok := err.(multiError); ok {
+		for _, e := range m.AllErrors() {
+			violations = append(violations, fieldViolations(prefix, e)...)
+		}
+		return
+	}
+	f, ok := err.(fieldError)
+	if !ok {
+		return []*epb.BadRequest_FieldViolation{{Field: prefix, Description: err.Error()}}
+	}
+	field := joinField(prefix, f.Field())
+	// protoc-gen-validate wraps the errors of embedded messages
+	if c, ok := err.(interface{ Cause() error }); ok && c.Cause() != nil {
+		if _, nested := c.Cause().(fieldError); nested {
+			return fieldViolations(field, c.Cause())
+		}
+		if _, nested := c.Cause().(multiError); nested {
+			return fieldViolations(field, c.Cause())
+		}
+	}
+	return []*epb.BadRequest_FieldViolation{{Field: field, Description: f.Reason()}}
+}
+
+func joinField(prefix, field string) string {
+	if prefix == "" {
+		return field
+	}
+	if field == "" {
+		return prefix
+	}
+	return prefix + "." + field
+}
@@ -0,0 +1,126 @@
+package validator
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// pgvError mimics the field errors generated by protoc-gen-validate.
+type pgvError struct {
+	field  string
+	reason string
+	cause  error
+}
+
+func (e pgvError) Field() string  { return e.field }
+func (e pgvError) Reason() string { return e.reason }
+func (e pgvError) Cause() error   { return e.cause }
+func (e pgvError) Error() string  { return "invalid " + e.field + ": " + e.reason }
+
+// pgvMultiError mimics the MultiError types generated by protoc-gen-validate.
+type pgvMultiError []error
+
+func (m pgvMultiError) Error() string      { return "multiple errors" }
+func (m pgvMultiError) AllErrors() []error { return m }
+
+type pgvRequest struct{}
+
+func (r *pgvRequest) Validate() error {
+	return pgvError{field: "name", reason: "value length must be at least 1 runes"}
+}
+func (r *pgvRequest) ValidateAll() error {
+	return pgvMultiError{
+		pgvError{field: "name", reason: "value length must be at least 1 runes"},
+		pgvError{field: "address", reason: "embedded message failed validation", cause: pgvMultiError{
+			pgvError{field: "city", reason: "value is required"},
+		}},
+	}
+}
+
+type handWrittenRequest struct {
+	value string
+}
+
+func (r *handWrittenRequest) Validate() error {
+	var errs Errors
+	if r.value == "" {
+		errs = append(errs, FieldError{FieldName: "value", Description: "输入的值不能为空！"})
+	}
+	return errs.Err()
+}
+
+type plainError struct{}
+
+func (r *plainError) Validate() error {
+	return errors.New("bad request")
+}
+
+func badRequest(t *testing.T, err error) []*epb.BadRequest_FieldViolation {
+	st := status.Convert(err)
+	require.Equal(t, codes.InvalidArgument, st.Code())
+	require.Len(t, st.Details(), 1)
+	br, ok := st.Details()[0].(*epb.BadRequest)
+	require.True(t, ok)
+	return br.FieldViolations
+}
+
+func TestValidateAllReportsEveryField(t *testing.T) {
+	violations := badRequest(t, Validate(&pgvRequest{}))
+	require.Len(t, violations, 2)
+	assert.Equal(t, "name", violations[0].Field)
+	assert.Equal(t, "value length must be at least 1 runes", violations[0].Description)
+	assert.Equal(t, "address.city", violations[1].Field)
+	assert.Equal(t, "value is required", violations[1].Description)
+}
+
+func TestHandWrittenValidate(t *testing.T) {
+	violations := badRequest(t, Validate(&handWrittenRequest{}))
+	require.Len(t, violations, 1)
+	assert.Equal(t, "value", violations[0].Field)
+	assert.NoError(t, Validate(&handWrittenRequest{value: "ok"}))
+}
+
+func TestPlainError(t *testing.T) {
+	violations := badRequest(t, Validate(&plainError{}))
+	require.Len(t, violations, 1)
+	assert.Equal(t, "", violations[0].Field)
+	assert.Equal(t, "bad request", violations[0].Description)
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	called := false
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		called = true
+		return nil, nil
+	}
+	_, err := UnaryServerInterceptor()(context.Background(), &handWrittenRequest{}, &grpc.UnaryServerInfo{}, handler)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.False(t, called)
+
+	_, err = UnaryServerInterceptor()(context.Background(), "not validatable", &grpc.UnaryServerInfo{}, handler)
+	assert.NoError(t, err)
+	assert.True(t, called)
+}
+
+type recvStream struct {
+	grpc.ServerStream
+}
+
+func (s *recvStream) RecvMsg(m interface{}) error {
+	return nil
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	err := StreamServerInterceptor()(nil, &recvStream{}, &grpc.StreamServerInfo{}, func(srv interface{}, stream grpc.ServerStream) error {
+		return stream.RecvMsg(&handWrittenRequest{})
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"github.com/chuangyou/qsf/internal/chain"
+	"github.com/chuangyou/qsf/plugin/rbac"
+	"github.com/grpc-ecosystem/go-grpc-middleware/auth"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// Names of the interceptors that can be ordered through Config.InterceptorOrder, along with the names of Config.Interceptors.
+// InterceptorCustom stands for Config.UnaryInterceptors and Config.StreamInterceptors.
+const (
+	InterceptorRecovery    = "recovery"
+	InterceptorAuth        = "auth"
+	InterceptorRBAC        = "rbac"
+	InterceptorRateLimit   = "ratelimit"
+	InterceptorConcurrency = "concurrency"
+	InterceptorPrometheus  = "prometheus"
+	InterceptorTracing     = "tracing"
+	InterceptorValidator   = "validator"
+	InterceptorCustom      = "custom"
+)
+
+// DefaultInterceptorOrder returns the order used when Config.InterceptorOrder is empty. The first interceptor
+// is the outermost one: recovery comes first so that panics in any other interceptor are caught, prometheus and
+// tracing come next so that the requests rejected by auth, rbac, ratelimit or concurrency are counted and traced too,
+// and rbac needs the caller authenticated by auth.
+// Names missing from a configured order are appended in this order, Config.Interceptors right after custom.
+func DefaultInterceptorOrder() []string {
+	return []string{
+		InterceptorRecovery,
+		InterceptorPrometheus,
+		InterceptorTracing,
+		InterceptorAuth,
+		InterceptorRBAC,
+		InterceptorRateLimit,
+		InterceptorConcurrency,
+		InterceptorValidator,
+		InterceptorCustom,
+	}
+}
+
+// Interceptor is a custom interceptor in a slot of its own, its name orders it through Config.InterceptorOrder.
+type Interceptor struct {
+	Name   string                       //拦截器名称，不能与内置拦截器重名
+	Unary  grpc.UnaryServerInterceptor  //unary拦截器（可选）
+	Stream grpc.StreamServerInterceptor //stream拦截器（可选）
+}
+
+// interceptorChain collects the interceptors of a service by name, so they can be chained in the configured order.
+type interceptorChain struct {
+	*chain.Chain
+}
+
+func newInterceptorChain() *interceptorChain {
+	return &interceptorChain{chain.New("service", DefaultInterceptorOrder())}
+}
+
+// add appends the interceptors under name, nil interceptors are skipped.
+func (c *interceptorChain) add(name string, unary grpc.UnaryServerInterceptor, stream grpc.StreamServerInterceptor) {
+	var (
+		u, s interface{}
+	)
+	if unary != nil {
+		u = unary
+	}
+	if stream != nil {
+		s = stream
+	}
+	c.Add(name, u, s)
+}
+
+// build returns the interceptors sorted by order.
+func (c *interceptorChain) build(order []string) (unary []grpc.UnaryServerInterceptor, stream []grpc.StreamServerInterceptor, err error) {
+	u, s, err := c.Build(order)
+	if err != nil {
+		return
+	}
+	for _, interceptor := range u {
+		unary = append(unary, interceptor.(grpc.UnaryServerInterceptor))
+	}
+	for _, interceptor := range s {
+		stream = append(stream, interceptor.(grpc.StreamServerInterceptor))
+	}
+	return
+}
+
+// authUnaryServerInterceptor authenticates callers with authFunc, except for the methods the authorizer marks public.
+func authUnaryServerInterceptor(authFunc grpc_auth.AuthFunc, authorizer *rbac.Authorizer) grpc.UnaryServerInterceptor {
+	auth := grpc_auth.UnaryServerInterceptor(authFunc)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if authorizer != nil && authorizer.IsPublic(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		return auth(ctx, req, info, handler)
+	}
+}
+
+// authStreamServerInterceptor authenticates callers with authFunc, except for the methods the authorizer marks public.
+func authStreamServerInterceptor(authFunc grpc_auth.AuthFunc, authorizer *rbac.Authorizer) grpc.StreamServerInterceptor {
+	auth := grpc_auth.StreamServerInterceptor(authFunc)
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if authorizer != nil && authorizer.IsPublic(info.FullMethod) {
+			return handler(srv, stream)
+		}
+		return auth(srv, stream, info, handler)
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chuangyou/qsf/plugin/ratelimit"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func recordingInterceptor(name string, calls *[]string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		*calls = append(*calls, name)
+		return handler(ctx, req)
+	}
+}
+
+func callChain(t *testing.T, chain *interceptorChain, order []string) []string {
+	unary, _, err := chain.build(order)
+	require.NoError(t, err)
+	var calls []string
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		calls = append(calls, "handler")
+		return nil, nil
+	}
+	for i := len(unary) - 1; i >= 0; i-- {
+		interceptor, next := unary[i], handler
+		handler = func(ctx context.Context, req interface{}) (interface{}, error) {
+			return interceptor(ctx, req, &grpc.UnaryServerInfo{}, next)
+		}
+	}
+	handler(context.Background(), nil)
+	return calls
+}
+
+func TestInterceptorChainOrder(t *testing.T) {
+	var calls []string
+	chain := newInterceptorChain()
+	chain.add(InterceptorTracing, recordingInterceptor("tracing", &calls), nil)
+	chain.add(InterceptorAuth, recordingInterceptor("auth", &calls), nil)
+	chain.add(InterceptorCustom, recordingInterceptor("custom1", &calls), nil)
+	chain.add(InterceptorCustom, recordingInterceptor("custom2", &calls), nil)
+	chain.add(InterceptorPrometheus, recordingInterceptor("prometheus", &calls), nil)
+
+	calls = nil
+	callChain(t, chain, nil)
+	assert.Equal(t, []string{"prometheus", "tracing", "auth", "custom1", "custom2"}, calls)
+
+	calls = nil
+	callChain(t, chain, []string{InterceptorTracing, InterceptorPrometheus, InterceptorCustom})
+	assert.Equal(t, []string{"tracing", "prometheus", "custom1", "custom2", "auth"}, calls)
+}
+
+// handledTotal returns grpc_server_handled_total of the service for code.
+func handledTotal(t *testing.T, s *Service, code codes.Code) (total float64) {
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(s.grpcMetrics))
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != "grpc_server_handled_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "grpc_code" && label.GetValue() == code.String() {
+					total += metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return
+}
+
+func TestRejectedCallsCounted(t *testing.T) {
+	s, err := NewSevice(&Config{Name: "example", Addr: freeAddr(t), NodeId: "node-1", MonitorListenAddr: freeAddr(t),
+		RateLimter: ratelimit.New(1, time.Hour)})
+	require.NoError(t, err)
+	require.NoError(t, s.Start(context.Background()))
+	defer s.Stop(context.Background())
+	conn, err := grpc.Dial(s.Addr, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	client := healthpb.NewHealthClient(conn)
+	_, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	// the rate-limited call is counted by the default order
+	assert.Equal(t, float64(1), handledTotal(t, s, codes.OK))
+	assert.Equal(t, float64(1), handledTotal(t, s, codes.ResourceExhausted))
+}
+
+func TestInterceptorChainRejectsBadOrder(t *testing.T) {
+	chain := newInterceptorChain()
+	_, _, err := chain.build([]string{InterceptorAuth, "unknown"})
+	assert.Error(t, err)
+	_, _, err = chain.build([]string{InterceptorAuth, InterceptorAuth})
+	assert.Error(t, err)
+}
+
+func TestNamedInterceptors(t *testing.T) {
+	var calls []string
+	_, err := NewSevice(&Config{Name: "example", Addr: "127.0.0.1:0", NodeId: "node-1",
+		Interceptors: []Interceptor{{Name: InterceptorAuth, Unary: recordingInterceptor("audit", &calls)}}})
+	assert.Error(t, err, "the name of a builtin interceptor is taken")
+
+	chain := newInterceptorChain()
+	require.NoError(t, chain.Slot("audit", InterceptorCustom))
+	chain.add("audit", recordingInterceptor("audit", &calls), nil)
+	chain.add(InterceptorCustom, recordingInterceptor("custom", &calls), nil)
+	chain.add(InterceptorAuth, recordingInterceptor("auth", &calls), nil)
+	calls = nil
+	callChain(t, chain, nil)
+	assert.Equal(t, []string{"auth", "custom", "audit"}, calls)
+	calls = nil
+	callChain(t, chain, []string{"audit"})
+	assert.Equal(t, []string{"audit", "auth", "custom"}, calls)
+}
@@ -1,201 +1,651 @@
 package server
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
 	"errors"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/chuangyou/qsf/constant"
 	"github.com/chuangyou/qsf/grpc_error"
+	"github.com/chuangyou/qsf/plugin/concurrency"
+	"github.com/chuangyou/qsf/plugin/config"
+	"github.com/chuangyou/qsf/plugin/credential"
+	"github.com/chuangyou/qsf/plugin/graceful"
+	"github.com/chuangyou/qsf/plugin/health"
+	"github.com/chuangyou/qsf/plugin/jwt"
+	"github.com/chuangyou/qsf/plugin/loadbalance"
+	"github.com/chuangyou/qsf/plugin/loadbalance/registry"
+	_ "github.com/chuangyou/qsf/plugin/loadbalance/registry/consul"
+	_ "github.com/chuangyou/qsf/plugin/loadbalance/registry/dns"
 	etcd_registry "github.com/chuangyou/qsf/plugin/loadbalance/registry/etcd"
+	_ "github.com/chuangyou/qsf/plugin/loadbalance/registry/static"
+	_ "github.com/chuangyou/qsf/plugin/loadbalance/registry/zookeeper"
 	"github.com/chuangyou/qsf/plugin/prometheus"
 	"github.com/chuangyou/qsf/plugin/ratelimit"
+	"github.com/chuangyou/qsf/plugin/rbac"
+	"github.com/chuangyou/qsf/plugin/recovery"
 	"github.com/chuangyou/qsf/plugin/tracing"
-	etcd "github.com/coreos/etcd/clientv3"
+	"github.com/chuangyou/qsf/plugin/validator"
 	"github.com/grpc-ecosystem/go-grpc-middleware"
-	"github.com/grpc-ecosystem/go-grpc-middleware/auth"
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 )
 
+// healthServiceName is the grpc health service registered on every service.
+const healthServiceName = "grpc.health.v1.Health"
+
 type Config struct {
-	Name              string                 //服务名称
-	Addr              string                 //服务地址
-	NodeId            string                 //服务节点
-	RegistryAddrs     []string               //服务注册地址
-	AccessToken       string                 //服务密钥
-	RateLimter        *ratelimit.RateLimiter //服务限流器
-	MonitorListenAddr string                 //服务监控地址
-	Tracer            opentracing.Tracer     //服务tracer
+	Name               string                         //服务名称
+	Addr               string                         //服务地址
+	NodeId             string                         //服务节点
+	RegistryAddrs      []string                       //服务注册地址，为空且未设置RegistryKind、Registry时不注册（直连模式）
+	RegistryKind       string                         //注册中心类型：etcd（默认）、consul、zookeeper、dns、static（可选）
+	Registry           registry.Registry              //自定义注册中心，设置后忽略RegistryKind和RegistryAddrs（可选）
+	Version            string                         //服务版本（可选）
+	Tags               []string                       //服务标签（可选）
+	Metadata           map[string]string              //服务自定义元数据（可选）
+	Weight             int                            //节点权重，用于客户端加权负载均衡，默认为1（可选）
+	Region             string                         //节点所在地域，默认读取环境变量QSF_REGION（可选）
+	Zone               string                         //节点所在可用区，默认读取环境变量QSF_ZONE（可选）
+	AccessToken        string                         //服务密钥
+	JWTVerifier        *jwt.Verifier                  //JWT校验器，设置后支持Bearer令牌认证（可选）
+	Authorizer         *rbac.Authorizer               //方法级授权策略（可选）
+	RateLimter         *ratelimit.RateLimiter         //服务限流器
+	DistributedLimit   *ratelimit.DistributedOption   //集群限流，所有节点共享Quota，设置后忽略RateLimter；Name、NodeID及etcd地址默认为服务名、节点ID及RegistryAddrs（可选）
+	RateLimitRules     []ratelimit.Rule               //按方法及调用方的限流规则，每条规则单独计数（可选）
+	RateLimitMaxKeys   int                            //按调用方限流时保留的最大key数，超过后淘汰最久未使用的，默认ratelimit.DefaultMaxKeys（可选）
+	ConcurrencyLimit   concurrency.Limit              //服务并发限制（最大处理中请求数），如concurrency.NewFixedLimit、NewAIMDLimit、NewGradientLimit（可选）
+	MonitorListenAddr  string                         //服务监控地址
+	Tracer             opentracing.Tracer             //服务tracer
+	RestartTimeout     time.Duration                  //热重启等待新进程就绪的超时时间
+	DeregisterDelay    time.Duration                  //关闭时注销后等待客户端感知的时间，期间继续处理请求
+	ShutdownTimeout    time.Duration                  //优雅关闭超时时间，超时后强制关闭
+	TLSCertFile        string                         //TLS证书（可选）
+	TLSKeyFile         string                         //TLS私钥（可选）
+	TLSClientCAFile    string                         //客户端CA证书，设置后校验客户端证书（双向TLS，可选）
+	UnaryInterceptors  []grpc.UnaryServerInterceptor  //自定义unary拦截器（可选）
+	StreamInterceptors []grpc.StreamServerInterceptor //自定义stream拦截器（可选）
+	Interceptors       []Interceptor                  //具名的自定义拦截器，可按名称排序，默认依次位于custom之后（可选）
+	InterceptorOrder   []string                       //拦截器顺序，默认为DefaultInterceptorOrder()（可选）
+	Debug              bool                           //调试模式，handler panic时错误中返回堆栈信息
+	ServerOptions      []grpc.ServerOption            //自定义grpc.ServerOption，拦截器请使用UnaryInterceptors/StreamInterceptors（可选）
+	ConfigCenter       *config.Center                 //动态配置中心，限流、服务密钥（已设置AccessToken时）及日志级别随配置更新（可选）
 }
 type Service struct {
 	Addr              string       //服务地址
-	AccessToken       string       //服务密钥
+	AccessToken       string       //启动时的服务密钥，运行中由SetAccessToken或配置中心更新
 	GrpcServer        *grpc.Server //grpc实例
 	monitorHttpServer *http.Server
 	grpcMetrics       *grpc_prometheus.ServerMetrics
+	registry          registry.Registry
+	name              string
+	nodeId            string
+	nodeData          registry.NodeData
+	accessToken       atomic.Value
+	configCancels     []func()
+	distributed       *ratelimit.DistributedLimiter
+	healthServer      *health.Server
+	jwtVerifier       *jwt.Verifier
+	mu                sync.Mutex
+	registryMu        sync.Mutex //serializes the registry calls, which are made without mu
+	started           bool
+	registered        bool
+	restartTimeout    time.Duration
+	deregisterDelay   time.Duration
+	shutdownTimeout   time.Duration
+	errc              chan error
 }
 
 func NewSevice(config *Config) (service *Service, err error) {
 	var (
+		tlsConfig                *tls.Config
+		serverOpts               []grpc.ServerOption
+		chain                    = newInterceptorChain()
+		panicRecovery            *recovery.Recovery
+		keyedLimiter             *ratelimit.KeyedLimiter
+		concurrencyLimiter       *concurrency.Limiter
+		rateLimiter              = config.RateLimter
 		unaryServerInterceptors  []grpc.UnaryServerInterceptor
 		streamServerInterceptors []grpc.StreamServerInterceptor
 	)
-	if config.Name == "" || config.Addr == "" || config.NodeId == "" || len(config.RegistryAddrs) == 0 {
+	if config.Name == "" || config.Addr == "" || config.NodeId == "" {
 		err = errors.New("service config data error")
 		return
 	}
+	//unwind what was set up before the error
+	defer func() {
+		if err == nil || service == nil {
+			return
+		}
+		service.cancelConfig()
+		if service.distributed != nil {
+			service.distributed.Close()
+		}
+	}()
+	//enable TLS, and mutual TLS when a client CA is configured
+	if config.TLSCertFile != "" || config.TLSKeyFile != "" {
+		tlsConfig, err = credential.NewServerTLSConfig(config.TLSCertFile, config.TLSKeyFile, config.TLSClientCAFile)
+		if err != nil {
+			return
+		}
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	} else if config.TLSClientCAFile != "" {
+		err = errors.New("service tls config error")
+		return
+	}
 	service = new(Service)
 	service.Addr = config.Addr
-	//register a service to etcd
-	err = service.registry(config.RegistryAddrs, config.Name, config.Addr, config.NodeId)
-	if err != nil {
-		return
+	service.errc = make(chan error, 2)
+	service.restartTimeout = config.RestartTimeout
+	if service.restartTimeout <= 0 {
+		service.restartTimeout = constant.DEFAULT_RESTART_TIMEOUT
+	}
+	service.deregisterDelay = config.DeregisterDelay
+	service.shutdownTimeout = config.ShutdownTimeout
+	if service.shutdownTimeout <= 0 {
+		service.shutdownTimeout = constant.DEFAULT_SHUTDOWN_TIMEOUT
 	}
-	//service accessToken
+	//recover handler panics
+	panicRecovery = recovery.New(config.Debug)
+	chain.add(InterceptorRecovery, panicRecovery.UnaryServerInterceptor(), panicRecovery.StreamServerInterceptor())
+	//service accessToken and jwt
 	service.AccessToken = config.AccessToken
-	if service.AccessToken != "" {
-		unaryServerInterceptors = append(unaryServerInterceptors, grpc_auth.UnaryServerInterceptor(service.AuthFunc))
-		streamServerInterceptors = append(streamServerInterceptors, grpc_auth.StreamServerInterceptor(service.AuthFunc))
+	service.accessToken.Store(config.AccessToken)
+	service.jwtVerifier = config.JWTVerifier
+	if service.AccessToken != "" || service.jwtVerifier != nil {
+		chain.add(InterceptorAuth, authUnaryServerInterceptor(service.AuthFunc, config.Authorizer), authStreamServerInterceptor(service.AuthFunc, config.Authorizer))
+	}
+	//enable method authorization
+	if config.Authorizer != nil {
+		chain.add(InterceptorRBAC, config.Authorizer.UnaryServerInterceptor(), config.Authorizer.StreamServerInterceptor())
+	}
+	//enable method and caller ratelimit, before the service ratelimit
+	if len(config.RateLimitRules) > 0 {
+		keyedLimiter, err = ratelimit.NewKeyedLimiter(config.RateLimitRules, config.RateLimitMaxKeys)
+		if err != nil {
+			return
+		}
+		chain.add(InterceptorRateLimit, keyedLimiter.UnaryServerInterceptor(), keyedLimiter.StreamServerInterceptor())
+	}
+	//enable cluster ratelimit, the node limits itself to its share of the quota once it joined in Start
+	if config.DistributedLimit != nil {
+		if service.distributed, err = newDistributedLimiter(config); err != nil {
+			return
+		}
+		rateLimiter = service.distributed.RateLimiter()
 	}
 	//enable service ratelimit
-	if config.RateLimter != nil {
-		unaryServerInterceptors = append(unaryServerInterceptors, ratelimit.UnaryServerInterceptor(config.RateLimter))
-		streamServerInterceptors = append(streamServerInterceptors, ratelimit.StreamServerInterceptor(config.RateLimter))
+	if rateLimiter != nil {
+		chain.add(InterceptorRateLimit, ratelimit.UnaryServerInterceptor(rateLimiter), ratelimit.StreamServerInterceptor(rateLimiter))
+	}
+	//enable concurrency limit, after the ratelimit so that rejected requests hold no slot
+	if config.ConcurrencyLimit != nil {
+		concurrencyLimiter = concurrency.New(config.ConcurrencyLimit)
+		chain.add(InterceptorConcurrency, concurrencyLimiter.UnaryServerInterceptor(), concurrencyLimiter.StreamServerInterceptor())
 	}
 	//enable service monitor
 	if config.MonitorListenAddr != "" {
 		prometheusRegistry := prometheus.NewRegistry()
 		service.grpcMetrics = grpc_prometheus.NewServerMetrics()
 		service.grpcMetrics.EnableHandlingTimeHistogram()
-		prometheusRegistry.MustRegister(service.grpcMetrics)
+		prometheusRegistry.MustRegister(service.grpcMetrics, panicRecovery, etcd_registry.Collector())
+		if concurrencyLimiter != nil {
+			prometheusRegistry.MustRegister(concurrencyLimiter)
+		}
 		service.monitorHttpServer = &http.Server{Handler: promhttp.HandlerFor(prometheusRegistry, promhttp.HandlerOpts{}), Addr: config.MonitorListenAddr}
-		unaryServerInterceptors = append(unaryServerInterceptors, grpc.UnaryServerInterceptor(service.grpcMetrics.UnaryServerInterceptor()))
-		streamServerInterceptors = append(streamServerInterceptors, grpc.StreamServerInterceptor(service.grpcMetrics.StreamServerInterceptor()))
+		chain.add(InterceptorPrometheus, service.grpcMetrics.UnaryServerInterceptor(), service.grpcMetrics.StreamServerInterceptor())
 	}
 	//enable the tracer
 	if config.Tracer != nil {
-		unaryServerInterceptors = append(unaryServerInterceptors, grpc.UnaryServerInterceptor(otgrpc.OpenTracingServerInterceptor(config.Tracer, otgrpc.LogPayloads())))
-		streamServerInterceptors = append(streamServerInterceptors, grpc.StreamServerInterceptor(otgrpc.OpenTracingStreamServerInterceptor(config.Tracer, otgrpc.LogPayloads())))
-	}
-	if len(unaryServerInterceptors) > 0 && len(streamServerInterceptors) > 0 {
-		service.GrpcServer = grpc.NewServer(
-			grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(unaryServerInterceptors...)),
-			grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(streamServerInterceptors...)),
-		)
-	} else if len(unaryServerInterceptors) > 0 {
-		service.GrpcServer = grpc.NewServer(
-			grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(unaryServerInterceptors...)),
-		)
-	} else if len(streamServerInterceptors) > 0 {
-		service.GrpcServer = grpc.NewServer(
-			grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(streamServerInterceptors...)),
-		)
-	} else {
-		service.GrpcServer = grpc.NewServer()
+		chain.add(InterceptorTracing, otgrpc.OpenTracingServerInterceptor(config.Tracer, otgrpc.LogPayloads()), otgrpc.OpenTracingStreamServerInterceptor(config.Tracer, otgrpc.LogPayloads()))
+	}
+	//validate requests that have a Validate method
+	chain.add(InterceptorValidator, validator.UnaryServerInterceptor(), validator.StreamServerInterceptor())
+	//custom interceptors
+	for _, interceptor := range config.UnaryInterceptors {
+		chain.add(InterceptorCustom, interceptor, nil)
+	}
+	for _, interceptor := range config.StreamInterceptors {
+		chain.add(InterceptorCustom, nil, interceptor)
+	}
+	slot := InterceptorCustom
+	for _, interceptor := range config.Interceptors {
+		if err = chain.Slot(interceptor.Name, slot); err != nil {
+			return
+		}
+		chain.add(interceptor.Name, interceptor.Unary, interceptor.Stream)
+		slot = interceptor.Name
+	}
+	unaryServerInterceptors, streamServerInterceptors, err = chain.build(config.InterceptorOrder)
+	if err != nil {
+		return
+	}
+	if len(unaryServerInterceptors) > 0 {
+		serverOpts = append(serverOpts, grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(unaryServerInterceptors...)))
+	}
+	if len(streamServerInterceptors) > 0 {
+		serverOpts = append(serverOpts, grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(streamServerInterceptors...)))
+	}
+	serverOpts = append(serverOpts, config.ServerOptions...)
+	service.GrpcServer = grpc.NewServer(serverOpts...)
+	//grpc health checking service
+	service.healthServer = health.NewServer()
+	healthpb.RegisterHealthServer(service.GrpcServer, service.healthServer)
+	//register a service to the registry
+	service.nodeData = registry.NodeData{
+		Addr:     config.Addr,
+		Version:  config.Version,
+		Region:   config.Region,
+		Zone:     config.Zone,
+		Tags:     config.Tags,
+		Metadata: make(map[string]string, len(config.Metadata)+1),
+	}
+	if service.nodeData.Region == "" {
+		service.nodeData.Region = os.Getenv(loadbalance.EnvRegion)
+	}
+	if service.nodeData.Zone == "" {
+		service.nodeData.Zone = os.Getenv(loadbalance.EnvZone)
+	}
+	for k, v := range config.Metadata {
+		service.nodeData.Metadata[k] = v
+	}
+	if config.Weight > 0 {
+		service.nodeData.Metadata[loadbalance.WeightKey] = strconv.Itoa(config.Weight)
+	}
+	service.name = config.Name
+	service.nodeId = config.NodeId
+	//update the settings from the config center
+	if config.ConfigCenter != nil {
+		if err = service.watchConfig(config); err != nil {
+			return
+		}
+	}
+	//without a registry the node is only reachable by direct connection
+	service.registry = config.Registry
+	if service.registry == nil && (len(config.RegistryAddrs) > 0 || config.RegistryKind != "") {
+		kind := config.RegistryKind
+		if kind == "" {
+			kind = etcd_registry.Kind
+		}
+		service.registry, err = registry.NewRegistry(kind, config.RegistryAddrs)
+		if err != nil {
+			return
+		}
 	}
 
 	return
 
 }
-func (s *Service) registry(registryAddrs []string, serviceName, serviceAddr, serviceNodeId string) (err error) {
+
+// watchConfig subscribes the rate limiter, the access token and the log level to the config center.
+func (s *Service) watchConfig(c *Config) (err error) {
 	var (
-		registry *etcd_registry.EtcdReigistry
+		cancel func()
 	)
-	//register a service to etcd
-	registry, err = etcd_registry.NewRegistry(
-		etcd_registry.Option{
-			EtcdConfig: etcd.Config{
-				Endpoints: registryAddrs,
-			},
-			RegistryDir: constant.DEFAULT_ETCD_PATH,
-			ServiceName: serviceName,
-			NodeID:      serviceNodeId,
-			NData: etcd_registry.NodeData{
-				Addr: serviceAddr,
-				//Metadata: map[string]string{"service_version": serviceVersion},
-			},
-			Ttl: 10 * time.Second,
-		})
-	if err == nil {
-		go func() {
-			registry.Register()
-		}()
+	defer func() {
+		if err != nil {
+			s.cancelConfig()
+		}
+	}()
+	if cancel, err = config.WatchLogLevel(c.ConfigCenter); err != nil {
+		return
+	}
+	s.configCancels = append(s.configCancels, cancel)
+	//a token only applies when the service was started with token authentication
+	if s.AccessToken != "" {
+		if cancel, err = config.WatchAccessToken(c.ConfigCenter, s.SetAccessToken); err != nil {
+			return
+		}
+		s.configCancels = append(s.configCancels, cancel)
+	}
+	//in cluster ratelimit the configured rate is the quota of all nodes
+	if s.distributed != nil {
+		if cancel, err = ratelimit.WatchQuota(c.ConfigCenter, s.distributed); err != nil {
+			return
+		}
+		s.configCancels = append(s.configCancels, cancel)
+	} else if c.RateLimter != nil {
+		if cancel, err = ratelimit.Watch(c.ConfigCenter, c.RateLimter); err != nil {
+			return
+		}
+		s.configCancels = append(s.configCancels, cancel)
 	}
 	return
+}
+
+// newDistributedLimiter creates the cluster ratelimit of the service, the node joins it in Start.
+func newDistributedLimiter(c *Config) (*ratelimit.DistributedLimiter, error) {
+	option := *c.DistributedLimit
+	if option.Name == "" {
+		option.Name = c.Name
+	}
+	if option.NodeID == "" {
+		option.NodeID = c.NodeId
+	}
+	if len(option.EtcdConfig.Endpoints) == 0 {
+		option.EtcdConfig.Endpoints = c.RegistryAddrs
+	}
+	return ratelimit.NewDistributedLimiter(option)
+}
+
+func (s *Service) cancelConfig() {
+	for _, cancel := range s.configCancels {
+		cancel()
+	}
+	s.configCancels = nil
+}
 
+// SetAccessToken replaces the access token of a running service.
+func (s *Service) SetAccessToken(token string) {
+	s.accessToken.Store(token)
 }
 
-func (s *Service) Run() {
+// Start binds the service listeners, registers the node to the registry and serves in the background.
+// ctx only bounds the startup; use Stop to shut the service down and Err to observe serve errors.
+func (s *Service) Start(ctx context.Context) (err error) {
+	var (
+		lis        net.Listener
+		monitorLis net.Listener
+	)
+	lis, err = graceful.Listen(s.Addr)
+	if err != nil {
+		return
+	}
+	if s.monitorHttpServer != nil {
+		monitorLis, err = graceful.Listen(s.monitorHttpServer.Addr)
+		if err != nil {
+			lis.Close()
+			return
+		}
+	}
+	s.mu.Lock()
+	s.started = true
+	s.mu.Unlock()
+	if err = s.register(ctx); err != nil {
+		lis.Close()
+		if monitorLis != nil {
+			monitorLis.Close()
+		}
+		return
+	}
 	///enable service monitor server
-	if s.monitorHttpServer != nil && s.grpcMetrics != nil {
-		s.grpcMetrics.InitializeMetrics(s.GrpcServer)
+	if monitorLis != nil {
+		if s.grpcMetrics != nil {
+			s.grpcMetrics.InitializeMetrics(s.GrpcServer)
+		}
 		go func() {
-			if err := s.monitorHttpServer.ListenAndServe(); err != nil {
-				log.Fatalf("Unable to start a monitor http server.")
+			if err := s.monitorHttpServer.Serve(monitorLis); err != nil && err != http.ErrServerClosed {
+				s.errc <- err
 			}
 		}()
 	}
 	go func() {
-		lis, err := net.Listen("tcp", s.Addr)
-		if err != nil {
-			log.Fatalf("failed to listen: %v", err)
-		}
 		if err := s.GrpcServer.Serve(lis); err != nil {
-			log.Fatalf("failed to serve: %v", err)
+			s.errc <- err
 		}
 	}()
-	s.handleSignal()
+	//take a share of the cluster ratelimit now that the node serves
+	if s.distributed != nil {
+		s.distributed.Join()
+	}
+	return
+}
 
+// Err returns a channel that receives an error when the grpc or monitor server stops serving unexpectedly.
+func (s *Service) Err() <-chan error {
+	return s.errc
+}
+
+// Stop shuts the service down in order: the node is removed from the registry first, then the service keeps
+// serving for DeregisterDelay so that clients stop routing to it, and finally the grpc server and the
+// monitor server are drained. Draining is bounded by ShutdownTimeout and ctx, whichever ends first,
+// after which the servers are closed forcibly.
+func (s *Service) Stop(ctx context.Context) (err error) {
+	var (
+		cancel context.CancelFunc
+	)
+	s.healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	s.mu.Lock()
+	s.cancelConfig()
+	s.started = false
+	distributed := s.distributed
+	s.distributed = nil
+	s.mu.Unlock()
+	wasRegistered := s.unregister(ctx)
+	//leave the cluster ratelimit, the other nodes take the share of the node
+	if distributed != nil {
+		distributed.Close()
+	}
+	if wasRegistered && s.deregisterDelay > 0 {
+		select {
+		case <-time.After(s.deregisterDelay):
+		case <-ctx.Done():
+		}
+	}
+	ctx, cancel = context.WithTimeout(ctx, s.shutdownTimeout)
+	defer cancel()
+	return s.drain(ctx)
+}
+
+// SetServingStatus sets the status reported by the grpc health service. The empty service name
+// stands for the whole node: NOT_SERVING withdraws its registration and SERVING restores it.
+func (s *Service) SetServingStatus(service string, status healthpb.HealthCheckResponse_ServingStatus) (err error) {
+	s.healthServer.SetServingStatus(service, status)
+	if service != "" {
+		return
+	}
+	if status == healthpb.HealthCheckResponse_SERVING {
+		return s.register(context.Background())
+	}
+	s.unregister(context.Background())
+	return
 }
-func (s *Service) handleSignal() {
+
+// register puts the node into the registry if the service is started and healthy.
+func (s *Service) register(ctx context.Context) (err error) {
+	s.registryMu.Lock()
+	defer s.registryMu.Unlock()
+	s.mu.Lock()
+	skip := s.registry == nil || s.registered || !s.started
+	s.mu.Unlock()
+	if skip {
+		return
+	}
+	if !s.healthServer.Serving() {
+		return
+	}
+	//advertise the grpc services registered so far
+	nodeData := s.nodeData
+	nodeData.Services = s.ServiceNames()
+	err = s.registry.Register(ctx, s.name, s.nodeId, nodeData)
+	if err == nil {
+		s.mu.Lock()
+		s.registered = true
+		s.mu.Unlock()
+	}
+	return
+}
+
+// Registered reports whether the node is registered. With the etcd registry the lease of the node must be
+// live too, it is false while the registry is registering the node again after the lease was lost.
+func (s *Service) Registered() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.registered {
+		return false
+	}
+	if r, ok := s.registry.(interface {
+		Registered() bool
+	}); ok {
+		return r.Registered()
+	}
+	return true
+}
+
+// ServiceNames returns the full names of the protobuf services registered on GrpcServer, which the node
+// advertises in the registry besides Config.Name. The grpc health service is left out.
+func (s *Service) ServiceNames() (names []string) {
+	for name := range s.GrpcServer.GetServiceInfo() {
+		if name != healthServiceName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// unregister removes the node from the registry and reports whether it was registered. The registry
+// call is bounded by ctx and constant.DEFAULT_DEREGISTER_TIMEOUT, so an unreachable registry cannot block
+// the shutdown; the node then leaves the registry once its lease or session expires.
+func (s *Service) unregister(ctx context.Context) (wasRegistered bool) {
+	var (
+		cancel context.CancelFunc
+		err    error
+		done   = make(chan error, 1)
+	)
+	s.registryMu.Lock()
+	defer s.registryMu.Unlock()
+	s.mu.Lock()
+	wasRegistered = s.registered
+	s.registered = false
+	s.mu.Unlock()
+	if !wasRegistered {
+		return
+	}
+	ctx, cancel = context.WithTimeout(ctx, constant.DEFAULT_DEREGISTER_TIMEOUT)
+	defer cancel()
+	//not every registry honors ctx
+	go func() {
+		done <- s.registry.Deregister(ctx)
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		log.Println("deregister service error:", err)
+	}
+	return
+}
+
+// drain gracefully stops the grpc server and the monitor server, forcing them closed once ctx is done.
+func (s *Service) drain(ctx context.Context) (err error) {
+	var (
+		stopped = make(chan struct{})
+	)
+	go func() {
+		s.GrpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.GrpcServer.Stop()
+		<-stopped
+		err = ctx.Err()
+	}
+	if s.monitorHttpServer != nil {
+		if ctx.Err() != nil {
+			s.monitorHttpServer.Close()
+		} else if shutdownErr := s.monitorHttpServer.Shutdown(ctx); shutdownErr != nil && err == nil {
+			err = shutdownErr
+		}
+	}
+	return
+}
+
+// Run starts the service and blocks until a system signal arrives or the service fails.
+// SIGHUP hands the listeners over to a new process and drains this one once the new process is ready.
+func (s *Service) Run() (err error) {
+	err = s.Start(context.Background())
+	if err != nil {
+		return
+	}
+	graceful.Ready()
+	return s.handleSignal()
+}
+func (s *Service) handleSignal() (err error) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(c)
 	for {
-		systemSignal := <-c
-		log.Println("server get a signal ", systemSignal.String())
-		switch systemSignal {
-		case syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT:
-			signal.Stop(c)
-			s.GrpcServer.GracefulStop()
+		select {
+		case err = <-s.errc:
+			log.Println("server stopped serving: ", err)
+			s.Stop(context.Background())
 			return
-		case syscall.SIGHUP:
-			signal.Stop(c)
-			s.GrpcServer.GracefulStop()
-			cmd := exec.Command(os.Args[0], os.Args[1:]...)
-			err := cmd.Start()
-			if err != nil {
-				log.Println("cmd.Start fail: ", err)
-				return
+		case systemSignal := <-c:
+			log.Println("server get a signal ", systemSignal.String())
+			if systemSignal == syscall.SIGHUP {
+				pid, restartErr := graceful.Restart(s.restartTimeout)
+				if restartErr != nil {
+					log.Println("restart fail: ", restartErr)
+					continue
+				}
+				log.Println("forked new pid : ", pid)
+				signal.Stop(c)
+				//the new process has taken over the listeners and the registration
+				ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+				defer cancel()
+				return s.drain(ctx)
 			}
-			log.Println("forked new pid : ", cmd.Process.Pid)
-			return
-		default:
 			signal.Stop(c)
-			s.GrpcServer.GracefulStop()
-			return
+			return s.Stop(context.Background())
 		}
 	}
 }
+
+// AuthFunc authenticates the caller by the access token ("Basic" scheme) or, when a JWT verifier is
+// configured, by a JWT ("Bearer" scheme) whose claims are then available through jwt.FromContext(ctx).
+// A bearer token that is present must be valid even if the access token matches, so that services can
+// rely on the claims forwarded by the gateway. With TLS enabled, the caller's certificate is available
+// through credential.PeerCertificate(ctx).
 func (s *Service) AuthFunc(ctx context.Context) (context.Context, error) {
-	accessToken, err := grpc_auth.AuthFromMD(ctx, "Basic")
-	if err != nil {
-		return nil, err
-	}
-	if accessToken == "" {
-		return nil, grpc_error.Internal()
+	var (
+		authenticated bool
+		accessToken   = s.accessToken.Load().(string)
+	)
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md["authorization"] {
+		scheme, token := jwt.SplitAuthorization(value)
+		if token == "" {
+			continue
+		}
+		switch {
+		case strings.EqualFold(scheme, "basic") && accessToken != "":
+			if subtle.ConstantTimeCompare([]byte(token), []byte(accessToken)) == 1 {
+				authenticated = true
+			}
+		case strings.EqualFold(scheme, "bearer") && s.jwtVerifier != nil:
+			claims, err := s.jwtVerifier.Verify(token)
+			if err != nil {
+				return nil, grpc_error.Unauthenticated()
+			}
+			ctx = jwt.NewContext(ctx, claims)
+			authenticated = true
+		}
 	}
-	if accessToken != s.AccessToken {
-		return nil, grpc_error.Internal()
+	if !authenticated {
+		return nil, grpc_error.Unauthenticated()
 	}
 	return ctx, nil
 }
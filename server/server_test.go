@@ -0,0 +1,322 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chuangyou/qsf/internal/etcdtest"
+	"github.com/chuangyou/qsf/plugin/config"
+	"github.com/chuangyou/qsf/plugin/health"
+	"github.com/chuangyou/qsf/plugin/ratelimit"
+	etcd3 "github.com/coreos/etcd/clientv3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+func freeAddr(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+	return lis.Addr().String()
+}
+
+func TestServiceNames(t *testing.T) {
+	s := &Service{GrpcServer: grpc.NewServer()}
+	healthpb.RegisterHealthServer(s.GrpcServer, health.NewServer())
+	for _, name := range []string{"test.v1.User", "test.v1.Admin"} {
+		s.GrpcServer.RegisterService(&grpc.ServiceDesc{ServiceName: name, HandlerType: (*interface{})(nil)}, struct{}{})
+	}
+	assert.Equal(t, []string{"test.v1.Admin", "test.v1.User"}, s.ServiceNames())
+}
+
+func TestStartBindError(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer busy.Close()
+
+	s, err := NewSevice(&Config{Name: "example", Addr: busy.Addr().String(), NodeId: "node-1"})
+	require.NoError(t, err)
+	assert.Error(t, s.Start(context.Background()))
+
+	// the grpc listener is released when the monitor server fails to bind
+	addr := freeAddr(t)
+	s, err = NewSevice(&Config{Name: "example", Addr: addr, NodeId: "node-1", MonitorListenAddr: busy.Addr().String()})
+	require.NoError(t, err)
+	assert.Error(t, s.Start(context.Background()))
+	lis, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	lis.Close()
+}
+
+func TestSeveralServices(t *testing.T) {
+	etcd, err := etcdtest.NewServer()
+	require.NoError(t, err)
+	defer etcd.Close()
+
+	services := make([]*Service, 0, 2)
+	for _, nodeID := range []string{"node-1", "node-2"} {
+		s, err := NewSevice(&Config{Name: "example", Addr: freeAddr(t), NodeId: nodeID, RegistryAddrs: etcd.Endpoints(),
+			MonitorListenAddr: freeAddr(t)})
+		require.NoError(t, err)
+		require.NoError(t, s.Start(context.Background()))
+		services = append(services, s)
+	}
+	assert.Equal(t, []string{"/qsf.service/example/node-1", "/qsf.service/example/node-2"}, etcd.Keys("/qsf.service/"))
+	for _, s := range services {
+		conn, err := grpc.Dial(s.Addr, grpc.WithInsecure())
+		require.NoError(t, err)
+		resp, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+		conn.Close()
+		require.NoError(t, err)
+		assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+	}
+
+	// stopping one service leaves the other serving
+	require.NoError(t, services[0].Stop(context.Background()))
+	assert.Equal(t, []string{"/qsf.service/example/node-2"}, etcd.Keys("/qsf.service/"))
+	conn, err := grpc.Dial(services[1].Addr, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	assert.NoError(t, err)
+	require.NoError(t, services[1].Stop(context.Background()))
+	assert.Empty(t, etcd.Keys("/qsf.service/"))
+}
+
+func TestRegistered(t *testing.T) {
+	etcd, err := etcdtest.NewServer()
+	require.NoError(t, err)
+	defer etcd.Close()
+	s, err := NewSevice(&Config{Name: "example", Addr: freeAddr(t), NodeId: "node-1", RegistryAddrs: etcd.Endpoints()})
+	require.NoError(t, err)
+	assert.False(t, s.Registered())
+	require.NoError(t, s.Start(context.Background()))
+	assert.True(t, s.Registered())
+	assert.Equal(t, []string{"/qsf.service/example/node-1"}, etcd.Keys("/qsf.service/"))
+
+	require.NoError(t, s.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING))
+	assert.False(t, s.Registered())
+	assert.Empty(t, etcd.Keys("/qsf.service/"))
+	require.NoError(t, s.SetServingStatus("", healthpb.HealthCheckResponse_SERVING))
+	assert.True(t, s.Registered())
+
+	require.NoError(t, s.Stop(context.Background()))
+	assert.False(t, s.Registered())
+	assert.Empty(t, etcd.Keys("/qsf.service/"))
+}
+
+func TestConfigCenter(t *testing.T) {
+	etcd, err := etcdtest.NewServer()
+	require.NoError(t, err)
+	defer etcd.Close()
+	etcd.Put("/qsf.config/example/"+ratelimit.ConfigItem, `{"rate": 20}`)
+	center, err := config.New(config.Option{EtcdConfig: etcd3.Config{Endpoints: etcd.Endpoints()}, Service: "example"})
+	require.NoError(t, err)
+	defer center.Close()
+
+	rl := ratelimit.New(10, time.Second)
+	s, err := NewSevice(&Config{Name: "example", Addr: "127.0.0.1:0", NodeId: "node-1", AccessToken: "old", RateLimter: rl, ConfigCenter: center})
+	require.NoError(t, err)
+	assert.Equal(t, 20, rl.Rate())
+
+	auth := func(token string) error {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "basic "+token))
+		_, err := s.AuthFunc(ctx)
+		return err
+	}
+	assert.NoError(t, auth("old"))
+	etcd.Put("/qsf.config/example/"+config.AuthItem, "accessToken: new")
+	deadline := time.Now().Add(10 * time.Second)
+	for auth("new") != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, auth("new"))
+	assert.Error(t, auth("old"))
+}
+
+func TestDistributedLimit(t *testing.T) {
+	etcd, err := etcdtest.NewServer()
+	require.NoError(t, err)
+	defer etcd.Close()
+	center, err := config.New(config.Option{EtcdConfig: etcd3.Config{Endpoints: etcd.Endpoints()}, Service: "example"})
+	require.NoError(t, err)
+	defer center.Close()
+
+	services := make([]*Service, 0, 2)
+	for _, nodeID := range []string{"node-1", "node-2"} {
+		s, err := NewSevice(&Config{Name: "example", Addr: "127.0.0.1:0", NodeId: nodeID, RegistryAddrs: etcd.Endpoints(),
+			DistributedLimit: &ratelimit.DistributedOption{Quota: 10, Ttl: time.Second}, ConfigCenter: center})
+		require.NoError(t, err)
+		services = append(services, s)
+	}
+	// the nodes take their share once they serve
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, etcd.Keys("/qsf.ratelimit/"))
+	for _, s := range services {
+		require.NoError(t, s.Start(context.Background()))
+	}
+	waitRates := func(rates ...int) {
+		current := func() []int {
+			list := []int{}
+			for _, s := range services[:len(rates)] {
+				list = append(list, s.distributed.RateLimiter().Rate())
+			}
+			return list
+		}
+		deadline := time.Now().Add(10 * time.Second)
+		for !assert.ObjectsAreEqual(rates, current()) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.Equal(t, rates, current())
+	}
+	waitRates(5, 5)
+	assert.Equal(t, []string{"/qsf.ratelimit/example/node-1", "/qsf.ratelimit/example/node-2"}, etcd.Keys("/qsf.ratelimit/"))
+
+	// the configured rate is the quota of the cluster
+	etcd.Put("/qsf.config/example/"+ratelimit.ConfigItem, `{"rate": 30}`)
+	waitRates(15, 15)
+
+	require.NoError(t, services[1].Stop(context.Background()))
+	waitRates(30)
+	require.NoError(t, services[0].Stop(context.Background()))
+	assert.Empty(t, etcd.Keys("/qsf.ratelimit/"))
+}
+
+func TestNewSeviceUnwinds(t *testing.T) {
+	etcd, err := etcdtest.NewServer()
+	require.NoError(t, err)
+	defer etcd.Close()
+	center, err := config.New(config.Option{EtcdConfig: etcd3.Config{Endpoints: etcd.Endpoints()}, Service: "example"})
+	require.NoError(t, err)
+	defer center.Close()
+
+	// the registry fails after the rate limiter subscribed to the config center
+	limiter := ratelimit.New(10, time.Second)
+	_, err = NewSevice(&Config{Name: "example", Addr: "127.0.0.1:0", NodeId: "node-1", RegistryKind: "unknown",
+		RateLimter: limiter, ConfigCenter: center})
+	require.Error(t, err)
+
+	other := ratelimit.New(10, time.Second)
+	cancel, err := ratelimit.Watch(center, other)
+	require.NoError(t, err)
+	defer cancel()
+	etcd.Put("/qsf.config/example/"+ratelimit.ConfigItem, `{"rate": 30}`)
+	deadline := time.Now().Add(5 * time.Second)
+	for other.Rate() != 30 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, 30, other.Rate())
+	assert.Equal(t, 10, limiter.Rate(), "the subscription of the failed service was canceled")
+}
+
+func TestStopDeregistersFirst(t *testing.T) {
+	etcd, err := etcdtest.NewServer()
+	require.NoError(t, err)
+	defer etcd.Close()
+	s, err := NewSevice(&Config{Name: "example", Addr: freeAddr(t), NodeId: "node-1", RegistryAddrs: etcd.Endpoints(),
+		DeregisterDelay: 500 * time.Millisecond})
+	require.NoError(t, err)
+	require.NoError(t, s.Start(context.Background()))
+	assert.Equal(t, []string{"/qsf.service/example/node-1"}, etcd.Keys("/qsf.service/"))
+	conn, err := grpc.Dial(s.Addr, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	begin := time.Now()
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Stop(context.Background())
+	}()
+	time.Sleep(200 * time.Millisecond)
+	// the node left the registry but still serves until DeregisterDelay ends
+	assert.Empty(t, etcd.Keys("/qsf.service/"))
+	_, err = healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	assert.NoError(t, err)
+	select {
+	case <-stopped:
+		t.Fatal("stopped before DeregisterDelay")
+	default:
+	}
+	require.NoError(t, <-stopped)
+	assert.True(t, time.Since(begin) >= 500*time.Millisecond)
+}
+
+func TestStopForcesStuckStream(t *testing.T) {
+	s, err := NewSevice(&Config{Name: "example", Addr: freeAddr(t), NodeId: "node-1",
+		ShutdownTimeout: 200 * time.Millisecond})
+	require.NoError(t, err)
+	handling := make(chan struct{})
+	s.GrpcServer.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "test.v1.Stuck",
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName: "Wait",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				close(handling)
+				<-stream.Context().Done()
+				return stream.Context().Err()
+			},
+			ServerStreams: true,
+			ClientStreams: true,
+		}},
+	}, struct{}{})
+	require.NoError(t, s.Start(context.Background()))
+	conn, err := grpc.Dial(s.Addr, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	stream, err := conn.NewStream(context.Background(), &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, "/test.v1.Stuck/Wait")
+	require.NoError(t, err)
+	select {
+	case <-handling:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not handled")
+	}
+
+	// the stream never ends by itself, it is closed once ShutdownTimeout expires
+	begin := time.Now()
+	assert.Equal(t, context.DeadlineExceeded, s.Stop(context.Background()))
+	elapsed := time.Since(begin)
+	assert.True(t, elapsed >= 200*time.Millisecond && elapsed < 5*time.Second, elapsed.String())
+	assert.Error(t, stream.RecvMsg(&struct{}{}))
+}
+
+func TestStopUnreachableRegistry(t *testing.T) {
+	etcd, err := etcdtest.NewServer()
+	require.NoError(t, err)
+	s, err := NewSevice(&Config{Name: "example", Addr: freeAddr(t), NodeId: "node-1", RegistryAddrs: etcd.Endpoints()})
+	require.NoError(t, err)
+	require.NoError(t, s.Start(context.Background()))
+	require.True(t, s.Registered())
+	etcd.Close()
+
+	// the deregistration gives up with the ctx of Stop
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Stop(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	registered := make(chan bool, 1)
+	go func() {
+		registered <- s.Registered()
+	}()
+	select {
+	case ok := <-registered:
+		assert.False(t, ok)
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("Registered blocked by the deregistration")
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop blocked by the unreachable registry")
+	}
+	assert.True(t, time.Since(begin) >= 500*time.Millisecond)
+}